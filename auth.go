@@ -2,13 +2,27 @@ package wail
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"net"
 	"net/smtp"
+	"strings"
 
 	"golang.org/x/oauth2"
 )
 
+// ErrTokenRefresh is returned by Dial when an OAuth 2.0 access token can't
+// be obtained, e.g. the token endpoint is unavailable. The error is usually
+// temporary and the Dial may be retried later. Unwrap it to get the cause
+// (e.g. *oauth2.RetrieveError)
+var ErrTokenRefresh = errors.New("wail: failed to refresh OAuth 2.0 token")
+
+// ErrAuthFailed is returned by Dial when the server rejects the credentials,
+// e.g. with "535 5.7.8 Authentication failed". Unwrap it to get the server
+// response (*textproto.Error)
+var ErrAuthFailed = errors.New("wail: authentication failed")
+
 type authLogin struct {
 	username string
 	password string
@@ -19,6 +33,24 @@ type authXoAuth2 struct {
 	token    oauth2.TokenSource
 }
 
+type authOAuthBearer struct {
+	username string
+	host     string
+	token    oauth2.TokenSource
+}
+
+// tlsAuth tells the mechanism that the connection is encrypted
+type tlsAuth struct {
+	smtp.Auth
+}
+
+func (a tlsAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	info := *server
+	info.TLS = true
+
+	return a.Auth.Start(&info)
+}
+
 func LoginAuth(username, password string) smtp.Auth {
 	return &authLogin{
 		username: username,
@@ -36,10 +68,12 @@ func (l *authLogin) Start(server *smtp.ServerInfo) (string, []byte, error) {
 
 func (l *authLogin) Next(fromServer []byte, more bool) ([]byte, error) {
 	if more {
+		prompt := loginPrompt(fromServer)
+
 		switch {
-		case bytes.Contains(fromServer, []byte("Username")):
+		case bytes.Contains(prompt, []byte("user")):
 			return []byte(l.username), nil
-		case bytes.Contains(fromServer, []byte("Password")):
+		case bytes.Contains(prompt, []byte("pass")):
 			return []byte(l.password), nil
 		default:
 			return nil, errors.New("wail: unknown command from server")
@@ -49,6 +83,33 @@ func (l *authLogin) Next(fromServer []byte, more bool) ([]byte, error) {
 	return nil, nil
 }
 
+// loginPrompt normalizes a LOGIN challenge. Servers send different
+// prompts ("Username:", "User Name", "username") and some of them
+// encode the prompt twice, so net/smtp passes it still base64-encoded
+func loginPrompt(fromServer []byte) []byte {
+	prompt := bytes.TrimSpace(fromServer)
+
+	if decoded, err := base64.StdEncoding.DecodeString(string(prompt)); err == nil && isPrintableASCII(decoded) {
+		prompt = decoded
+	}
+
+	return bytes.ToLower(prompt)
+}
+
+func isPrintableASCII(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+
+	for _, c := range b {
+		if c < ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
 func XoAuth2Auth(username string, token oauth2.TokenSource) smtp.Auth {
 	return &authXoAuth2{
 		username: username,
@@ -63,7 +124,7 @@ func (x *authXoAuth2) Start(server *smtp.ServerInfo) (string, []byte, error) {
 
 	t, err := x.token.Token()
 	if err != nil {
-		return "", nil, errors.New("wail: failed to get token")
+		return "", nil, tokenError(err)
 	}
 
 	oauth2 := fmt.Sprintf("user=%v\001auth=%v %v\001\001", x.username, t.Type(), t.AccessToken)
@@ -78,3 +139,58 @@ func (x *authXoAuth2) Next(fromServer []byte, more bool) ([]byte, error) {
 
 	return nil, nil
 }
+
+// OAuthBearerAuth returns an smtp.Auth that implements the OAUTHBEARER
+// mechanism (RFC 7628). The host may contain a port, e.g. "smtp.example.com:587"
+func OAuthBearerAuth(username, host string, token oauth2.TokenSource) smtp.Auth {
+	return &authOAuthBearer{
+		username: username,
+		host:     host,
+		token:    token,
+	}
+}
+
+func (o *authOAuthBearer) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("wail: unencrypted connection")
+	}
+
+	t, err := o.token.Token()
+	if err != nil {
+		return "", nil, tokenError(err)
+	}
+
+	host, port, err := net.SplitHostPort(o.host)
+	if err != nil {
+		host, port = o.host, ""
+	}
+
+	resp := fmt.Sprintf("n,a=%s,\001host=%s\001", saslName(o.username), host)
+
+	if port != "" {
+		resp += fmt.Sprintf("port=%s\001", port)
+	}
+
+	resp += fmt.Sprintf("auth=Bearer %s\001\001", t.AccessToken)
+
+	return "OAUTHBEARER", []byte(resp), nil
+}
+
+// Next answers an error challenge with a dummy response (a single ^A)
+// as RFC 7628 requires, so the server completes the exchange with an error
+func (o *authOAuthBearer) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{'\001'}, nil
+	}
+
+	return nil, nil
+}
+
+// saslName escapes "," and "=" in the authorization identity (RFC 5801)
+func saslName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+func tokenError(err error) error {
+	return fmt.Errorf("%w (%w)", ErrTokenRefresh, err)
+}
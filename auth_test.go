@@ -0,0 +1,151 @@
+package wail
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/smtp"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestLoginAuthNext(t *testing.T) {
+	auth := LoginAuth("user@example.com", "secret")
+
+	prompts := map[string]string{
+		"Username:":  "user@example.com",
+		"User Name":  "user@example.com",
+		"username":   "user@example.com",
+		"Password:":  "secret",
+		"PASSWORD":   "secret",
+		"  Pass:   ": "secret",
+		base64.StdEncoding.EncodeToString([]byte("Username:")): "user@example.com",
+		base64.StdEncoding.EncodeToString([]byte("Password:")): "secret",
+	}
+
+	for prompt, expect := range prompts {
+		resp, err := auth.Next([]byte(prompt), true)
+		if err != nil {
+			t.Errorf("Unexpected error for prompt %q: %v", prompt, err)
+		} else if string(resp) != expect {
+			t.Errorf("Invalid response for prompt %q, expect %s, got %s", prompt, expect, resp)
+		}
+	}
+
+	if _, err := auth.Next([]byte("Hello"), true); err == nil {
+		t.Error("An unknown prompt should return an error")
+	}
+
+	if resp, err := auth.Next(nil, false); resp != nil || err != nil {
+		t.Error("No response is expected when the server has nothing more to say")
+	}
+}
+
+func TestOAuthBearerAuth(t *testing.T) {
+	token := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "vF9dft4qmT"})
+
+	auth := OAuthBearerAuth("user,1@example.com", "smtp.example.com:587", token)
+
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com"}); err == nil {
+		t.Error("OAUTHBEARER should not be used over an unencrypted connection")
+	}
+
+	mech, resp, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "n,a=user=2C1@example.com,\x01host=smtp.example.com\x01port=587\x01auth=Bearer vF9dft4qmT\x01\x01"
+
+	if mech != "OAUTHBEARER" || string(resp) != expect {
+		t.Errorf("Invalid initial response %s %q, expect %q", mech, resp, expect)
+	}
+
+	next, err := auth.Next([]byte(`{"status":"invalid_token"}`), true)
+	if err != nil || string(next) != "\x01" {
+		t.Errorf("An error challenge should be answered with ^A, got %q (%v)", next, err)
+	}
+}
+
+func TestChooseAuthMechanism(t *testing.T) {
+	tests := []struct {
+		advertised string
+		preferred  []string
+		expect     string
+	}{
+		{"LOGIN PLAIN", nil, "PLAIN"},
+		{"LOGIN PLAIN CRAM-MD5", nil, "PLAIN"},
+		{"LOGIN CRAM-MD5", nil, "CRAM-MD5"},
+		{"LOGIN", nil, "LOGIN"},
+		{"LOGIN PLAIN", []string{"LOGIN", "PLAIN"}, "LOGIN"},
+		{"XOAUTH2 PLAIN-CLIENTTOKEN", nil, ""},
+	}
+
+	for _, tt := range tests {
+		if m := chooseAuthMechanism(tt.advertised, tt.preferred); m != tt.expect {
+			t.Errorf("Invalid mechanism for %q (%v), expect %q, got %q", tt.advertised, tt.preferred, tt.expect, m)
+		}
+	}
+}
+
+type countingTokenSource struct {
+	n   int
+	err error
+}
+
+func (c *countingTokenSource) Token() (*oauth2.Token, error) {
+	c.n++
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return &oauth2.Token{AccessToken: "vF9dft4qmT", Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+func TestTokenCaching(t *testing.T) {
+	ts := &countingTokenSource{}
+
+	cfg := &SmtpConfig{Sender: SenderConfig{Login: "user@example.com", TokenSource: ts}}
+
+	c := NewClient(cfg)
+	p := NewClientPool(cfg, PoolConfig{})
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.tokens.Token(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ts.n != 1 {
+		t.Errorf("A valid token should be reused, got %d requests", ts.n)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.tokens.Token(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ts.n != 2 {
+		t.Errorf("The pool should request its token once, got %d requests", ts.n-1)
+	}
+}
+
+func TestTokenRefreshError(t *testing.T) {
+	cause := &oauth2.RetrieveError{ErrorCode: "temporarily_unavailable"}
+
+	for _, auth := range []smtp.Auth{
+		XoAuth2Auth("user@example.com", &countingTokenSource{err: cause}),
+		OAuthBearerAuth("user@example.com", "smtp.example.com:587", &countingTokenSource{err: cause}),
+	} {
+		_, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+
+		var re *oauth2.RetrieveError
+
+		if !errors.Is(err, ErrTokenRefresh) || !errors.As(err, &re) {
+			t.Errorf("Expect ErrTokenRefresh wrapping the cause, got %v", err)
+		}
+	}
+}
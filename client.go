@@ -1,15 +1,28 @@
 package wail
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
 )
 
 // SenderConfig contains information about the sender
@@ -23,6 +36,29 @@ type SenderConfig struct {
 
 	// Password from your email account. It is used for authentication on server
 	Password string
+
+	// PasswordFunc returns the password from your email account. If it's set,
+	// it takes precedence over Password and is called by Dial right before
+	// authentication. Use it to fetch the password from a secret manager
+	// instead of keeping it in the config
+	PasswordFunc func() (string, error)
+
+	// AuthIdentity is an authorization identity (authzid) used by the PLAIN
+	// mechanism. Set it if you send on behalf of another account (e.g. a shared
+	// mailbox). Leave it empty to act as the account specified in Login
+	AuthIdentity string
+
+	// TokenSource provides OAuth 2.0 access tokens. If it's set, Dial
+	// authenticates with the OAUTHBEARER or XOAUTH2 mechanism instead
+	// of the password. The client caches tokens with oauth2.ReuseTokenSource,
+	// so pass a source that is able to refresh them (e.g. the one returned
+	// by oauth2.Config.TokenSource) rather than a static token
+	TokenSource oauth2.TokenSource
+
+	// AuthMechanisms contains password authentication mechanisms (PLAIN, LOGIN,
+	// CRAM-MD5) in order of preference. By default PLAIN is preferred, then
+	// CRAM-MD5 and LOGIN
+	AuthMechanisms []string
 }
 
 type encryption int
@@ -58,18 +94,63 @@ type ServerConfig struct {
 
 	ConnectTimeout time.Duration
 
+	// RcptTimeout is a maximum time to wait for the server to accept a single
+	// recipient. Some servers verify recipients with callbacks, so one slow
+	// recipient may stall sending. Zero value means no limit
+	RcptTimeout time.Duration
+
 	// NeedAuth is used to indicate that the server
-	// demands an authentication before sending emails
+	// demands an authentication before sending emails.
+	// If it's false, the client never authenticates, even
+	// if the server advertises AUTH (e.g. a relay that
+	// trusts the sender IP)
 	NeedAuth bool
 
 	// EncryptType is an encryption type (SSL, TLS or none)
 	EncryptType encryption
 
+	// MaxConcurrentDials limits the number of clients connecting to the
+	// server at the same time, so a burst of Dials doesn't exceed the
+	// connection limit of the server. The limit is shared by all clients
+	// (pooled or not) with the same server address. The first limit set
+	// for the address is used, the later ones are ignored. If the
+	// ConnectTimeout is set, it also limits waiting for a free slot.
+	// Zero value means no limit
+	MaxConcurrentDials int
+
+	// ReadBufferSize and WriteBufferSize are sizes of the connection buffers
+	// in bytes. Bigger buffers may speed up sending of large messages.
+	// Zero value means the default size (4096 bytes)
+	ReadBufferSize  int
+	WriteBufferSize int
+
 	// maxMsgSize is a maximum message size that can be sent to the server.
 	// This field is set only if the server returns the SIZE extension
 	maxMsgSize uint
 }
 
+func (c *ServerConfig) address() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(int(c.Port)))
+}
+
+// DefaultTLSConfig returns the TLS configuration used when the TlsConfig
+// is nil. It requires TLS 1.2 or later and allows only AEAD cipher suites
+// with forward secrecy for TLS 1.2. Use it as a starting point to make
+// a custom configuration
+func DefaultTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
+
 // SmtpConfig contains information required for establishing connection
 // and generating message
 type SmtpConfig struct {
@@ -80,63 +161,450 @@ type SmtpConfig struct {
 	Sender SenderConfig
 
 	// TlsConfig is the TLS configuration used for TLS or SSL connections.
+	// DefaultTLSConfig is used if it's nil. The ServerName of its copy
+	// is set to the server host unless the InsecureSkipVerify is set.
 	//
 	// Note: leave the default value if you don't know how to use it
 	TlsConfig *tls.Config
+
+	// VerifyConnection is called after the TLS handshake, e.g. to pin
+	// the certificate of a relay. It runs after the standard verification
+	// (if it isn't skipped) and the VerifyConnection of the TlsConfig (if
+	// it's set). The connection is aborted if it returns an error
+	VerifyConnection func(tls.ConnectionState) error
+
+	// RateLimit is a maximum number of messages sent per second.
+	// Use it to comply with the provider quotas. Zero value means no limit
+	RateLimit float64
+
+	// SeparateBccDelivery makes Send deliver the mail to each Bcc recipient
+	// in a separate transaction. It guarantees that other recipients can't
+	// find out about Bcc recipients even if the server exposes RCPT lists
+	SeparateBccDelivery bool
+
+	// ExpectedStatus is an enhanced status code (RFC 3463) that the final
+	// response of the transaction must contain, e.g. "2.0.0". If it's set
+	// and the server replies with another one, Send returns an error even
+	// though the message has been accepted. Leave it empty to accept any 250
+	ExpectedStatus string
+
+	// BeforeSend is called with the assembled message right before the
+	// mail transaction starts. The returned bytes are sent instead of the
+	// message, so it may be used to sign or stamp it. If BeforeSend returns
+	// an error the mail is not sent
+	BeforeSend func(raw []byte) ([]byte, error)
+
+	// OnProgress is called while the message content is being sent,
+	// every 64 KiB and once the whole content is written. The total
+	// is -1 if the size isn't known (e.g. SendReader)
+	OnProgress func(written, total int64)
+
+	// Compress enables the DEFLATE compression of the session if the
+	// server advertises the COMPRESS extension. It reduces the traffic
+	// of large messages over metered links
+	Compress bool
+
+	// Reconnect configures restoring of a broken connection by Send
+	Reconnect ReconnectConfig
+
+	// FallbackServers are tried in order if the server is unavailable. If
+	// the connection breaks or the server rejects the message temporarily
+	// (4xx), Send submits the same assembled message to the next fallback
+	// server. The next mail is sent to the primary server again. Use
+	// LastResponse to find out which server has accepted the message
+	FallbackServers []ServerConfig
+
+	// Helo is a fully qualified domain name of the client sent in the EHLO
+	// command. By default the hostname is used if it's qualified, otherwise
+	// the address literal of the connection (e.g. [192.0.2.1]). An IP
+	// address is turned into the address literal (192.0.2.1 becomes [192.0.2.1])
+	Helo string
+
+	// HeloAddressLiteral makes the client send the address literal of the
+	// local outbound IP in the EHLO command instead of the hostname. Some
+	// servers require it to match the connecting IP. It's ignored if Helo is set
+	HeloAddressLiteral bool
+
+	// SentFolder is the IMAP folder every sent mail is saved to with
+	// the \Seen flag, as SMTP doesn't do it. A mail is saved once all its
+	// transactions succeed, even if it's sent in several ones (e.g. to
+	// groups or separate Bcc recipients). Nil value means no saving
+	SentFolder *ImapConfig
+}
+
+// ReconnectConfig contains settings of restoring a connection
+// that has been broken since the previous Send
+type ReconnectConfig struct {
+	// Attempts is a maximum number of attempts to reconnect. Default is 1
+	Attempts int
+
+	// Backoff is a delay after the first failed attempt. It's doubled after
+	// each next failed attempt up to MaxBackoff. Default is 1 second.
+	// If the server rejects the attempt with a 4xx reply containing a retry
+	// hint (e.g. "Retry-After: 60" or "try again in 5 minutes"), the hinted
+	// delay is used instead
+	Backoff time.Duration
+
+	// MaxBackoff is a maximum delay between attempts, including the one
+	// hinted by the server. Default is 30 seconds
+	MaxBackoff time.Duration
+}
+
+// Validate checks the config for mistakes and returns an error listing
+// all of them. Dial calls it before connecting to the server. Suspicious
+// settings that may still work are reported by Warnings instead
+func (c *SmtpConfig) Validate() error {
+	var errs []error
+
+	errs = append(errs, c.Server.validate("server")...)
+
+	for i := range c.FallbackServers {
+		errs = append(errs, c.FallbackServers[i].validate(fmt.Sprintf("fallback server %d", i+1))...)
+	}
+
+	needAuth := c.Server.NeedAuth
+	for _, srv := range c.FallbackServers {
+		needAuth = needAuth || srv.NeedAuth
+	}
+
+	if needAuth {
+		if c.Sender.Login == "" {
+			errs = append(errs, errors.New("wail: sender login is not specified"))
+		}
+
+		if c.Sender.TokenSource == nil && c.Sender.Password == "" && c.Sender.PasswordFunc == nil {
+			errs = append(errs, errors.New("wail: sender password or token source is not specified"))
+		}
+	}
+
+	if c.RateLimit < 0 {
+		errs = append(errs, fmt.Errorf("wail: rate limit %v is negative", c.RateLimit))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Warnings returns the suspicious settings that don't prevent Dial but
+// usually mean a mistake, e.g. EncryptSSL on port 587 which expects STARTTLS.
+// It returns nil if there are none
+func (c *SmtpConfig) Warnings() error {
+	warnings := c.Server.warnings("server")
+
+	for i := range c.FallbackServers {
+		warnings = append(warnings, c.FallbackServers[i].warnings(fmt.Sprintf("fallback server %d", i+1))...)
+	}
+
+	return errors.Join(warnings...)
+}
+
+// warnings checks the encryption type matches the well-known port
+func (c *ServerConfig) warnings(name string) []error {
+	switch {
+	case c.EncryptType == EncryptSSL && (c.Port == 25 || c.Port == 587):
+		return []error{fmt.Errorf("wail: %s port %d expects STARTTLS, use EncryptTLS instead of EncryptSSL", name, c.Port)}
+	case c.EncryptType == EncryptTLS && c.Port == 465:
+		return []error{fmt.Errorf("wail: %s port 465 expects implicit TLS, use EncryptSSL instead of EncryptTLS", name)}
+	}
+
+	return nil
+}
+
+// validate checks the server config. name is used in error messages
+func (c *ServerConfig) validate(name string) []error {
+	var errs []error
+
+	if c.Host == "" {
+		errs = append(errs, fmt.Errorf("wail: %s host is not specified", name))
+	}
+
+	if c.MaxConcurrentDials < 0 {
+		errs = append(errs, fmt.Errorf("wail: %s max concurrent dials %d is negative", name, c.MaxConcurrentDials))
+	}
+
+	if c.Port == 0 {
+		errs = append(errs, fmt.Errorf("wail: %s port is not specified", name))
+	}
+
+	if c.EncryptType > EncryptNone || c.EncryptType < EncryptSSL {
+		errs = append(errs, fmt.Errorf("wail: %s encryption type %d is unknown", name, c.EncryptType))
+	}
+
+	if c.ConnectTimeout < 0 || c.RcptTimeout < 0 {
+		errs = append(errs, fmt.Errorf("wail: %s timeouts must not be negative", name))
+	}
+
+	return errs
 }
 
 // SmtpClient represents a client that negotiate with the server
 type SmtpClient struct {
 	cfg    *SmtpConfig
 	client *smtp.Client
+
+	// server is the config of the server the client is connected to.
+	// serverIdx is its index among the server and the fallback ones
+	server    *ServerConfig
+	serverIdx int
+
+	// failedOver is set when a message has been submitted to a fallback
+	// server, so the next mail reconnects starting with the primary one
+	failedOver bool
+
+	// conn is the connection used by the client. It's
+	// kept to set deadlines of the commands
+	conn net.Conn
+
+	// deadline is the deadline of the current Send (if any)
+	deadline time.Time
+
+	// limiter throttles sending if a rate limit is configured.
+	// It's shared between all clients of the same pool
+	limiter *rate.Limiter
+
+	// lastResponse is the final response of the last transaction
+	lastResponse Response
+
+	// broken is set when the connection has been lost or left in an
+	// unknown state. The next Send restores the connection
+	broken bool
+
+	// tokens caches OAuth 2.0 access tokens of the sender until they
+	// expire. It's shared between all clients of the same pool
+	tokens oauth2.TokenSource
+
+	// banner is the greeting of the server
+	banner string
+
+	// sentCopy is the first delivered copy of the mail being sent.
+	// It's kept only if the sent folder is configured
+	sentCopy *message
+}
+
+// Response is a reply of the SMTP server
+type Response struct {
+	// Code is a three-digit reply code, e.g. 250
+	Code int
+
+	// Message is a text of the reply. Lines of
+	// a multiline reply are separated by "\n"
+	Message string
+
+	// Server is the address (host:port) of the server that replied
+	Server string
+}
+
+// EnhancedCode returns the enhanced status code (RFC 3463) that
+// the message starts with, e.g. "2.0.0". It returns an empty
+// string if the server doesn't use enhanced status codes
+func (r Response) EnhancedCode() string {
+	code, _, _ := strings.Cut(r.Message, " ")
+
+	parts := strings.Split(code, ".")
+	if len(parts) != 3 || len(parts[0]) != 1 || !strings.ContainsAny(parts[0], "245") {
+		return ""
+	}
+
+	for _, p := range parts[1:] {
+		if _, err := strconv.ParseUint(p, 10, 16); err != nil {
+			return ""
+		}
+	}
+
+	return code
+}
+
+func (r Response) String() string {
+	return fmt.Sprintf("%d %s", r.Code, r.Message)
 }
 
 // NewClient returns the new SMTP client
 func NewClient(cfg *SmtpConfig) *SmtpClient {
-	return &SmtpClient{cfg: cfg, client: nil}
+	s := &SmtpClient{cfg: cfg, client: nil}
+
+	if cfg != nil {
+		s.limiter = newLimiter(cfg.RateLimit)
+		s.tokens = reuseTokenSource(cfg.Sender.TokenSource)
+	}
+
+	return s
+}
+
+// reuseTokenSource wraps the token source so a token is requested only
+// when the cached one expires, e.g. not on each reconnect
+func reuseTokenSource(ts oauth2.TokenSource) oauth2.TokenSource {
+	if ts == nil {
+		return nil
+	}
+
+	return oauth2.ReuseTokenSource(nil, ts)
+}
+
+func newLimiter(limit float64) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+
+	return rate.NewLimiter(rate.Limit(limit), 1)
 }
 
 // Dial establishes a connection with the server using
 // parameters from SMTP config. If an error occurs
-// during a connection Dial will return it
+// during a connection Dial will return it. If fallback
+// servers are configured, they are tried in order and
+// Dial fails only if none of them is available
 func (s *SmtpClient) Dial() error {
 	if s.cfg == nil {
 		return errors.New("wail: smtp config is not provided")
 	}
 
-	address := fmt.Sprintf("%s:%d", s.cfg.Server.Host, s.cfg.Server.Port)
-
-	conn, err := net.DialTimeout("tcp", address, s.cfg.Server.ConnectTimeout)
-	if err != nil {
+	if err := s.cfg.Validate(); err != nil {
 		return err
 	}
 
-	if s.cfg.Server.EncryptType == EncryptSSL || s.cfg.Server.EncryptType == EncryptTLS {
-		if s.cfg.TlsConfig == nil {
-			s.cfg.TlsConfig = &tls.Config{}
+	var errs []error
+
+	for i := 0; i <= len(s.cfg.FallbackServers); i++ {
+		err := s.dialServer(i)
+		if err == nil {
+			return nil
 		}
 
-		if !s.cfg.TlsConfig.InsecureSkipVerify {
-			s.cfg.TlsConfig.ServerName = s.cfg.Server.Host
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 1 {
+		return errs[0]
+	}
+
+	return errors.Join(errs...)
+}
+
+// serverConfig returns the config of the server by its index. Index 0
+// is the server from the config, the next ones are the fallback servers
+func (s *SmtpClient) serverConfig(i int) *ServerConfig {
+	if i == 0 {
+		return &s.cfg.Server
+	}
+
+	return &s.cfg.FallbackServers[i-1]
+}
+
+var (
+	// dialSlots contains the semaphores limiting concurrent Dials
+	// (see ServerConfig.MaxConcurrentDials) keyed by server address
+	dialSlots   = make(map[string]chan struct{})
+	dialSlotsMu sync.Mutex
+)
+
+// acquireDialSlot waits for a free dial slot of the server.
+// The returned function releases the slot
+func acquireDialSlot(srv *ServerConfig) (func(), error) {
+	if srv.MaxConcurrentDials <= 0 {
+		return func() {}, nil
+	}
+
+	address := srv.address()
+
+	dialSlotsMu.Lock()
+
+	slots, ok := dialSlots[address]
+	if !ok {
+		slots = make(chan struct{}, srv.MaxConcurrentDials)
+		dialSlots[address] = slots
+	}
+
+	dialSlotsMu.Unlock()
+
+	var timeout <-chan time.Time
+
+	if srv.ConnectTimeout != 0 {
+		t := time.NewTimer(srv.ConnectTimeout)
+		defer t.Stop()
+
+		timeout = t.C
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-timeout:
+		return nil, fmt.Errorf("wail: timed out waiting for a free dial slot of %s", srv.address())
+	}
+}
+
+// tlsConfig returns a copy of the TLS configuration for the server,
+// so the one of the caller is never modified
+func (s *SmtpClient) tlsConfig(srv *ServerConfig) *tls.Config {
+	cfg := DefaultTLSConfig()
+	if s.cfg.TlsConfig != nil {
+		cfg = s.cfg.TlsConfig.Clone()
+	}
+
+	if !cfg.InsecureSkipVerify {
+		cfg.ServerName = srv.Host
+	}
+
+	// VerifyConnection runs after the callback of the TlsConfig if it's set
+	if verify := s.cfg.VerifyConnection; verify != nil {
+		prev := cfg.VerifyConnection
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if prev != nil {
+				if err := prev(cs); err != nil {
+					return err
+				}
+			}
+
+			return verify(cs)
 		}
+	}
+
+	return cfg
+}
+
+// dialServer connects to the server with the specified index
+func (s *SmtpClient) dialServer(i int) error {
+	srv := s.serverConfig(i)
 
-		conn = tls.Client(conn, s.cfg.TlsConfig)
+	s.server = srv
+	s.serverIdx = i
+
+	address := srv.address()
+
+	release, err := acquireDialSlot(srv)
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	conn, err := net.DialTimeout("tcp", address, srv.ConnectTimeout)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := s.tlsConfig(srv)
+
+	if srv.EncryptType == EncryptSSL {
+		conn = tls.Client(conn, tlsConfig)
 	}
 
 	var c *smtp.Client
 
-	if s.cfg.Server.ConnectTimeout != 0 {
+	// smtp.NewClient drops the greeting, so it's recorded on the way
+	gc := &greetingConn{Conn: conn}
+
+	if srv.ConnectTimeout != 0 {
 		connChan := make(chan error)
 
 		go func() {
 			defer close(connChan)
 
-			c, err = smtp.NewClient(conn, s.cfg.Server.Host)
+			c, err = smtp.NewClient(gc, srv.Host)
 			connChan <- err
 		}()
 
 		select {
-		case <-time.After(s.cfg.Server.ConnectTimeout):
+		case <-time.After(srv.ConnectTimeout):
 			return errors.New("wail: connection timeout")
 		case err := <-connChan:
 			if err != nil {
@@ -144,71 +612,118 @@ func (s *SmtpClient) Dial() error {
 			}
 		}
 	} else {
-		c, err = smtp.NewClient(conn, s.cfg.Server.Host)
+		c, err = smtp.NewClient(gc, srv.Host)
 		if err != nil {
 			return err
 		}
 	}
 
 	s.client = c
+	s.conn = conn
+	s.banner = gc.banner()
+	s.broken = false
+	s.failedOver = false
+	s.setBufferSizes(gc)
 
-	hostname, err := os.Hostname()
-	if err != nil {
-		hostname = "localhost"
-	}
-
-	if err := c.Hello(hostname); err != nil {
+	if err := c.Hello(s.heloName()); err != nil {
 		return err
 	}
 
 	if ok, value := c.Extension("SIZE"); ok {
 		if size, err := strconv.Atoi(value); err == nil {
-			s.cfg.Server.maxMsgSize = uint(size)
+			srv.maxMsgSize = uint(size)
 		}
 	}
 
-	if s.cfg.Server.EncryptType == EncryptTLS {
+	if srv.EncryptType == EncryptTLS {
 		if ok, _ := c.Extension("STARTTLS"); ok {
-			if err := c.StartTLS(s.cfg.TlsConfig); err != nil {
+			if err := s.startTLS(gc, tlsConfig, srv.Host); err != nil {
 				c.Quit()
 				return err
 			}
+
+			c = s.client
 		}
 	}
 
-	if s.cfg.Server.NeedAuth {
+	if srv.NeedAuth {
 		if s.cfg.Sender.Login == "" {
 			return errors.New("wail: sender login is not specified")
 		}
 
-		if s.cfg.Sender.Password == "" {
+		tokenSource := s.tokens
+		if tokenSource == nil {
+			tokenSource = reuseTokenSource(s.cfg.Sender.TokenSource)
+			s.tokens = tokenSource
+		}
+
+		if tokenSource == nil && s.cfg.Sender.Password == "" && s.cfg.Sender.PasswordFunc == nil {
 			return errors.New("wail: sender password is not specified")
 		}
 
+		password := s.cfg.Sender.Password
+
+		if tokenSource == nil && s.cfg.Sender.PasswordFunc != nil {
+			p, err := s.cfg.Sender.PasswordFunc()
+			if err != nil {
+				c.Quit()
+				return fmt.Errorf("wail: failed to get sender password (%w)", err)
+			}
+
+			password = p
+		}
+
 		var auth smtp.Auth = nil
 
 		if ok, authMethod := c.Extension("AUTH"); ok {
 			switch {
-			case strings.Contains(authMethod, "LOGIN"):
-				auth = LoginAuth(s.cfg.Sender.Login, s.cfg.Sender.Password)
-			case strings.Contains(authMethod, "CRAM-MD5"):
-				auth = smtp.CRAMMD5Auth(s.cfg.Sender.Login, s.cfg.Sender.Password)
-			case strings.Contains(authMethod, "XOAUTH2"):
-				{
-					// TODO: make support XOAUTH2 auth?
+			case tokenSource != nil:
+				// OAUTHBEARER is the standard mechanism (RFC 7628),
+				// XOAUTH2 is its predecessor used by Google and Microsoft
+				if strings.Contains(authMethod, "OAUTHBEARER") {
+					auth = OAuthBearerAuth(s.cfg.Sender.Login, address, tokenSource)
+				} else if strings.Contains(authMethod, "XOAUTH2") {
+					auth = XoAuth2Auth(s.cfg.Sender.Login, tokenSource)
+				}
+			default:
+				switch chooseAuthMechanism(authMethod, s.cfg.Sender.AuthMechanisms) {
+				case "PLAIN":
+					auth = smtp.PlainAuth(s.cfg.Sender.AuthIdentity, s.cfg.Sender.Login, password, srv.Host)
+				case "LOGIN":
+					auth = LoginAuth(s.cfg.Sender.Login, password)
+				case "CRAM-MD5":
+					auth = smtp.CRAMMD5Auth(s.cfg.Sender.Login, password)
 				}
-			case strings.Contains(authMethod, "PLAIN"):
-				auth = smtp.PlainAuth("", s.cfg.Sender.Login, s.cfg.Sender.Password, s.cfg.Server.Host)
 			}
 
 			if auth == nil {
 				c.Quit()
 				return errors.New("wail: can't retrieve authentication method")
 			}
+
+			// smtp.Client doesn't know about TLS
+			// since it gets the connection wrapped
+			if _, ok := s.conn.(*tls.Conn); ok {
+				auth = tlsAuth{auth}
+			}
 		}
 
 		if err := c.Auth(auth); err != nil {
 			c.Quit()
+
+			// Only a reply of the server means the credentials are wrong
+			var protoErr *textproto.Error
+			if errors.As(err, &protoErr) {
+				return fmt.Errorf("%w (%w)", ErrAuthFailed, err)
+			}
+
+			return err
+		}
+	}
+
+	if s.cfg.Compress {
+		if err := s.compress(); err != nil {
+			c.Quit()
 			return err
 		}
 	}
@@ -216,62 +731,1315 @@ func (s *SmtpClient) Dial() error {
 	return nil
 }
 
-// Close closes a connection with the server by sending the QUIT command
-func (s *SmtpClient) Close() error {
-	if s.client == nil {
-		return errors.New("wail: connection with the smtp server is not established")
+// compress enables the DEFLATE compression of the session if the server
+// advertises the COMPRESS extension. Otherwise the session stays as is
+func (s *SmtpClient) compress() error {
+	ok, params := s.client.Extension("COMPRESS")
+	if !ok || !strings.Contains(strings.ToUpper(params), "DEFLATE") {
+		return nil
+	}
+
+	if _, _, err := s.cmd(250, "COMPRESS DEFLATE"); err != nil {
+		return fmt.Errorf("wail: can't enable the compression (%w)", err)
+	}
+
+	text := s.client.Text
+
+	fw, err := flate.NewWriter(text.W, flate.DefaultCompression)
+	if err != nil {
+		return fmt.Errorf("wail: can't enable the compression (%w)", err)
+	}
+
+	text.R = bufio.NewReader(flate.NewReader(text.R))
+	text.W = bufio.NewWriter(deflateWriter{fw: fw, w: text.W})
+
+	return nil
+}
+
+// deflateWriter compresses the data and sends it right away,
+// so each command reaches the server as soon as it's flushed
+type deflateWriter struct {
+	fw *flate.Writer
+	w  *bufio.Writer
+}
+
+func (d deflateWriter) Write(p []byte) (int, error) {
+	n, err := d.fw.Write(p)
+	if err != nil {
+		return n, err
 	}
 
-	return s.client.Quit()
+	if err := d.fw.Flush(); err != nil {
+		return n, err
+	}
+
+	return n, d.w.Flush()
 }
 
-// Send assembles the message and sends it to the server
-func (s *SmtpClient) Send(m *Mail) error {
-	if s.client == nil {
-		return errors.New("wail: connection with the smtp server is not established")
+// chooseAuthMechanism returns the first of the preferred mechanisms that is
+// advertised by the server. It returns an empty string if there is no such one
+func chooseAuthMechanism(advertised string, preferred []string) string {
+	if len(preferred) == 0 {
+		preferred = []string{"PLAIN", "CRAM-MD5", "LOGIN"}
 	}
 
-	if m == nil {
-		return errors.New("wail: an empty mail object has been provided")
+	mechanisms := strings.Fields(strings.ToUpper(advertised))
+
+	for _, p := range preferred {
+		for _, m := range mechanisms {
+			if strings.EqualFold(p, m) {
+				return m
+			}
+		}
 	}
 
-	if err := s.client.Noop(); err != nil {
-		if err := s.Dial(); err != nil {
-			return fmt.Errorf("wail: an error occured while reconnecting to the server (%s)", err.Error())
+	return ""
+}
+
+// hostname and lookupCNAME may be replaced in tests
+var (
+	hostname    = os.Hostname
+	lookupCNAME = net.LookupCNAME
+)
+
+// heloName returns the name of the client for the EHLO command. Servers
+// often reject unqualified names (e.g. a container hostname like pod-abc123),
+// so if the hostname can't be qualified, the address literal is used (RFC 5321)
+func (s *SmtpClient) heloName() string {
+	if s.cfg.Helo != "" {
+		if ip := net.ParseIP(s.cfg.Helo); ip != nil {
+			return addressLiteral(ip)
 		}
+
+		return s.cfg.Helo
 	}
 
-	if err := s.client.Mail(s.cfg.Sender.Login); err != nil {
-		return err
+	name, err := hostname()
+	if err == nil && name != "" && !s.cfg.HeloAddressLiteral {
+		if strings.Contains(name, ".") {
+			return name
+		}
+
+		if cname, err := lookupCNAME(name); err == nil {
+			if cname = strings.TrimSuffix(cname, "."); strings.Contains(cname, ".") {
+				return cname
+			}
+		}
 	}
 
-	if len(m.recipients) == 0 {
-		return errors.New("wail: no recipients provided to send email")
+	if addr, ok := s.conn.LocalAddr().(*net.TCPAddr); ok {
+		return addressLiteral(addr.IP)
 	}
 
-	for _, email := range m.recipients {
-		if err := s.client.Rcpt(email); err != nil {
-			return err
-		}
+	return "localhost"
+}
+
+// addressLiteral formats the IP as an address literal (RFC 5321 4.1.3)
+func addressLiteral(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "[" + ip4.String() + "]"
 	}
 
-	m.mb.SetFieldFrom(s.cfg.Sender.Name, s.cfg.Sender.Login)
+	return "[IPv6:" + ip.String() + "]"
+}
 
-	header, err := m.mb.GetResultMessage(s.cfg.Server.maxMsgSize)
-	if err != nil {
+// setBufferSizes replaces the default buffers of the client connection with
+// the ones of the configured sizes. It's called before any command is sent,
+// so the default buffers are empty and nothing is lost
+func (s *SmtpClient) setBufferSizes(conn io.ReadWriter) {
+	text := s.client.Text
+
+	if size := s.server.ReadBufferSize; size > 0 && text.R.Buffered() == 0 {
+		text.R = bufio.NewReaderSize(conn, size)
+	}
+
+	if size := s.server.WriteBufferSize; size > 0 && text.W.Buffered() == 0 {
+		text.W = bufio.NewWriterSize(conn, size)
+	}
+}
+
+// startTLS upgrades the connection with the STARTTLS command. Unlike
+// smtp.Client.StartTLS it puts the TLS connection behind the greeting
+// recorder, so the client created on it again gets the sized buffers
+func (s *SmtpClient) startTLS(gc *greetingConn, cfg *tls.Config, host string) error {
+	if _, _, err := s.cmd(220, "STARTTLS"); err != nil {
 		return err
 	}
 
-	w, err := s.client.Data()
-	if err != nil {
-		return nil
+	conn := tls.Client(gc.Conn, cfg)
+	if err := conn.Handshake(); err != nil {
+		return err
 	}
 
-	_, err = w.Write(header)
+	// The server doesn't greet the client again
+	gc.Conn = conn
+	gc.pending = []byte("220 " + host + "\r\n")
+
+	c, err := smtp.NewClient(gc, host)
 	if err != nil {
-		w.Close()
 		return err
 	}
 
-	return w.Close()
+	s.client = c
+	s.conn = conn
+	s.setBufferSizes(gc)
+
+	return c.Hello(s.heloName())
+}
+
+// Banner returns the greeting of the server the client is connected to,
+// e.g. "220 smtp.example.com ESMTP ready". Lines of a multiline greeting
+// are separated by "\n"
+func (s *SmtpClient) Banner() string {
+	return s.banner
+}
+
+// maxGreetingSize limits the recorded greeting
+const maxGreetingSize = 4096
+
+// greetingConn records the greeting of the server. After STARTTLS
+// it wraps the TLS connection and replays the greeting
+type greetingConn struct {
+	net.Conn
+
+	greeting []byte
+	done     bool
+
+	// pending is read before the connection
+	pending []byte
+}
+
+func (g *greetingConn) Read(p []byte) (int, error) {
+	if len(g.pending) != 0 {
+		n := copy(p, g.pending)
+		g.pending = g.pending[n:]
+
+		return n, nil
+	}
+
+	n, err := g.Conn.Read(p)
+
+	if !g.done {
+		g.greeting = append(g.greeting, p[:n]...)
+		g.done = len(g.greeting) > maxGreetingSize || g.lastLine() >= 0
+	}
+
+	return n, err
+}
+
+// lastLine returns the end of the last line of the greeting
+// (the one without "-" after the code) or -1 if it isn't read yet
+func (g *greetingConn) lastLine() int {
+	start := 0
+
+	for {
+		i := bytes.IndexByte(g.greeting[start:], '\n')
+		if i < 0 {
+			return -1
+		}
+
+		line := g.greeting[start : start+i]
+		if len(line) < 4 || line[3] != '-' {
+			return start + i
+		}
+
+		start += i + 1
+	}
+}
+
+// banner returns the recorded greeting
+func (g *greetingConn) banner() string {
+	greeting := g.greeting
+	if end := g.lastLine(); end >= 0 {
+		greeting = greeting[:end]
+	}
+
+	lines := strings.Split(string(greeting), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, "\r")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Close closes a connection with the server by sending the QUIT command.
+// The client can't send mails after Close until Dial is called again
+func (s *SmtpClient) Close() error {
+	if s.client == nil {
+		return errors.New("wail: connection with the smtp server is not established")
+	}
+
+	text := s.client.Text
+
+	id, err := text.Cmd("QUIT")
+	if err == nil {
+		text.StartResponse(id)
+		_, _, err = text.ReadResponse(221)
+		text.EndResponse(id)
+	}
+
+	closeErr := s.client.Close()
+	s.client = nil
+
+	if err != nil {
+		return err
+	}
+
+	// The session is over once the server replies to QUIT, so the
+	// connection closed or reset by the server after that is not an error
+	if closeErr != nil && !isConnClosed(closeErr) {
+		return closeErr
+	}
+
+	return nil
+}
+
+// isConnClosed reports whether the error is caused
+// by the connection closed or reset by the server
+func isConnClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// Reset aborts the current mail transaction by sending the RSET command.
+// Unlike Close it keeps the connection, so the client may send other mails
+func (s *SmtpClient) Reset() error {
+	if s.client == nil {
+		return errors.New("wail: connection with the smtp server is not established")
+	}
+
+	return s.client.Reset()
+}
+
+// ErrConnectionLost is returned when the connection breaks before the
+// server accepts the message (e.g. the server drops it in the middle of
+// the content). The message has not been delivered and may be sent again,
+// the connection is restored on the next Send
+var ErrConnectionLost = errors.New("wail: the connection has been lost, the message has not been delivered")
+
+// ErrVerifyUnavailable is returned by VerifyRecipient when the
+// server doesn't allow to verify the address
+var ErrVerifyUnavailable = errors.New("wail: the server doesn't verify addresses")
+
+// VerifyRecipient asks the server whether the mailbox exists with the
+// VRFY command. It returns true if the server confirms the address (250
+// or 251) and false if it doesn't know it (550, 551 or 553). The server
+// reply is returned as well.
+//
+// Note: most public servers disable VRFY to prevent address harvesting.
+// ErrVerifyUnavailable is returned if VRFY is disabled or the server
+// can't verify the address but will attempt the delivery (252)
+func (s *SmtpClient) VerifyRecipient(addr string) (bool, string, error) {
+	if s.client == nil {
+		return false, "", errors.New("wail: connection with the smtp server is not established")
+	}
+
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return false, "", fmt.Errorf("wail: invalid address (%w)", err)
+	}
+
+	// A display name is not a part of the mailbox
+	code, msg, err := s.cmd(0, "VRFY %s", parsed.Address)
+	if err != nil {
+		return false, "", err
+	}
+
+	switch code {
+	case 250, 251:
+		return true, msg, nil
+	case 550, 551, 553:
+		return false, msg, nil
+	case 252, 500, 502, 504:
+		return false, msg, ErrVerifyUnavailable
+	}
+
+	return false, msg, fmt.Errorf("wail: unexpected server response %d %s", code, msg)
+}
+
+// Send assembles the message and sends it to the server
+func (s *SmtpClient) Send(m *Mail) error {
+	return s.SendContext(context.Background(), m)
+}
+
+// SendContext is like Send but if a rate limit is configured, it
+// stops waiting for the next sending slot when ctx is done
+func (s *SmtpClient) SendContext(ctx context.Context, m *Mail) error {
+	return s.saveSent(func() error { return s.sendMail(ctx, m) })
+}
+
+// sendMail sends the mail to all its recipients
+func (s *SmtpClient) sendMail(ctx context.Context, m *Mail) error {
+	if m == nil {
+		return errors.New("wail: an empty mail object has been provided")
+	}
+
+	done, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer done()
+
+	if len(m.recipients) == 0 {
+		return errors.New("wail: no recipients provided to send email")
+	}
+
+	if s.cfg.SeparateBccDelivery && len(m.bcc) != 0 {
+		return s.sendSeparateBcc(m)
+	}
+
+	return s.send(m, m.recipients)
+}
+
+// SendTest sends the mail to the sender login only, e.g. to check how
+// it's rendered. The header fields (To, Cc) are kept as is
+func (s *SmtpClient) SendTest(m *Mail) error {
+	if m == nil {
+		return errors.New("wail: an empty mail object has been provided")
+	}
+
+	return s.saveSent(func() error {
+		done, err := s.begin(context.Background())
+		if err != nil {
+			return err
+		}
+
+		defer done()
+
+		return s.send(m, []string{s.cfg.Sender.Login})
+	})
+}
+
+// SendFrom sends the mail on behalf of the specified author (and envelope
+// sender if set) over the current authenticated session, so a single
+// client can serve several sender addresses. The mail itself is not changed
+func (s *SmtpClient) SendFrom(from FromConfig, m *Mail) error {
+	return s.SendFromContext(context.Background(), from, m)
+}
+
+// SendFromContext is like SendFrom but stops waiting
+// for the rate limit when ctx is done
+func (s *SmtpClient) SendFromContext(ctx context.Context, from FromConfig, m *Mail) error {
+	if m == nil {
+		return errors.New("wail: an empty mail object has been provided")
+	}
+
+	cm := m.clone()
+
+	if err := cm.SetFromConfig(from); err != nil {
+		return fmt.Errorf("wail: invalid sender (%w)", err)
+	}
+
+	return s.SendContext(ctx, cm)
+}
+
+// SendRaw sends the assembled message (e.g. a message prepared by Resend)
+// as is. The from address is used as the envelope sender and the message
+// is delivered to the to addresses regardless of its header fields
+func (s *SmtpClient) SendRaw(from string, to []string, raw []byte) error {
+	return s.SendRawContext(context.Background(), from, to, raw)
+}
+
+// SendRawContext is like SendRaw but stops waiting
+// for the rate limit when ctx is done
+func (s *SmtpClient) SendRawContext(ctx context.Context, from string, to []string, raw []byte) error {
+	if len(raw) == 0 {
+		return errors.New("wail: an empty message has been provided")
+	}
+
+	if len(to) == 0 {
+		return errors.New("wail: no recipients provided to send email")
+	}
+
+	if err := validateRecipients(to); err != nil {
+		return err
+	}
+
+	if s.server != nil {
+		if max := s.server.maxMsgSize; max != 0 && uint(len(raw)) > max {
+			return fmt.Errorf("wail: a max message size (%d) that the server can accept has been exceeded", max)
+		}
+	}
+
+	done, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer done()
+
+	return s.saveSent(func() error { return s.transaction(from, nil, to, rawMessage(raw), false) })
+}
+
+// SendReader streams the assembled message from r to the server as is. Unlike
+// SendRaw the message is never held in memory, so it suits very large messages.
+// BeforeSend and the fallback servers are not used since the message can't be
+// read twice. If the sent folder is configured, the message is kept in memory
+// to be saved there once it's sent
+func (s *SmtpClient) SendReader(from string, to []string, r io.Reader) error {
+	return s.SendReaderContext(context.Background(), from, to, r)
+}
+
+// SendReaderContext is like SendReader but aborts the transfer as soon
+// as ctx is done. The connection is restored on the next Send
+func (s *SmtpClient) SendReaderContext(ctx context.Context, from string, to []string, r io.Reader) error {
+	if r == nil {
+		return errors.New("wail: an empty message has been provided")
+	}
+
+	if len(to) == 0 {
+		return errors.New("wail: no recipients provided to send email")
+	}
+
+	if err := validateRecipients(to); err != nil {
+		return err
+	}
+
+	return s.saveSent(func() error { return s.sendReader(ctx, from, to, r) })
+}
+
+// sendReader performs the transaction of SendReader
+func (s *SmtpClient) sendReader(ctx context.Context, from string, to []string, r io.Reader) error {
+	done, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer done()
+
+	var sent *bytes.Buffer
+
+	if s.cfg.SentFolder != nil {
+		sent = new(bytes.Buffer)
+		r = io.TeeReader(r, sent)
+	}
+
+	stop := s.watchContext(ctx)
+
+	err = s.mail(from)
+
+	for i := 0; err == nil && i < len(to); i++ {
+		err = s.rcpt(to[i])
+	}
+
+	if err == nil {
+		err = s.dataFrom(readerSource{r}, -1)
+	}
+
+	stop()
+
+	if err == nil {
+		if sent != nil {
+			s.sentCopy = rawMessage(sent.Bytes())
+		}
+
+		return nil
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		s.disconnect()
+		return fmt.Errorf("wail: sending has been interrupted (%w)", ctxErr)
+	}
+
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		s.disconnect()
+		return fmt.Errorf("%w (%w)", ErrConnectionLost, err)
+	}
+
+	return err
+}
+
+// saveSent runs the sending and then saves the first delivered copy of the
+// mail to the sent folder, so a mail sent in several transactions (e.g.
+// separate Bcc copies) is saved once. Nothing is saved if any transaction
+// fails, and the saving never stops the delivery
+func (s *SmtpClient) saveSent(send func() error) error {
+	s.sentCopy = nil
+	defer func() { s.sentCopy = nil }()
+
+	if err := send(); err != nil {
+		return err
+	}
+
+	if s.cfg.SentFolder == nil || s.sentCopy == nil {
+		return nil
+	}
+
+	if err := appendSent(s.cfg.SentFolder, s.sentCopy); err != nil {
+		return fmt.Errorf("%w (%w)", ErrSentFolder, err)
+	}
+
+	return nil
+}
+
+// disconnect closes the connection that has been lost or left in an
+// unknown state, so it's restored on the next Send
+func (s *SmtpClient) disconnect() {
+	s.client.Close()
+	s.broken = true
+}
+
+// watchContext interrupts blocked reads and writes of the connection when
+// ctx is done. The returned function stops watching
+func (s *SmtpClient) watchContext(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		select {
+		case <-ctx.Done():
+			s.conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-finished
+	}
+}
+
+// begin prepares the client for a new mail: it waits for the rate limit,
+// restores the connection if needed and applies the deadline of ctx.
+// The returned function must be called when the mail is sent
+func (s *SmtpClient) begin(ctx context.Context) (func(), error) {
+	if s.client == nil {
+		return nil, errors.New("wail: connection with the smtp server is not established")
+	}
+
+	if s.limiter != nil {
+		if err := s.limiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("wail: rate limit wait has been interrupted (%w)", err)
+		}
+	}
+
+	if s.failedOver {
+		s.client.Quit()
+		s.broken = true
+	}
+
+	// RSET clears the state left by a previous mail and checks
+	// that the connection is alive. It's restored if it isn't
+	if s.broken || s.Reset() != nil {
+		s.client.Close()
+
+		if err := s.reconnect(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// The deadline of ctx limits the whole sending,
+	// while RcptTimeout limits each recipient within it
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return func() {}, nil
+	}
+
+	s.deadline = deadline
+	s.conn.SetDeadline(deadline)
+
+	return func() {
+		s.deadline = time.Time{}
+		s.conn.SetDeadline(time.Time{})
+	}, nil
+}
+
+// ErrReconnect is returned by Send when the lost connection can't be
+// restored, so the mail hasn't been sent at all. Unwrap it to get the cause
+var ErrReconnect = errors.New("wail: failed to reconnect to the server")
+
+// reconnect dials the server until it succeeds or the attempts
+// run out. The delay between attempts grows exponentially
+func (s *SmtpClient) reconnect(ctx context.Context) error {
+	// The state of the lost connection must not leak into the new one
+	s.broken = true
+	s.deadline = time.Time{}
+	s.lastResponse = Response{}
+
+	// An invalid config fails every attempt, so don't wait for them
+	if err := s.cfg.Validate(); err != nil {
+		return fmt.Errorf("%w (%w)", ErrReconnect, err)
+	}
+
+	cfg := s.cfg.Reconnect
+
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = 1
+	}
+
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = time.Second
+	}
+
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+
+	backoff := cfg.Backoff
+
+	for i := 1; ; i++ {
+		err := s.Dial()
+		if err == nil {
+			return nil
+		}
+
+		if i == cfg.Attempts {
+			return fmt.Errorf("%w (%w)", ErrReconnect, err)
+		}
+
+		delay := backoff
+
+		if d, ok := retryAfter(err); ok {
+			if delay = d; delay > cfg.MaxBackoff {
+				delay = cfg.MaxBackoff
+			}
+		}
+
+		t := time.NewTimer(delay)
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("%w: interrupted (%w)", ErrReconnect, ctx.Err())
+		}
+
+		if backoff *= 2; backoff > cfg.MaxBackoff {
+			backoff = cfg.MaxBackoff
+		}
+	}
+}
+
+// retryAfterRe matches a retry hint of the server,
+// e.g. "Retry-After: 60" or "try again in 5 minutes"
+var retryAfterRe = regexp.MustCompile(`(?i)(?:retry[- ]after|try again in)[:=\s]*(\d+)\s*(s|secs?|seconds?|m|mins?|minutes?|h|hours?)?\b`)
+
+// retryAfter returns the delay hinted by the server in the
+// transient failure reply, if there is a positive one
+func retryAfter(err error) (time.Duration, bool) {
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code/100 != 4 {
+		return 0, false
+	}
+
+	m := retryAfterRe.FindStringSubmatch(tpErr.Msg)
+	if m == nil {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+
+	unit := time.Second
+
+	switch strings.ToLower(m[2]) {
+	case "m", "min", "mins", "minute", "minutes":
+		unit = time.Minute
+	case "h", "hour", "hours":
+		unit = time.Hour
+	}
+
+	// Avoid overflow, the delay is capped anyway
+	if n > 1e6 {
+		n = 1e6
+	}
+
+	return time.Duration(n) * unit, true
+}
+
+// sendSeparateBcc sends the mail to To and Cc recipients in one transaction
+// and then to each Bcc recipient in a separate one. None of the copies
+// contains the Bcc field
+func (s *SmtpClient) sendSeparateBcc(m *Mail) error {
+	bcc := make(map[string]bool, len(m.bcc))
+	for _, email := range m.bcc {
+		bcc[email] = true
+	}
+
+	rcpts := make([]string, 0, len(m.recipients))
+	for _, email := range m.recipients {
+		if !bcc[email] {
+			rcpts = append(rcpts, email)
+		}
+	}
+
+	cm := m.clone()
+	delete(cm.mb.header, "bcc")
+
+	if _, ok := cm.mb.header["to"]; !ok {
+		if _, ok := cm.mb.header["cc"]; !ok {
+			cm.mb.header["to"] = undisclosedRecipients
+		}
+	}
+
+	if len(rcpts) != 0 {
+		if err := s.send(cm, rcpts); err != nil {
+			return err
+		}
+	}
+
+	for _, email := range m.bcc {
+		if err := s.send(cm, []string{email}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// send performs a single mail transaction delivering the mail to rcpts
+func (s *SmtpClient) send(m *Mail, rcpts []string) error {
+	var params []string
+
+	binary := m.mb.encoding == Binary
+
+	if binary {
+		if !s.hasExtension("BINARYMIME") || !s.hasExtension("CHUNKING") {
+			return errors.New("wail: binary encoding requires the server to support BINARYMIME and CHUNKING")
+		}
+
+		params = append(params, "BODY=BINARYMIME")
+	}
+
+	if m.mtPriority != nil && s.hasExtension("MT-PRIORITY") {
+		params = append(params, fmt.Sprintf("MT-PRIORITY=%d", *m.mtPriority))
+	}
+
+	from := s.from(m)
+
+	m.mb.SetFieldFrom(from.Name, from.Address)
+
+	if from.Envelope != from.Address {
+		m.mb.SetFieldSender(from.Envelope)
+	} else {
+		m.mb.SetFieldSender("")
+	}
+
+	msg, err := m.mb.assemble(s.server.maxMsgSize)
+	if err != nil {
+		return err
+	}
+
+	return s.transaction(from.Envelope, params, rcpts, msg, binary)
+}
+
+// transaction performs a mail transaction sending the message to rcpts.
+// If it fails, the message is submitted to the next fallback servers
+func (s *SmtpClient) transaction(from string, params, rcpts []string, msg *message, binary bool) error {
+	// A malformed recipient must not leave a half-done transaction
+	if err := validateRecipients(rcpts); err != nil {
+		return err
+	}
+
+	if s.cfg.BeforeSend != nil {
+		raw, err := s.cfg.BeforeSend(msg.Bytes())
+		if err != nil {
+			return fmt.Errorf("wail: the message has been rejected by BeforeSend (%w)", err)
+		}
+
+		msg = rawMessage(raw)
+	}
+
+	errs := []error{s.deliver(from, params, rcpts, msg, binary)}
+
+	for i := s.serverIdx + 1; shouldFailover(errs[len(errs)-1]) && i <= len(s.cfg.FallbackServers); i++ {
+		s.client.Quit()
+		s.client.Close()
+
+		if err := s.dialServer(i); err != nil {
+			errs = append(errs, &dialError{err})
+			continue
+		}
+
+		s.failedOver = true
+		errs = append(errs, s.deliver(from, params, rcpts, msg, binary))
+	}
+
+	switch {
+	case errs[len(errs)-1] == nil:
+		if s.cfg.SentFolder != nil && s.sentCopy == nil {
+			s.sentCopy = msg
+		}
+
+		return nil
+	case len(errs) == 1:
+		return errs[0]
+	}
+
+	return errors.Join(errs...)
+}
+
+// dialError is an error of connecting to a fallback server
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string { return e.err.Error() }
+func (e *dialError) Unwrap() error { return e.err }
+
+// shouldFailover reports whether the message may be submitted to the next
+// server: the server is unavailable or has rejected the message temporarily.
+// A permanent rejection would be the same on any server
+func shouldFailover(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+
+	var (
+		netErr  net.Error
+		dialErr *dialError
+	)
+
+	return errors.As(err, &dialErr) || errors.As(err, &netErr) ||
+		errors.Is(err, ErrConnectionLost) || isConnClosed(err)
+}
+
+// deliver performs a mail transaction on the current connection
+func (s *SmtpClient) deliver(from string, params, rcpts []string, msg *message, binary bool) error {
+	var err error
+
+	if err := s.mail(from, params...); err != nil {
+		return err
+	}
+
+	for _, email := range rcpts {
+		if err := s.rcpt(email); err != nil {
+			return err
+		}
+	}
+
+	if binary {
+		err = s.bdat(msg.Bytes())
+	} else {
+		err = s.dataFrom(msg, msg.Len())
+	}
+
+	if err != nil {
+		// The server hasn't replied to the content, so the state of the
+		// session is unknown. The connection is restored on the next Send
+		var protoErr *textproto.Error
+		if !errors.As(err, &protoErr) {
+			s.disconnect()
+			return fmt.Errorf("%w (%w)", ErrConnectionLost, err)
+		}
+
+		return err
+	}
+
+	s.lastResponse.Server = s.server.address()
+
+	if expected := s.cfg.ExpectedStatus; expected != "" && s.lastResponse.EnhancedCode() != expected {
+		return fmt.Errorf("wail: unexpected server response %s (expected %s)", s.lastResponse, expected)
+	}
+
+	return nil
+}
+
+// LastResponse returns the final response of the server to the last
+// sent message. It may be used to log the queue ID reported by the server
+func (s *SmtpClient) LastResponse() Response {
+	return s.lastResponse
+}
+
+// readFinalResponse reads the response to the message
+// content and keeps it as the last response
+func (s *SmtpClient) readFinalResponse(id uint) error {
+	text := s.client.Text
+
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+
+	code, msg, err := text.ReadResponse(250)
+
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		code, msg = protoErr.Code, protoErr.Msg
+	}
+
+	s.lastResponse = Response{Code: code, Message: msg}
+
+	return err
+}
+
+// dataFrom sends the message using the DATA command. Unlike smtp.Client.Data
+// it keeps the final response of the server (see LastResponse). The message
+// is written straight to the connection, so it's produced (e.g. attachments
+// are encoded) only as fast as the server accepts the data. The total is the
+// content size reported to OnProgress
+func (s *SmtpClient) dataFrom(src io.WriterTo, total int64) error {
+	if _, _, err := s.cmd(354, "DATA"); err != nil {
+		return err
+	}
+
+	text := s.client.Text
+	id := text.Next()
+
+	text.StartRequest(id)
+
+	var w io.WriteCloser = text.DotWriter()
+
+	if s.cfg.OnProgress != nil {
+		w = &progressWriter{w: w, total: total, report: s.cfg.OnProgress}
+	}
+
+	// The writer must be closed whatever happens, otherwise
+	// the terminating dot is never sent
+	err := func() (err error) {
+		defer func() {
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+
+			text.EndRequest(id)
+		}()
+
+		_, err = src.WriteTo(w)
+		return err
+	}()
+
+	if err != nil {
+		return err
+	}
+
+	return s.readFinalResponse(id)
+}
+
+// progressInterval is a number of bytes between OnProgress calls
+const progressInterval = 64 << 10
+
+// progressWriter reports the progress of writing the message content
+type progressWriter struct {
+	w       io.WriteCloser
+	total   int64
+	written int64
+
+	// reported is the number of bytes at the last report
+	reported int64
+
+	report func(written, total int64)
+}
+
+// Write writes b in chunks, so the progress is reported
+// even if the whole content is written at once
+func (p *progressWriter) Write(b []byte) (int, error) {
+	var n int
+
+	for len(b) != 0 {
+		chunk := b
+		if len(chunk) > progressInterval {
+			chunk = chunk[:progressInterval]
+		}
+
+		written, err := p.w.Write(chunk)
+		n += written
+		p.written += int64(written)
+
+		if p.written-p.reported >= progressInterval {
+			p.reported = p.written
+			p.report(p.written, p.total)
+		}
+
+		if err != nil {
+			return n, err
+		}
+
+		b = b[len(chunk):]
+	}
+
+	return n, nil
+}
+
+// readerSource writes the message read from
+// the reader (see SendReader) to the connection
+type readerSource struct {
+	r io.Reader
+}
+
+func (rs readerSource) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, rs.r)
+}
+
+// Close terminates the content and reports the final progress
+func (p *progressWriter) Close() error {
+	err := p.w.Close()
+
+	if err == nil && p.written != p.reported {
+		p.reported = p.written
+		p.report(p.written, p.total)
+	}
+
+	return err
+}
+
+// validateRecipients checks all the envelope recipients before the
+// transaction starts, so it isn't aborted in the middle of RCPT commands.
+// Recipients must be bare addresses (or postmaster, RFC 5321 4.5.1)
+func validateRecipients(rcpts []string) error {
+	var errs []error
+
+	for _, email := range rcpts {
+		if strings.EqualFold(email, "postmaster") {
+			continue
+		}
+
+		if len(email) > 254 || strings.ContainsAny(email, "\r\n") {
+			errs = append(errs, fmt.Errorf("wail: invalid recipient %q", email))
+			continue
+		}
+
+		if a, err := mail.ParseAddress(email); err != nil || a.Address != email {
+			errs = append(errs, fmt.Errorf("wail: invalid recipient %q", email))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// rcpt issues the RCPT command. If RcptTimeout is set and the server
+// doesn't reply in time, the connection is closed because the reply may
+// still come. It's restored on the next Send
+func (s *SmtpClient) rcpt(email string) error {
+	timeout := s.server.RcptTimeout
+	if timeout <= 0 {
+		return s.client.Rcpt(email)
+	}
+
+	deadline := time.Now().Add(timeout)
+	if !s.deadline.IsZero() && s.deadline.Before(deadline) {
+		deadline = s.deadline
+	}
+
+	s.conn.SetDeadline(deadline)
+	defer s.conn.SetDeadline(s.deadline)
+
+	err := s.client.Rcpt(email)
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		s.disconnect()
+		return fmt.Errorf("wail: timed out waiting for the server to accept recipient %s (%w)", email, err)
+	}
+
+	return err
+}
+
+// from returns the author of the mail with all the fields filled in.
+// The sender from the config is used if the mail doesn't specify its own
+func (s *SmtpClient) from(m *Mail) FromConfig {
+	from := FromConfig{
+		Name:    s.cfg.Sender.Name,
+		Address: s.cfg.Sender.Login,
+	}
+
+	if m.from != nil {
+		from = *m.from
+
+		if from.Name == "" && m.cfg.FromName == FromNameSender {
+			from.Name = s.cfg.Sender.Name
+		}
+	}
+
+	if m.nullReturnPath {
+		from.Envelope = ""
+	} else if from.Envelope == "" {
+		from.Envelope = s.cfg.Sender.Login
+	}
+
+	return from
+}
+
+func (s *SmtpClient) hasExtension(ext string) bool {
+	ok, _ := s.client.Extension(ext)
+	return ok
+}
+
+// cmd sends the command to the server and reads the response
+func (s *SmtpClient) cmd(expectCode int, format string, args ...any) (int, string, error) {
+	id, err := s.client.Text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+
+	s.client.Text.StartResponse(id)
+	defer s.client.Text.EndResponse(id)
+
+	return s.client.Text.ReadResponse(expectCode)
+}
+
+// mail issues the MAIL command. Unlike smtp.Client.Mail
+// it allows to pass additional parameters (e.g. BODY=BINARYMIME)
+func (s *SmtpClient) mail(from string, params ...string) error {
+	if len(params) == 0 {
+		return s.client.Mail(from)
+	}
+
+	if strings.ContainsAny(from, "\r\n") {
+		return errors.New("wail: a line must not contain CR or LF")
+	}
+
+	_, _, err := s.cmd(250, "MAIL FROM:<%s> %s", from, strings.Join(params, " "))
+	return err
+}
+
+// bdat sends the message as a single chunk using
+// the BDAT command of the CHUNKING extension (RFC 3030)
+func (s *SmtpClient) bdat(msg []byte) error {
+	text := s.client.Text
+	id := text.Next()
+
+	text.StartRequest(id)
+
+	fmt.Fprintf(text.W, "BDAT %d LAST\r\n", len(msg))
+	text.W.Write(msg)
+
+	err := text.W.Flush()
+
+	text.EndRequest(id)
+
+	if err != nil {
+		return err
+	}
+
+	return s.readFinalResponse(id)
+}
+
+// RecipientGroup is a set of recipients that receive
+// their own copy of the mail (see SendGroups)
+type RecipientGroup struct {
+	// To is the main email addresses of the group
+	To []string
+
+	// Cc is the email addresses to which a copy is sent
+	Cc []string
+}
+
+// SendGroups sends the mail to each group of recipients over the same
+// connection. Every group gets a separate message with its own To and Cc
+// fields while the subject and the message stay the same
+func (s *SmtpClient) SendGroups(m *Mail, groups []RecipientGroup) error {
+	return s.SendGroupsContext(context.Background(), m, groups)
+}
+
+// SendGroupsContext is like SendGroups but stops waiting
+// for the rate limit when ctx is done
+func (s *SmtpClient) SendGroupsContext(ctx context.Context, m *Mail, groups []RecipientGroup) error {
+	if m == nil {
+		return errors.New("wail: an empty mail object has been provided")
+	}
+
+	return s.saveSent(func() error { return s.sendGroups(ctx, m, groups) })
+}
+
+// sendGroups sends the copy of the mail to each group
+func (s *SmtpClient) sendGroups(ctx context.Context, m *Mail, groups []RecipientGroup) error {
+	for i, g := range groups {
+		gm := m.clone()
+		gm.resetRecipients()
+
+		if err := gm.To(g.To...); err != nil {
+			return fmt.Errorf("wail: invalid recipient group %d (%w)", i, err)
+		}
+
+		if len(g.Cc) != 0 {
+			if err := gm.CopyTo(g.Cc...); err != nil {
+				return fmt.Errorf("wail: invalid recipient group %d (%w)", i, err)
+			}
+		}
+
+		if err := s.sendMail(ctx, gm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// BulkConfig contains settings of a bulk sending (see SendBulk)
+type BulkConfig struct {
+	// Bcc are addresses added to the envelope of every message, e.g. an
+	// archive mailbox. They never appear in the header fields
+	Bcc []string
+
+	// Personalize is called with a copy of the mail for each recipient
+	// before it's sent, so the subject or the message may be changed
+	Personalize func(m *Mail, rcpt string) error
+}
+
+// SendBulk sends a separate copy of the mail to each recipient over the
+// same connection. Every copy has the only recipient in the To field, so
+// recipients know nothing about each other. A failure of one recipient
+// doesn't stop the sending, the returned error lists all the failures
+func (s *SmtpClient) SendBulk(m *Mail, rcpts []string, cfg BulkConfig) error {
+	return s.SendBulkContext(context.Background(), m, rcpts, cfg)
+}
+
+// SendBulkContext is like SendBulk but stops sending when ctx is done
+func (s *SmtpClient) SendBulkContext(ctx context.Context, m *Mail, rcpts []string, cfg BulkConfig) error {
+	if m == nil {
+		return errors.New("wail: an empty mail object has been provided")
+	}
+
+	// Each copy is sent to the Bcc recipients too, so an invalid
+	// one must fail the bulk before the first copy is sent
+	if err := validateRecipients(cfg.Bcc); err != nil {
+		return fmt.Errorf("wail: invalid bulk Bcc address (%w)", err)
+	}
+
+	return s.saveSent(func() error {
+		var errs []error
+
+		for _, rcpt := range rcpts {
+			if err := ctx.Err(); err != nil {
+				errs = append(errs, err)
+				break
+			}
+
+			if err := s.sendBulkCopy(ctx, m, rcpt, cfg); err != nil {
+				errs = append(errs, fmt.Errorf("wail: failed to send to %s (%w)", rcpt, err))
+			}
+		}
+
+		return errors.Join(errs...)
+	})
+}
+
+// sendBulkCopy sends the personal copy of the mail to rcpt
+// and the bulk Bcc recipients in one transaction
+func (s *SmtpClient) sendBulkCopy(ctx context.Context, m *Mail, rcpt string, cfg BulkConfig) error {
+	pm := m.clone()
+	pm.resetRecipients()
+
+	if err := pm.To(rcpt); err != nil {
+		return err
+	}
+
+	if cfg.Personalize != nil {
+		if err := cfg.Personalize(pm, rcpt); err != nil {
+			return err
+		}
+	}
+
+	done, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer done()
+
+	return s.send(pm, append(pm.Recipients(), cfg.Bcc...))
 }
@@ -1,9 +1,30 @@
 package wail
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"golang.org/x/oauth2"
 )
 
 func testClientNoConfig() *SmtpClient {
@@ -106,6 +127,52 @@ func TestClose(t *testing.T) {
 	if err := testClientNoConfig().Close(); err == nil {
 		t.Error("can't do Close() before Dial()")
 	}
+
+	ts := newTestServer(t)
+	ts.resetQuit = true
+
+	c := NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Errorf("A connection reset by the server after 221 should not be an error, got %v", err)
+	}
+
+	if err := c.Send(testMail("example1@example.com")); err == nil || !strings.Contains(err.Error(), "not established") {
+		t.Errorf("Send after Close should fail, got %v", err)
+	}
+
+	// Without 221 the session may not be over
+	ts.dropQuit = true
+
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err == nil {
+		t.Error("A connection reset by the server instead of replying to QUIT should be an error")
+	}
+}
+
+func TestCloseResetTLS(t *testing.T) {
+	ts, _ := newTLSTestServer(t)
+	ts.resetQuit = true
+
+	cfg := ts.config()
+	cfg.Server.EncryptType = EncryptSSL
+	cfg.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The close_notify alert is sent to the reset connection
+	if err := c.Close(); err != nil {
+		t.Errorf("A connection reset by the server after 221 should not be an error, got %v", err)
+	}
 }
 
 func TestSend(t *testing.T) {
@@ -125,7 +192,7 @@ func TestSend(t *testing.T) {
 	}
 
 	// Do Send() -> Close() -> Send()
-	// This test checks whether reconnection to the server is being performed
+	// This test checks that a closed client can't send mails until Dial
 	mail := NewMail(nil)
 
 	mail.SetSubject("тема")
@@ -138,8 +205,2591 @@ func TestSend(t *testing.T) {
 
 	c.Send(mail)
 	c.Close()
-	
+
+	if err := c.Send(mail); err == nil {
+		t.Error("can't do Send() after Close()")
+	}
+
+	c.Dial()
+
 	if err := c.Send(mail); err != nil {
 		t.Error(err)
 	}
 }
+
+// testServer is a fake SMTP server that records everything it receives
+type testServer struct {
+	ln         net.Listener
+	extensions []string
+
+	mu           sync.Mutex
+	commands     []string
+	transactions []testTransaction
+
+	// auth contains decoded credentials of AUTH PLAIN commands
+	auth []string
+
+	// dataReply is a reply to the message content. Default is "250 OK"
+	dataReply string
+
+	// rcptDelay delays replies to RCPT commands of the recipients
+	rcptDelay map[string]time.Duration
+
+	// rejectConns is a number of next connections to reject
+	rejectConns int
+
+	// rejectReply is a greeting of the rejected connections
+	rejectReply string
+
+	// dropData makes the server drop the connection in the middle
+	// of the next message content
+	dropData bool
+
+	// compressed is set when the session is switched to DEFLATE
+	compressed bool
+
+	// compressReply rejects the COMPRESS command if it's set
+	compressReply string
+
+	// mailboxes contains the addresses confirmed by VRFY. If it's
+	// nil, VRFY is disabled
+	mailboxes map[string]bool
+
+	// dropQuit makes the server close the connection
+	// abruptly instead of replying to QUIT
+	dropQuit bool
+
+	// resetQuit makes the server reset the connection
+	// right after replying to QUIT
+	resetQuit bool
+
+	// password is the only password accepted by AUTH PLAIN if it's set
+	password string
+
+	// tlsConfig enables the STARTTLS command
+	tlsConfig *tls.Config
+
+	// startTLS is set once a session is upgraded with STARTTLS
+	startTLS bool
+}
+
+type testTransaction struct {
+	from   string
+	params string
+	rcpt   []string
+	data   string
+}
+
+func newTestServer(t testing.TB, extensions ...string) *testServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &testServer{ln: ln, extensions: extensions}
+
+	go ts.serve()
+	t.Cleanup(func() { ln.Close() })
+
+	return ts
+}
+
+// config returns a config of an unencrypted connection to the server
+func (ts *testServer) config() *SmtpConfig {
+	port := ts.ln.Addr().(*net.TCPAddr).Port
+
+	return &SmtpConfig{
+		Server: ServerConfig{
+			Host:           "127.0.0.1",
+			Port:           uint16(port),
+			ConnectTimeout: 5 * time.Second,
+			EncryptType:    EncryptNone,
+		},
+		Sender: SenderConfig{
+			Name:  "Test",
+			Login: "sender@example.com",
+		},
+	}
+}
+
+func (ts *testServer) serve() {
+	for {
+		conn, err := ts.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go ts.handle(conn)
+	}
+}
+
+func (ts *testServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := textproto.NewReader(bufio.NewReader(conn))
+	w := bufio.NewWriter(conn)
+
+	// fw and raw are set once the session is compressed
+	var (
+		fw  *flate.Writer
+		raw *bufio.Writer
+	)
+
+	reply := func(lines ...string) {
+		for _, l := range lines {
+			w.WriteString(l + "\r\n")
+		}
+
+		w.Flush()
+
+		if fw != nil {
+			fw.Flush()
+			raw.Flush()
+		}
+	}
+
+	var tx *testTransaction
+
+	ts.mu.Lock()
+	reject := ts.rejectConns > 0
+	if reject {
+		ts.rejectConns--
+	}
+	rejectReply := ts.rejectReply
+	ts.mu.Unlock()
+
+	if reject {
+		if rejectReply == "" {
+			rejectReply = "554 No SMTP service here"
+		}
+
+		reply(rejectReply)
+		return
+	}
+
+	reply("220 localhost ESMTP ready")
+
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return
+		}
+
+		ts.mu.Lock()
+		ts.commands = append(ts.commands, line)
+		ts.mu.Unlock()
+
+		verb, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			lines := []string{"250-localhost"}
+			for _, ext := range ts.extensions {
+				lines = append(lines, "250-"+ext)
+			}
+
+			reply(append(lines, "250 HELP")...)
+		case "MAIL":
+			from, params := parsePath(arg)
+			tx = &testTransaction{from: from, params: params}
+			reply("250 OK")
+		case "RCPT":
+			to, _ := parsePath(arg)
+			tx.rcpt = append(tx.rcpt, to)
+
+			ts.mu.Lock()
+			delay := ts.rcptDelay[to]
+			ts.mu.Unlock()
+
+			time.Sleep(delay)
+			reply("250 OK")
+		case "BDAT":
+			size, last, _ := strings.Cut(arg, " ")
+
+			n, err := strconv.Atoi(size)
+			if err != nil {
+				reply("501 Invalid chunk size")
+				continue
+			}
+
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(r.R, chunk); err != nil {
+				return
+			}
+
+			tx.data += string(chunk)
+
+			if strings.EqualFold(last, "LAST") {
+				ts.mu.Lock()
+				ts.transactions = append(ts.transactions, *tx)
+				ts.mu.Unlock()
+			}
+
+			reply("250 OK")
+		case "DATA":
+			reply("354 Go ahead")
+
+			ts.mu.Lock()
+			drop := ts.dropData
+			ts.dropData = false
+			ts.mu.Unlock()
+
+			if drop {
+				r.ReadLine()
+				return
+			}
+
+			data, err := r.ReadDotBytes()
+			if err != nil {
+				return
+			}
+
+			tx.data = string(data)
+
+			ts.mu.Lock()
+			ts.transactions = append(ts.transactions, *tx)
+			dataReply := ts.dataReply
+			ts.mu.Unlock()
+
+			if dataReply == "" {
+				dataReply = "250 OK"
+			}
+
+			reply(dataReply)
+		case "AUTH":
+			mech, resp, _ := strings.Cut(arg, " ")
+			if !strings.EqualFold(mech, "PLAIN") {
+				reply("504 Unrecognized authentication type")
+				continue
+			}
+
+			if resp == "" {
+				reply("334 ")
+
+				if resp, err = r.ReadLine(); err != nil {
+					return
+				}
+			}
+
+			cred, err := base64.StdEncoding.DecodeString(resp)
+			if err != nil {
+				reply("501 Invalid base64 data")
+				continue
+			}
+
+			ts.mu.Lock()
+			ts.auth = append(ts.auth, string(cred))
+			password := ts.password
+			ts.mu.Unlock()
+
+			if password != "" && !strings.HasSuffix(string(cred), "\x00"+password) {
+				reply("535 5.7.8 Authentication failed")
+				continue
+			}
+
+			reply("235 2.7.0 Authentication successful")
+		case "STARTTLS":
+			ts.mu.Lock()
+			cfg := ts.tlsConfig
+			ts.mu.Unlock()
+
+			if cfg == nil {
+				reply("454 TLS not available")
+				continue
+			}
+
+			reply("220 Ready to start TLS")
+
+			conn = tls.Server(conn, cfg)
+			r = textproto.NewReader(bufio.NewReader(conn))
+			w = bufio.NewWriter(conn)
+
+			ts.mu.Lock()
+			ts.startTLS = true
+			ts.mu.Unlock()
+		case "COMPRESS":
+			if !strings.EqualFold(arg, "DEFLATE") {
+				reply("504 Unsupported compression")
+				continue
+			}
+
+			ts.mu.Lock()
+			compressReply := ts.compressReply
+			ts.mu.Unlock()
+
+			if compressReply != "" {
+				reply(compressReply)
+				continue
+			}
+
+			reply("250 OK")
+
+			raw = w
+			fw, _ = flate.NewWriter(raw, flate.DefaultCompression)
+
+			r = textproto.NewReader(bufio.NewReader(flate.NewReader(r.R)))
+			w = bufio.NewWriter(fw)
+
+			ts.mu.Lock()
+			ts.compressed = true
+			ts.mu.Unlock()
+		case "RSET":
+			tx = nil
+			reply("250 OK")
+		case "VRFY":
+			ts.mu.Lock()
+			mailboxes := ts.mailboxes
+			ts.mu.Unlock()
+
+			switch {
+			case mailboxes == nil:
+				reply("502 5.5.1 VRFY command is disabled")
+			case mailboxes[arg]:
+				reply("250 2.1.5 <" + arg + ">")
+			default:
+				reply("550 5.1.1 No such user here")
+			}
+		case "NOOP":
+			reply("250 OK")
+		case "QUIT":
+			ts.mu.Lock()
+			drop, reset := ts.dropQuit, ts.resetQuit
+			ts.mu.Unlock()
+
+			if !drop {
+				reply("221 Bye")
+			}
+
+			if drop || reset {
+				setLinger(conn)
+			}
+
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// setLinger makes closing of the connection reset it
+func setLinger(conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+
+	conn.(*net.TCPConn).SetLinger(0)
+}
+
+// parsePath returns the path and the parameters of the MAIL or RCPT command
+func parsePath(arg string) (string, string) {
+	start, end := strings.Index(arg, "<"), strings.Index(arg, ">")
+	if start < 0 || end < start {
+		return "", ""
+	}
+
+	return arg[start+1 : end], strings.TrimSpace(arg[end+1:])
+}
+
+func (ts *testServer) received() []testTransaction {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return append([]testTransaction(nil), ts.transactions...)
+}
+
+// headerValue returns a value of the header field from the raw message
+func headerValue(data string, field string) string {
+	header, _, _ := strings.Cut(data, "\n\n")
+
+	for _, l := range strings.Split(header, "\n") {
+		if k, v, ok := strings.Cut(l, ":"); ok && strings.EqualFold(k, field) {
+			return strings.TrimSpace(v)
+		}
+	}
+
+	return ""
+}
+
+func TestSendGroups(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	mail := NewMail(nil)
+	mail.SetSubject("Report")
+
+	mt := NewTextMessage()
+	mt.Set(TextPlain, []byte("Hello, World"))
+
+	mail.SetMessage(&mt)
+
+	groups := []RecipientGroup{
+		{To: []string{"a1@example.com", "a2@example.com"}, Cc: []string{"manager-a@example.com"}},
+		{To: []string{"b1@example.com"}, Cc: []string{"manager-b@example.com"}},
+	}
+
+	if err := c.SendGroups(mail, groups); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := ts.received()
+	if len(tx) != 2 {
+		t.Fatalf("Expect 2 transactions, got %d", len(tx))
+	}
+
+	expect := []struct {
+		rcpt []string
+		cc   string
+	}{
+		{[]string{"a1@example.com", "a2@example.com", "manager-a@example.com"}, "<manager-a@example.com>"},
+		{[]string{"b1@example.com", "manager-b@example.com"}, "<manager-b@example.com>"},
+	}
+
+	for i, e := range expect {
+		if strings.Join(tx[i].rcpt, ",") != strings.Join(e.rcpt, ",") {
+			t.Errorf("Invalid recipients of group %d, expect %v, got %v", i, e.rcpt, tx[i].rcpt)
+		}
+
+		if cc := headerValue(tx[i].data, "Cc"); cc != e.cc {
+			t.Errorf("Invalid Cc of group %d, expect %s, got %s", i, e.cc, cc)
+		}
+
+		if subj := headerValue(tx[i].data, "Subject"); subj == "" {
+			t.Errorf("Subject of group %d is lost", i)
+		}
+	}
+
+	if len(mail.recipients) != 0 {
+		t.Error("SendGroups should not change the original mail")
+	}
+}
+
+func TestPasswordFunc(t *testing.T) {
+	ts := newTestServer(t, "AUTH PLAIN")
+
+	calls := 0
+
+	cfg := ts.config()
+	cfg.Server.NeedAuth = true
+	cfg.Sender.Password = "static"
+	cfg.Sender.PasswordFunc = func() (string, error) {
+		calls++
+		return "from-vault", nil
+	}
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if calls != 1 {
+		t.Errorf("PasswordFunc should be called once, called %d times", calls)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if len(ts.auth) != 1 || ts.auth[0] != "\x00sender@example.com\x00from-vault" {
+		t.Errorf("The password from PasswordFunc should be used for auth, got %q", ts.auth)
+	}
+}
+
+func testMail(to ...string) *Mail {
+	mail := NewMail(nil)
+	mail.SetSubject("Test")
+	mail.To(to...)
+
+	mt := NewTextMessage()
+	mt.Set(TextPlain, []byte("Hello, World"))
+
+	mail.SetMessage(&mt)
+
+	return mail
+}
+
+func TestRateLimit(t *testing.T) {
+	ts := newTestServer(t)
+
+	cfg := ts.config()
+	cfg.RateLimit = 20
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	const n = 4
+
+	start := time.Now()
+
+	for i := 0; i < n; i++ {
+		if err := c.Send(testMail("example@example.com")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first message is sent immediately, each next one waits 1/20s
+	if elapsed, min := time.Since(start), (n-1)*time.Second/20; elapsed < min {
+		t.Errorf("Sending %d messages should take at least %v, took %v", n, min, elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := c.SendContext(ctx, testMail("example@example.com")); err == nil {
+		t.Error("Waiting for the rate limit should be interrupted by the context")
+	}
+
+	if tx := ts.received(); len(tx) != n {
+		t.Errorf("Expect %d transactions, got %d", n, len(tx))
+	}
+}
+
+func TestSendBinaryMIME(t *testing.T) {
+	content := []byte("\x00\x01binary\r\n.\r\n\xff\xfe\n")
+
+	mail := NewMail(&MailConfig{Encoding: Binary})
+	mail.To("example@example.com")
+
+	mt := NewMultipartMixedMessage()
+	mt.SetText(TextPlain, []byte("See the attachment"))
+
+	a := NewAttachment()
+	a.SetAsBinary("data.bin", content)
+
+	mt.AddAttachment(a)
+	mail.SetMessage(&mt)
+
+	ts := newTestServer(t, "CHUNKING", "BINARYMIME")
+
+	c := NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if err := c.Send(mail); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := ts.received()
+	if len(tx) != 1 {
+		t.Fatalf("Expect 1 transaction, got %d", len(tx))
+	}
+
+	if tx[0].params != "BODY=BINARYMIME" {
+		t.Errorf("Invalid MAIL parameters, expect %s, got %s", "BODY=BINARYMIME", tx[0].params)
+	}
+
+	if !strings.Contains(tx[0].data, "Content-Transfer-Encoding: binary\r\n\r\n"+string(content)) {
+		t.Error("The attachment should be sent as is")
+	}
+
+	// The server without BINARYMIME can't accept binary messages
+	ts = newTestServer(t, "CHUNKING")
+
+	c = NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if err := c.Send(mail); err == nil {
+		t.Error("Binary encoding should require the BINARYMIME extension")
+	}
+}
+
+func TestSendFromConfig(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	mail := testMail("example@example.com")
+
+	if err := c.Send(mail); err != nil {
+		t.Fatal(err)
+	}
+
+	err := mail.SetFromConfig(FromConfig{
+		Name:     "Support",
+		Address:  "support@example.com",
+		Envelope: "bounces@example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Send(mail); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := ts.received()
+	if len(tx) != 2 {
+		t.Fatalf("Expect 2 transactions, got %d", len(tx))
+	}
+
+	expect := []struct {
+		envelope, from, sender string
+	}{
+		{"sender@example.com", "Test <sender@example.com>", ""},
+		{"bounces@example.com", "Support <support@example.com>", "<bounces@example.com>"},
+	}
+
+	for i, e := range expect {
+		if tx[i].from != e.envelope {
+			t.Errorf("Invalid envelope sender %d, expect %s, got %s", i, e.envelope, tx[i].from)
+		}
+
+		if from := headerValue(tx[i].data, "From"); from != e.from {
+			t.Errorf("Invalid From field %d, expect %s, got %s", i, e.from, from)
+		}
+
+		if sender := headerValue(tx[i].data, "Sender"); sender != e.sender {
+			t.Errorf("Invalid Sender field %d, expect %s, got %s", i, e.sender, sender)
+		}
+	}
+}
+
+func TestSeparateBccDelivery(t *testing.T) {
+	ts := newTestServer(t)
+
+	cfg := ts.config()
+	cfg.SeparateBccDelivery = true
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	mail := testMail("to@example.com")
+	mail.CopyTo("cc@example.com")
+	mail.BlindCopyTo("bcc@example.com")
+
+	if err := c.Send(mail); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := ts.received()
+	if len(tx) != 2 {
+		t.Fatalf("Expect 2 transactions, got %d", len(tx))
+	}
+
+	if rcpt := strings.Join(tx[0].rcpt, ","); rcpt != "to@example.com,cc@example.com" {
+		t.Errorf("Invalid recipients of the main transaction, got %s", rcpt)
+	}
+
+	if rcpt := strings.Join(tx[1].rcpt, ","); rcpt != "bcc@example.com" {
+		t.Errorf("Invalid recipients of the Bcc transaction, got %s", rcpt)
+	}
+
+	for i := range tx {
+		if strings.Contains(tx[i].data, "bcc@example.com") {
+			t.Errorf("Transaction %d should not mention the Bcc recipient", i)
+		}
+	}
+
+	// The mail to Bcc recipients only gets the placeholder To field
+	mail = testMail()
+	mail.BlindCopyTo("bcc@example.com")
+
+	if err := c.Send(mail); err != nil {
+		t.Fatal(err)
+	}
+
+	if tx = ts.received(); !strings.Contains(tx[2].data, "To:undisclosed-recipients:;\n") {
+		t.Errorf("The To field should be the undisclosed recipients group, got\n%s", tx[2].data)
+	}
+}
+
+func TestSendMTPriority(t *testing.T) {
+	mail := testMail("example@example.com")
+
+	if err := mail.SetMTPriority(10); err == nil {
+		t.Error("Priority should be in range from -9 to 9")
+	}
+
+	if err := mail.SetMTPriority(4); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ext := range []string{"MT-PRIORITY MIXER", ""} {
+		ts := newTestServer(t, ext)
+
+		c := NewClient(ts.config())
+		if err := c.Dial(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Send(mail); err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close()
+
+		expect := ""
+		if ext != "" {
+			expect = "MT-PRIORITY=4"
+		}
+
+		if tx := ts.received(); len(tx) != 1 || tx[0].params != expect {
+			t.Errorf("Invalid MAIL parameters, expect %q, got %+v", expect, tx)
+		}
+	}
+}
+
+func TestSendExpectedStatus(t *testing.T) {
+	ts := newTestServer(t)
+	ts.dataReply = "250 2.0.0 Ok: queued as 4F2A1"
+
+	cfg := ts.config()
+	cfg.ExpectedStatus = "2.0.0"
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if err := c.Send(testMail("rcpt@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := c.LastResponse()
+	if resp.Code != 250 || resp.Message != "2.0.0 Ok: queued as 4F2A1" || resp.EnhancedCode() != "2.0.0" {
+		t.Errorf("Invalid last response %+v", resp)
+	}
+
+	ts.mu.Lock()
+	ts.dataReply = "250 2.6.0 Ok: queued with warnings"
+	ts.mu.Unlock()
+
+	err := c.Send(testMail("rcpt@example.com"))
+	if err == nil || !strings.Contains(err.Error(), "2.6.0 Ok: queued with warnings") {
+		t.Errorf("Expect the non-250 DATA reply to be reported, got %v", err)
+	}
+
+	ts.mu.Lock()
+	ts.dataReply = "554 5.7.1 Message rejected"
+	ts.mu.Unlock()
+
+	if err := c.Send(testMail("rcpt@example.com")); err == nil {
+		t.Error("Expect an error for a rejected message")
+	}
+
+	if resp := c.LastResponse(); resp.Code != 554 || resp.EnhancedCode() != "5.7.1" {
+		t.Errorf("Invalid last response %+v", resp)
+	}
+}
+
+func TestBufferSizes(t *testing.T) {
+	ts := newTestServer(t)
+
+	cfg := ts.config()
+	cfg.Server.ReadBufferSize = 64 << 10
+	cfg.Server.WriteBufferSize = 64 << 10
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	body := strings.Repeat("0123456789abcdef\r\n", 16<<10)
+
+	mt := NewTextMessage()
+	mt.Set(TextPlain, []byte(body))
+
+	m := NewMail(&MailConfig{Encoding: SevenBit})
+	m.To("rcpt@example.com")
+	m.SetMessage(&mt)
+
+	if err := c.Send(m); err != nil {
+		t.Fatal(err)
+	}
+
+	rcv := ts.received()
+	if len(rcv) != 1 {
+		t.Fatalf("Expect 1 transaction, got %d", len(rcv))
+	}
+
+	if _, data, _ := strings.Cut(rcv[0].data, "\n\n"); strings.TrimSuffix(data, "\n") != strings.ReplaceAll(body, "\r\n", "\n") {
+		t.Errorf("The message body is corrupted (%d bytes received)", len(data))
+	}
+
+	if r, w := c.client.Text.R.Size(), c.client.Text.W.Size(); r != 64<<10 || w != 64<<10 {
+		t.Errorf("The buffers should be sized, got %d and %d", r, w)
+	}
+}
+
+func TestStartTLSBufferSizes(t *testing.T) {
+	ts, cert := newTLSTestServer(t)
+	ts.ln.Close()
+
+	ts = newTestServer(t, "STARTTLS", "AUTH PLAIN")
+	ts.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	cfg := ts.config()
+	cfg.Server.EncryptType = EncryptTLS
+	cfg.Server.NeedAuth = true
+	cfg.Server.ReadBufferSize = 32 << 10
+	cfg.Server.WriteBufferSize = 64 << 10
+	cfg.Sender.Password = "secret"
+	cfg.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+
+	// smtp.PlainAuth allows unencrypted "localhost" and "127.0.0.1"
+	cfg.Server.Host = "::ffff:127.0.0.1"
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if r, w := c.client.Text.R.Size(), c.client.Text.W.Size(); r != 32<<10 || w != 64<<10 {
+		t.Errorf("The buffers of the TLS connection should be sized, got %d and %d", r, w)
+	}
+
+	if banner := c.Banner(); banner != "220 localhost ESMTP ready" {
+		t.Errorf("The greeting before STARTTLS should be kept, got %q", banner)
+	}
+
+	if err := c.Send(testMail("rcpt@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if !ts.startTLS || len(ts.auth) != 1 || len(ts.transactions) != 1 {
+		t.Errorf("The mail should be sent over STARTTLS, got %d auths and %d transactions", len(ts.auth), len(ts.transactions))
+	}
+}
+
+func BenchmarkSendBufferSizes(b *testing.B) {
+	mt := NewTextMessage()
+	mt.Set(TextPlain, bytes.Repeat([]byte("0123456789abcdef\r\n"), 64<<10))
+
+	m := NewMail(&MailConfig{Encoding: SevenBit})
+	m.To("rcpt@example.com")
+	m.SetMessage(&mt)
+
+	for _, size := range []int{0, 16 << 10, 64 << 10} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			ts := newTestServer(b)
+
+			cfg := ts.config()
+			cfg.Server.ReadBufferSize = size
+			cfg.Server.WriteBufferSize = size
+
+			c := NewClient(cfg)
+			if err := c.Dial(); err != nil {
+				b.Fatal(err)
+			}
+
+			defer c.Close()
+
+			b.SetBytes(int64(len(mt.text)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := c.Send(m); err != nil {
+					b.Fatal(err)
+				}
+
+				ts.mu.Lock()
+				ts.transactions = nil
+				ts.mu.Unlock()
+			}
+		})
+	}
+}
+
+func TestSendReusesConnection(t *testing.T) {
+	ts := newTestServer(t, "AUTH PLAIN")
+
+	cfg := ts.config()
+	cfg.Server.NeedAuth = true
+	cfg.Sender.Password = "secret"
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.Send(testMail("rcpt@example.com")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Reset(); err == nil {
+		t.Error("can't do Reset() after Close()")
+	}
+
+	if rcv := ts.received(); len(rcv) != 2 {
+		t.Fatalf("Expect 2 transactions, got %d", len(rcv))
+	}
+
+	count := map[string]int{}
+
+	ts.mu.Lock()
+	for _, cmd := range ts.commands {
+		verb, _, _ := strings.Cut(cmd, " ")
+		count[verb]++
+	}
+	ts.mu.Unlock()
+
+	if count["EHLO"] != 1 || count["AUTH"] != 1 || count["RSET"] != 2 {
+		t.Errorf("The connection should be reused via RSET, got commands %v", count)
+	}
+}
+
+func TestBeforeSend(t *testing.T) {
+	ts := newTestServer(t)
+
+	cfg := ts.config()
+	cfg.BeforeSend = func(raw []byte) ([]byte, error) {
+		return append([]byte("X-Stamp: checked\r\n"), raw...), nil
+	}
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if err := c.Send(testMail("rcpt@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	rcv := ts.received()
+	if len(rcv) != 1 || !strings.HasPrefix(rcv[0].data, "X-Stamp: checked\n") {
+		t.Fatalf("The stamp should be prepended to the message, got %v", rcv)
+	}
+
+	cfg.BeforeSend = func(raw []byte) ([]byte, error) {
+		return nil, errors.New("signing failed")
+	}
+
+	if err := c.Send(testMail("rcpt@example.com")); err == nil || !strings.Contains(err.Error(), "signing failed") {
+		t.Errorf("Expect the BeforeSend error, got %v", err)
+	}
+
+	if rcv := ts.received(); len(rcv) != 1 {
+		t.Errorf("The rejected message should not be sent, got %d transactions", len(rcv))
+	}
+}
+
+func TestRcptTimeout(t *testing.T) {
+	ts := newTestServer(t)
+	ts.rcptDelay = map[string]time.Duration{"slow@example.com": time.Second}
+
+	cfg := ts.config()
+	cfg.Server.RcptTimeout = 100 * time.Millisecond
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	err := c.Send(testMail("fast@example.com", "slow@example.com"))
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() || !strings.Contains(err.Error(), "slow@example.com") {
+		t.Fatalf("Expect a timeout of slow@example.com, got %v", err)
+	}
+
+	// The broken connection is restored by the next Send
+	if err := c.Send(testMail("fast@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	if rcv := ts.received(); len(rcv) != 1 || rcv[0].rcpt[0] != "fast@example.com" {
+		t.Errorf("Invalid transactions %v", rcv)
+	}
+}
+
+func TestServerAddress(t *testing.T) {
+	tests := map[string]ServerConfig{
+		"smtp.example.com:587": {Host: "smtp.example.com", Port: 587},
+		"192.0.2.1:25":         {Host: "192.0.2.1", Port: 25},
+		"[2001:db8::1]:465":    {Host: "2001:db8::1", Port: 465},
+	}
+
+	for expect, srv := range tests {
+		if addr := srv.address(); addr != expect {
+			t.Errorf("Invalid address of %s, expect %s, got %s", srv.Host, expect, addr)
+		}
+	}
+}
+
+func TestHeloName(t *testing.T) {
+	defer func(h func() (string, error), l func(string) (string, error)) {
+		hostname, lookupCNAME = h, l
+	}(hostname, lookupCNAME)
+
+	hostname = func() (string, error) { return "pod-abc123", nil }
+	lookupCNAME = func(string) (string, error) { return "", errors.New("no such host") }
+
+	ts := newTestServer(t)
+
+	ehlo := func(cfg *SmtpConfig) string {
+		ts.mu.Lock()
+		ts.commands = nil
+		ts.mu.Unlock()
+
+		c := NewClient(cfg)
+		if err := c.Dial(); err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close()
+
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+
+		return ts.commands[0]
+	}
+
+	if cmd := ehlo(ts.config()); cmd != "EHLO [127.0.0.1]" {
+		t.Errorf("The address literal should be used for an unqualified hostname, got %q", cmd)
+	}
+
+	lookupCNAME = func(string) (string, error) { return "pod-abc123.cluster.example.com.", nil }
+
+	if cmd := ehlo(ts.config()); cmd != "EHLO pod-abc123.cluster.example.com" {
+		t.Errorf("The qualified hostname should be used, got %q", cmd)
+	}
+
+	cfg := ts.config()
+	cfg.Helo = "mail.example.com"
+
+	if cmd := ehlo(cfg); cmd != "EHLO mail.example.com" {
+		t.Errorf("The configured name should be used, got %q", cmd)
+	}
+
+	cfg = ts.config()
+	cfg.HeloAddressLiteral = true
+
+	if cmd := ehlo(cfg); cmd != "EHLO [127.0.0.1]" {
+		t.Errorf("The address literal of the local IP should be used, got %q", cmd)
+	}
+
+	for ip, expect := range map[string]string{"192.0.2.1": "EHLO [192.0.2.1]", "2001:db8::1": "EHLO [IPv6:2001:db8::1]"} {
+		cfg = ts.config()
+		cfg.Helo = ip
+
+		if cmd := ehlo(cfg); cmd != expect {
+			t.Errorf("The configured IP should be turned into the address literal, expect %q, got %q", expect, cmd)
+		}
+	}
+}
+
+func TestDialPrefersPlainAuth(t *testing.T) {
+	ts := newTestServer(t, "AUTH LOGIN PLAIN")
+
+	cfg := ts.config()
+	cfg.Server.NeedAuth = true
+	cfg.Sender.Password = "secret"
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if len(ts.auth) != 1 || ts.auth[0] != "\x00sender@example.com\x00secret" {
+		t.Errorf("PLAIN should be used when the server advertises LOGIN first, got %q", ts.auth)
+	}
+}
+
+func TestDialAuthIdentity(t *testing.T) {
+	ts := newTestServer(t, "AUTH PLAIN")
+
+	cfg := ts.config()
+	cfg.Server.NeedAuth = true
+	cfg.Sender.Password = "secret"
+	cfg.Sender.AuthIdentity = "shared@example.com"
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if len(ts.auth) != 1 || ts.auth[0] != "shared@example.com\x00sender@example.com\x00secret" {
+		t.Errorf("The authorization identity should be sent in AUTH PLAIN, got %q", ts.auth)
+	}
+}
+
+func TestDialWithoutAuth(t *testing.T) {
+	ts := newTestServer(t, "AUTH LOGIN PLAIN")
+
+	cfg := ts.config()
+	cfg.Sender.Password = "secret"
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if err := c.Send(testMail("rcpt@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, cmd := range ts.commands {
+		if strings.HasPrefix(strings.ToUpper(cmd), "AUTH") {
+			t.Errorf("The client should not authenticate when NeedAuth is false, got %q", cmd)
+		}
+	}
+
+	if len(ts.transactions) != 1 {
+		t.Errorf("Expect 1 transaction, got %d", len(ts.transactions))
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	ts := newTestServer(t)
+
+	cfg := ts.config()
+	cfg.Reconnect = ReconnectConfig{Attempts: 3, Backoff: 10 * time.Millisecond}
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	// Break the connection and make the first reconnect fail
+	c.conn.Close()
+
+	ts.mu.Lock()
+	ts.rejectConns = 1
+	ts.mu.Unlock()
+
+	if err := c.Send(testMail("rcpt@example.com")); err != nil {
+		t.Fatalf("The connection should be restored on the second attempt, got %v", err)
+	}
+
+	c.conn.Close()
+
+	ts.mu.Lock()
+	ts.rejectConns = 3
+	ts.mu.Unlock()
+
+	if err := c.Send(testMail("rcpt@example.com")); err == nil {
+		t.Error("Sending should fail when all the reconnect attempts fail")
+	}
+
+	if rcv := ts.received(); len(rcv) != 1 {
+		t.Errorf("Expect 1 transaction, got %d", len(rcv))
+	}
+}
+
+func TestSendAfterDroppedData(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	ts.mu.Lock()
+	ts.dropData = true
+	ts.mu.Unlock()
+
+	if err := c.Send(testMail("rcpt@example.com")); !errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("Expect ErrConnectionLost when the connection is dropped during DATA, got %v", err)
+	}
+
+	if !c.broken {
+		t.Error("The client should be marked as disconnected")
+	}
+
+	if err := c.Send(testMail("rcpt@example.com")); err != nil {
+		t.Fatalf("The next Send on the same client should succeed, got %v", err)
+	}
+
+	// A large message fails while it's being written
+	large := NewMail(nil)
+	large.To("rcpt@example.com")
+	large.SetMessage(PlainText(strings.Repeat("Hello, World\r\n", 1<<18)))
+
+	ts.mu.Lock()
+	ts.dropData = true
+	ts.mu.Unlock()
+
+	if err := c.Send(large); !errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("Expect ErrConnectionLost when the connection is dropped during DATA, got %v", err)
+	}
+
+	if err := c.Send(testMail("rcpt@example.com")); err != nil {
+		t.Fatalf("The next Send on the same client should succeed, got %v", err)
+	}
+
+	if rcv := ts.received(); len(rcv) != 2 {
+		t.Errorf("Expect 2 transactions, got %d", len(rcv))
+	}
+}
+
+func TestReconnectError(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if err := c.Send(testMail("rcpt@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection drops between two mails of the session
+	c.conn.Close()
+
+	if err := c.Send(testMail("rcpt@example.com")); err != nil {
+		t.Fatalf("The mail should be sent over the restored connection, got %v", err)
+	}
+
+	if rcv := ts.received(); len(rcv) != 2 || len(rcv[1].rcpt) != 1 || rcv[1].from == "" {
+		t.Fatalf("The full transaction should be sent again, got %+v", rcv)
+	}
+
+	c.conn.Close()
+
+	ts.mu.Lock()
+	ts.rejectConns = 1
+	ts.mu.Unlock()
+
+	err := c.Send(testMail("rcpt@example.com"))
+	if !errors.Is(err, ErrReconnect) || errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("Expect ErrReconnect when the connection can't be restored, got %v", err)
+	}
+
+	if r := c.LastResponse(); r.Code != 0 {
+		t.Errorf("The response of the lost connection should be reset, got %v", r)
+	}
+
+	if err := c.Send(testMail("rcpt@example.com")); err != nil {
+		t.Fatalf("The next Send should restore the connection, got %v", err)
+	}
+
+	if rcv := ts.received(); len(rcv) != 3 {
+		t.Errorf("Expect 3 transactions, got %d", len(rcv))
+	}
+}
+
+func TestResend(t *testing.T) {
+	original := []byte("Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+		"From: <author@example.com>\r\n" +
+		"To: <old@example.com>\r\n" +
+		"Message-ID: <original@example.com>\r\n" +
+		"Subject: Report\r\n" +
+		"\r\n" +
+		"Hello\r\n")
+
+	if _, err := Resend(original, ResentConfig{From: "forwarder@example.com"}); err == nil {
+		t.Error("Resend without addresses should fail")
+	}
+
+	raw, err := Resend(original, ResentConfig{
+		From:      "forwarder@example.com",
+		To:        []string{"new@example.com"},
+		Date:      time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		MessageID: "resent-1@example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t)
+
+	c := NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if err := c.SendRaw("forwarder@example.com", []string{"new@example.com"}, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	rcv := ts.received()
+	if len(rcv) != 1 || rcv[0].from != "forwarder@example.com" || rcv[0].rcpt[0] != "new@example.com" {
+		t.Fatalf("Invalid transactions %+v", rcv)
+	}
+
+	expect := "Resent-Date: Fri, 01 Mar 2024 12:00:00 +0000\n" +
+		"Resent-From: <forwarder@example.com>\n" +
+		"Resent-To: <new@example.com>\n" +
+		"Resent-Message-ID: <resent-1@example.com>\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000\n"
+
+	if !strings.HasPrefix(rcv[0].data, expect) || headerValue(rcv[0].data, "Message-ID") != "<original@example.com>" {
+		t.Errorf("The Resent-* block should precede the original header, got\n%s", rcv[0].data)
+	}
+}
+
+func TestSendRawRejected(t *testing.T) {
+	ts := newTestServer(t, "SIZE 64")
+
+	c := NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	raw := []byte("Subject: Hi\r\n\r\nHello\r\n")
+
+	if err := c.SendRaw("sender@example.com", nil, raw); err == nil {
+		t.Error("SendRaw without recipients should fail")
+	}
+
+	if err := c.SendRaw("sender@example.com", []string{"Bob <bob@example.com>"}, raw); err == nil {
+		t.Error("SendRaw should reject an invalid recipient")
+	}
+
+	if err := c.SendRaw("sender@example.com", []string{"bob@example.com"}, bytes.Repeat(raw, 10)); err == nil {
+		t.Error("SendRaw should reject a message exceeding the max size")
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, cmd := range ts.commands {
+		if strings.EqualFold(cmd, "RSET") {
+			t.Errorf("The rejected messages should not reach the server, got commands %v", ts.commands)
+			break
+		}
+	}
+}
+
+func TestResendDisplayNames(t *testing.T) {
+	original := []byte("From: <author@example.com>\r\n" +
+		"To: <old@example.com>\r\n" +
+		"Subject: Report\r\n" +
+		"\r\n" +
+		"Hello\r\n")
+
+	raw, err := Resend(original, ResentConfig{
+		From: "Bob <bob@example.com>",
+		To:   []string{"Al <al@example.com>", "new@example.com"},
+		Cc:   []string{`"Doe, John" <john@example.com>`},
+		Date: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"Resent-From": `"Bob" <bob@example.com>`,
+		"Resent-To":   `"Al" <al@example.com>, <new@example.com>`,
+		"Resent-Cc":   `"Doe, John" <john@example.com>`,
+	}
+
+	for field, value := range expect {
+		if got := msg.Header.Get(field); got != value {
+			t.Errorf("Invalid %s field, expect %s, got %s", field, value, got)
+		}
+
+		if _, err := msg.Header.AddressList(field); err != nil {
+			t.Errorf("The %s field should be a valid address list (%v)", field, err)
+		}
+	}
+
+	if id := msg.Header.Get("Resent-Message-ID"); !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("The Resent-Message-ID should use the domain of the sender, got %s", id)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	for _, ext := range []string{"COMPRESS DEFLATE", ""} {
+		ts := newTestServer(t, ext)
+
+		cfg := ts.config()
+		cfg.Compress = true
+
+		c := NewClient(cfg)
+		if err := c.Dial(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := c.Send(testMail("rcpt@example.com")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		ts.mu.Lock()
+		compressed := ts.compressed
+		ts.mu.Unlock()
+
+		if compressed != (ext != "") {
+			t.Errorf("Expect compressed %v for the extensions %q", ext != "", ext)
+		}
+
+		if rcv := ts.received(); len(rcv) != 2 || headerValue(rcv[1].data, "To") != "<rcpt@example.com>" {
+			t.Errorf("Invalid transactions %+v", rcv)
+		}
+	}
+}
+
+func TestCompressRejected(t *testing.T) {
+	ts := newTestServer(t, "COMPRESS DEFLATE")
+	ts.compressReply = "454 Compression not available"
+
+	cfg := ts.config()
+	cfg.Compress = true
+
+	c := NewClient(cfg)
+
+	var protoErr *textproto.Error
+	if err := c.Dial(); !errors.As(err, &protoErr) || protoErr.Code != 454 {
+		t.Errorf("Expect the rejected COMPRESS to be reported, got %v", err)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.compressed {
+		t.Error("The session shouldn't be compressed")
+	}
+}
+
+func TestSendFrom(t *testing.T) {
+	ts := newTestServer(t, "AUTH PLAIN")
+
+	cfg := ts.config()
+	cfg.Server.NeedAuth = true
+	cfg.Sender.Password = "secret"
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	mail := testMail("rcpt@example.com")
+
+	tenants := []FromConfig{
+		{Name: "Tenant A", Address: "news@a.example.com"},
+		{Name: "Tenant B", Address: "news@b.example.com", Envelope: "bounces@b.example.com"},
+	}
+
+	for _, from := range tenants {
+		if err := c.SendFrom(from, mail); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.SendFrom(FromConfig{Address: "invalid"}, mail); err == nil {
+		t.Error("An invalid sender should be rejected")
+	}
+
+	if err := c.Send(mail); err != nil {
+		t.Fatal(err)
+	}
+
+	rcv := ts.received()
+	if len(rcv) != 3 {
+		t.Fatalf("Expect 3 transactions, got %d", len(rcv))
+	}
+
+	expect := []struct{ envelope, from string }{
+		{"sender@example.com", "Tenant A <news@a.example.com>"},
+		{"bounces@b.example.com", "Tenant B <news@b.example.com>"},
+		{"sender@example.com", "Test <sender@example.com>"},
+	}
+
+	for i, e := range expect {
+		if rcv[i].from != e.envelope {
+			t.Errorf("Invalid envelope sender of mail %d, expect %s, got %s", i, e.envelope, rcv[i].from)
+		}
+
+		if !strings.Contains(rcv[i].data, "From:"+e.from+"\n") {
+			t.Errorf("Mail %d should be sent from %s, got\n%s", i, e.from, rcv[i].data)
+		}
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if len(ts.auth) != 1 {
+		t.Errorf("The session should be authenticated once, got %d AUTH commands", len(ts.auth))
+	}
+}
+
+func TestVerifyRecipient(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if _, _, err := c.VerifyRecipient("user@example.com"); !errors.Is(err, ErrVerifyUnavailable) {
+		t.Errorf("Expect ErrVerifyUnavailable if VRFY is disabled, got %v", err)
+	}
+
+	ts.mu.Lock()
+	ts.mailboxes = map[string]bool{"user@example.com": true}
+	ts.mu.Unlock()
+
+	ok, msg, err := c.VerifyRecipient("user@example.com")
+	if err != nil || !ok || msg != "2.1.5 <user@example.com>" {
+		t.Errorf("The address should exist, got %v %q (%v)", ok, msg, err)
+	}
+
+	ok, msg, err = c.VerifyRecipient("User <user@example.com>")
+	if err != nil || !ok || msg != "2.1.5 <user@example.com>" {
+		t.Errorf("The address with a display name should exist, got %v %q (%v)", ok, msg, err)
+	}
+
+	ok, msg, err = c.VerifyRecipient("nobody@example.com")
+	if err != nil || ok || msg != "5.1.1 No such user here" {
+		t.Errorf("The address should not exist, got %v %q (%v)", ok, msg, err)
+	}
+
+	if _, _, err := c.VerifyRecipient("not an address"); err == nil {
+		t.Error("An invalid address should be rejected")
+	}
+}
+
+func TestFallbackServers(t *testing.T) {
+	primary := newTestServer(t)
+	primary.dataReply = "451 4.3.0 Temporary failure"
+
+	fallback := newTestServer(t)
+
+	// The closed listener stands for the unavailable server
+	down := newTestServer(t)
+	down.ln.Close()
+
+	cfg := primary.config()
+	cfg.FallbackServers = []ServerConfig{down.config().Server, fallback.config().Server}
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if err := c.Send(testMail("rcpt@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	if rcv := fallback.received(); len(rcv) != 1 {
+		t.Fatalf("The message should be submitted to the fallback server, got %d transactions", len(rcv))
+	}
+
+	if srv := c.LastResponse().Server; srv != fallback.ln.Addr().String() {
+		t.Errorf("Invalid server that accepted the message, expect %s, got %s", fallback.ln.Addr(), srv)
+	}
+
+	// The next mail is sent to the primary server again
+	primary.mu.Lock()
+	primary.dataReply = ""
+	primary.mu.Unlock()
+
+	if err := c.Send(testMail("rcpt@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	if srv := c.LastResponse().Server; srv != primary.ln.Addr().String() {
+		t.Errorf("The primary server should accept the next message, got %s", srv)
+	}
+
+	// A permanent rejection is not submitted to the other servers
+	primary.mu.Lock()
+	primary.dataReply = "554 5.7.1 Rejected"
+	primary.mu.Unlock()
+
+	if err := c.Send(testMail("rcpt@example.com")); err == nil {
+		t.Error("The error should be returned if the server rejects the message")
+	}
+
+	if rcv := fallback.received(); len(rcv) != 1 {
+		t.Errorf("The rejected message should not be submitted to the fallback server, got %d transactions", len(rcv))
+	}
+
+	primary.mu.Lock()
+	primary.dataReply = "451 4.3.0 Temporary failure"
+	primary.mu.Unlock()
+
+	fallback.mu.Lock()
+	fallback.dataReply = "554 5.7.1 Rejected"
+	fallback.mu.Unlock()
+
+	if err := c.Send(testMail("rcpt@example.com")); err == nil {
+		t.Error("The error should be returned if the last server rejects the message")
+	}
+
+	// Dial falls back to the next available server
+	cfg = down.config()
+	cfg.FallbackServers = []ServerConfig{primary.config().Server}
+
+	c = NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	cfg = down.config()
+
+	if err := NewClient(cfg).Dial(); err == nil {
+		t.Error("Dial should fail if no server is available")
+	}
+}
+
+func TestSmtpConfigValidate(t *testing.T) {
+	valid := func() *SmtpConfig {
+		return &SmtpConfig{
+			Server: ServerConfig{
+				Host:        "smtp.example.com",
+				Port:        465,
+				NeedAuth:    true,
+				EncryptType: EncryptSSL,
+			},
+			Sender: SenderConfig{
+				Login:    "sender@example.com",
+				Password: "secret",
+			},
+		}
+	}
+
+	if err := valid().Validate(); err != nil {
+		t.Errorf("The config should be valid, got %v", err)
+	}
+
+	tests := map[string]func(c *SmtpConfig){
+		"host is not specified":         func(c *SmtpConfig) { c.Server.Host = "" },
+		"port is not specified":         func(c *SmtpConfig) { c.Server.Port = 0 },
+		"login is not specified":        func(c *SmtpConfig) { c.Sender.Login = "" },
+		"password or token source":      func(c *SmtpConfig) { c.Sender.Password = "" },
+		"encryption type 5 is unknown":  func(c *SmtpConfig) { c.Server.EncryptType = 5 },
+		"timeouts must not be negative": func(c *SmtpConfig) { c.Server.ConnectTimeout = -time.Second },
+		"rate limit -1 is negative":     func(c *SmtpConfig) { c.RateLimit = -1 },
+		"fallback server 1 host":        func(c *SmtpConfig) { c.FallbackServers = []ServerConfig{{Port: 465}} },
+	}
+
+	for problem, mutate := range tests {
+		cfg := valid()
+		mutate(cfg)
+
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expect the %q problem, got %v", problem, err)
+		}
+
+		if err := NewClient(cfg).Dial(); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("Dial should validate the config, expect the %q problem, got %v", problem, err)
+		}
+	}
+
+	cfg := valid()
+	cfg.Server.Host = ""
+	cfg.Sender.Login = ""
+
+	if err := cfg.Validate(); err == nil || strings.Count(err.Error(), "\n") != 1 {
+		t.Errorf("All the problems should be listed, got %v", err)
+	}
+
+	// The token source replaces the password
+	cfg = valid()
+	cfg.Sender.Password = ""
+	cfg.Sender.TokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"})
+
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("The config with the token source should be valid, got %v", err)
+	}
+}
+
+func TestSmtpConfigWarnings(t *testing.T) {
+	cfg := &SmtpConfig{
+		Server: ServerConfig{Host: "smtp.example.com", Port: 465, EncryptType: EncryptSSL},
+	}
+
+	if w := cfg.Warnings(); w != nil {
+		t.Errorf("The config should have no warnings, got %v", w)
+	}
+
+	tests := map[string]func(c *SmtpConfig){
+		"server port 587 expects STARTTLS":     func(c *SmtpConfig) { c.Server.Port = 587 },
+		"server port 465 expects implicit TLS": func(c *SmtpConfig) { c.Server.EncryptType = EncryptTLS },
+		"fallback server 1 port 25":            func(c *SmtpConfig) { c.FallbackServers = []ServerConfig{{Host: "a", Port: 25, EncryptType: EncryptSSL}} },
+	}
+
+	for problem, mutate := range tests {
+		c := *cfg
+		mutate(&c)
+
+		if w := c.Warnings(); w == nil || !strings.Contains(w.Error(), problem) {
+			t.Errorf("Expect the %q warning, got %v", problem, w)
+		}
+
+		// A mismatch of the port and the encryption doesn't prevent Dial
+		if err := c.Validate(); err != nil {
+			t.Errorf("The %q warning should not be a validation error, got %v", problem, err)
+		}
+	}
+}
+
+// serveThrottled serves a single SMTP session over conn reading
+// the message content slowly, like a server on a slow link
+func serveThrottled(conn net.Conn, received *int64) {
+	defer conn.Close()
+
+	r := textproto.NewReader(bufio.NewReader(conn))
+	w := textproto.NewWriter(bufio.NewWriter(conn))
+
+	w.PrintfLine("220 localhost ESMTP ready")
+
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, _, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			w.PrintfLine("250-localhost")
+			w.PrintfLine("250 HELP")
+		case "DATA":
+			w.PrintfLine("354 Start mail input")
+
+			dr := r.DotReader()
+			buf := make([]byte, 4096)
+
+			for {
+				n, err := dr.Read(buf)
+				atomic.AddInt64(received, int64(n))
+
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return
+				}
+
+				time.Sleep(100 * time.Microsecond)
+			}
+
+			w.PrintfLine("250 OK")
+		case "QUIT":
+			w.PrintfLine("221 Bye")
+			return
+		default:
+			w.PrintfLine("250 OK")
+		}
+	}
+}
+
+// lazyMessage generates the message content on demand
+// and tracks how far it has been read ahead of the server
+type lazyMessage struct {
+	size     int64
+	produced int64
+	received *int64
+	maxLag   int64
+
+	// onRead is called after each read
+	onRead func(produced int64)
+}
+
+func (l *lazyMessage) Read(p []byte) (int, error) {
+	if l.produced >= l.size {
+		return 0, io.EOF
+	}
+
+	if rest := l.size - l.produced; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+
+	for i := range p {
+		switch (l.produced + int64(i)) % 78 {
+		case 76:
+			p[i] = '\r'
+		case 77:
+			p[i] = '\n'
+		default:
+			p[i] = 'a'
+		}
+	}
+
+	l.produced += int64(len(p))
+
+	if lag := l.produced - atomic.LoadInt64(l.received); lag > l.maxLag {
+		l.maxLag = lag
+	}
+
+	if l.onRead != nil {
+		l.onRead(l.produced)
+	}
+
+	return len(p), nil
+}
+
+// throttledClient returns the client connected to serveThrottled
+func throttledClient(t *testing.T, received *int64) *SmtpClient {
+	cc, sc := net.Pipe()
+	go serveThrottled(sc, received)
+
+	c, err := smtp.NewClient(cc, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &SmtpConfig{Server: ServerConfig{Host: "localhost"}}
+
+	s := NewClient(cfg)
+	s.client, s.conn, s.server = c, cc, &cfg.Server
+
+	return s
+}
+
+func TestSendReaderBackpressure(t *testing.T) {
+	const bound = 256 << 10
+
+	connect := func(received *int64) *SmtpClient {
+		return throttledClient(t, received)
+	}
+
+	var received int64
+
+	c := connect(&received)
+	msg := &lazyMessage{size: 1 << 20, received: &received}
+
+	if err := c.SendReader("sender@example.com", []string{"rcpt@example.com"}, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+
+	if msg.maxLag > bound {
+		t.Errorf("The message should not be read ahead of the server, lag %d bytes", msg.maxLag)
+	}
+
+	// The transfer is aborted as soon as ctx is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var abortedAt int64
+
+	received = 0
+	c = connect(&received)
+	msg = &lazyMessage{size: 1 << 20, received: &received, onRead: func(produced int64) {
+		if produced > bound && abortedAt == 0 {
+			abortedAt = produced
+			cancel()
+		}
+	}}
+
+	start := time.Now()
+
+	err := c.SendReaderContext(ctx, "sender@example.com", []string{"rcpt@example.com"}, msg)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expect the cancellation error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("The transfer should be aborted immediately, took %v", elapsed)
+	}
+
+	if msg.produced-abortedAt > bound {
+		t.Errorf("The message should not be read after the cancellation, read %d more bytes", msg.produced-abortedAt)
+	}
+}
+
+func TestSendBulk(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	mail := testMail()
+	mail.SetSubject("News")
+
+	rcpts := []string{"alice@example.com", "not an address", "bob@example.com"}
+
+	err := c.SendBulk(mail, rcpts, BulkConfig{
+		Bcc: []string{"archive@example.com"},
+		Personalize: func(m *Mail, rcpt string) error {
+			m.SetSubject("News for " + rcpt)
+			return nil
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "not an address") {
+		t.Errorf("The invalid recipient should be reported, got %v", err)
+	}
+
+	tx := ts.received()
+	if len(tx) != 2 {
+		t.Fatalf("Expect 2 transactions, got %d", len(tx))
+	}
+
+	for i, rcpt := range []string{"alice@example.com", "bob@example.com"} {
+		if strings.Join(tx[i].rcpt, ",") != rcpt+",archive@example.com" {
+			t.Errorf("Invalid envelope recipients of %s, got %v", rcpt, tx[i].rcpt)
+		}
+
+		if !strings.Contains(tx[i].data, "To:<"+rcpt+">\n") || !strings.Contains(tx[i].data, "Subject:News for "+rcpt+"\n") {
+			t.Errorf("The copy should be personalized for %s, got\n%s", rcpt, tx[i].data)
+		}
+
+		if strings.Contains(tx[i].data, "archive@example.com") || strings.Contains(tx[i].data, rcpts[2-i*2]) {
+			t.Errorf("The copy of %s should not mention other recipients", rcpt)
+		}
+	}
+
+	for _, bcc := range []string{"invalid", "Archive <archive@example.com>"} {
+		err := c.SendBulk(mail, rcpts, BulkConfig{Bcc: []string{bcc}})
+		if err == nil || strings.Contains(err.Error(), "failed to send to") {
+			t.Errorf("The invalid Bcc address %q should be rejected before sending, got %v", bcc, err)
+		}
+	}
+
+	if tx := ts.received(); len(tx) != 2 {
+		t.Errorf("The bulk with an invalid Bcc address should not be sent, got %d transactions", len(tx))
+	}
+}
+
+func TestFromNamePolicy(t *testing.T) {
+	ts := newTestServer(t)
+
+	cfg := ts.config()
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	tests := []struct {
+		policy fromNamePolicy
+		sender string
+		expect string
+	}{
+		{FromNameAsIs, "", "From:news@example.com\n"},
+		{FromNameLocalPart, "", "From:news <news@example.com>\n"},
+		{FromNameSender, "Weekly News", "From:Weekly News <news@example.com>\n"},
+		{FromNameSender, "", "From:news <news@example.com>\n"},
+	}
+
+	for i, tt := range tests {
+		cfg.Sender.Name = tt.sender
+
+		mail := NewMail(&MailConfig{FromName: tt.policy})
+		mail.To("rcpt@example.com")
+		mail.SetFrom("", "news@example.com")
+		mail.SetMessage(PlainText("Hello, World"))
+
+		if err := c.Send(mail); err != nil {
+			t.Fatal(err)
+		}
+
+		if tx := ts.received(); !strings.Contains(tx[i].data, tt.expect) {
+			t.Errorf("Expect %q with policy %d, got\n%s", tt.expect, tt.policy, tx[i].data)
+		}
+	}
+}
+
+func TestDefaultTLSConfig(t *testing.T) {
+	cfg := DefaultTLSConfig()
+
+	if cfg.MinVersion < tls.VersionTLS12 {
+		t.Errorf("MinVersion should be at least TLS 1.2, got %x", cfg.MinVersion)
+	}
+
+	if len(cfg.CipherSuites) == 0 {
+		t.Error("TLS 1.2 cipher suites should be set")
+	}
+
+	cfg.MinVersion = tls.VersionTLS10
+
+	if DefaultTLSConfig().MinVersion != tls.VersionTLS12 {
+		t.Error("Each call should return a new config")
+	}
+
+	ts := newTestServer(t, "")
+
+	scfg := ts.config()
+	scfg.Server.EncryptType = EncryptSSL
+
+	c := NewClient(scfg)
+
+	if tc := c.tlsConfig(&scfg.Server); tc.MinVersion != tls.VersionTLS12 || tc.ServerName != "127.0.0.1" {
+		t.Errorf("The default config with the server name should be used, got %+v", tc)
+	}
+}
+
+// newTLSTestServer starts a test server with the implicit TLS
+// and returns it along with its certificate
+func newTLSTestServer(t *testing.T, extensions ...string) (*testServer, tls.Certificate) {
+	// httptest provides a self-signed certificate for 127.0.0.1
+	hs := httptest.NewTLSServer(nil)
+	hs.Close()
+
+	cert := hs.TLS.Certificates[0]
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &testServer{ln: ln, extensions: extensions}
+
+	go ts.serve()
+	t.Cleanup(func() { ln.Close() })
+
+	return ts, cert
+}
+
+func TestVerifyConnection(t *testing.T) {
+	ts, cert := newTLSTestServer(t)
+
+	pinned := cert.Certificate[0]
+
+	var verified int
+
+	cfg := ts.config()
+	cfg.Server.EncryptType = EncryptSSL
+	cfg.TlsConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection: func(tls.ConnectionState) error {
+			verified++
+			return nil
+		},
+	}
+
+	shared := cfg.TlsConfig
+
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 || !bytes.Equal(cs.PeerCertificates[0].Raw, pinned) {
+			return errors.New("unexpected certificate")
+		}
+
+		return nil
+	}
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatalf("The pinned certificate should be accepted, got %v", err)
+	}
+
+	c.Close()
+
+	if verified != 1 {
+		t.Errorf("The VerifyConnection of the TlsConfig should be called too, got %d calls", verified)
+	}
+
+	if cfg.TlsConfig != shared || shared.VerifyConnection == nil || shared.ServerName != "" {
+		t.Error("The TlsConfig of the caller should not be modified")
+	}
+
+	pinned = []byte("another certificate")
+
+	if err := c.Dial(); err == nil || !strings.Contains(err.Error(), "unexpected certificate") {
+		t.Errorf("A certificate that doesn't match the pinned one should be rejected, got %v", err)
+	}
+}
+
+func TestOnProgress(t *testing.T) {
+	ts := newTestServer(t)
+
+	type progress struct{ written, total int64 }
+
+	var calls []progress
+
+	cfg := ts.config()
+	cfg.OnProgress = func(written, total int64) {
+		calls = append(calls, progress{written, total})
+	}
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	mail := NewMail(nil)
+	mail.To("rcpt@example.com")
+
+	a := NewAttachment()
+	a.SetAsBinary("large.bin", bytes.Repeat([]byte{0xfe, 0x01, 0x7f}, 100000))
+
+	mt := NewMultipartMixedMessage()
+	mt.SetText(TextPlain, []byte("Hello, World"))
+	mt.AddAttachment(a)
+
+	mail.SetMessage(&mt)
+
+	if err := c.Send(mail); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) < 3 {
+		t.Fatalf("OnProgress should be called periodically, got %d calls", len(calls))
+	}
+
+	total := calls[0].total
+
+	for i, p := range calls {
+		if p.total != total || (i != 0 && p.written <= calls[i-1].written) {
+			t.Errorf("Invalid progress %d: %+v", i, calls)
+			break
+		}
+	}
+
+	if last := calls[len(calls)-1]; last.written != total || total <= 300000 {
+		t.Errorf("The progress should reach the total, got %+v", last)
+	}
+}
+
+func TestSendValidatesRecipients(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	to := []string{"alice@example.com", "Bob <bob@example.com>", "carol@example.com\r\nRSET", "not an address"}
+
+	err := c.SendReader("sender@example.com", to, strings.NewReader("Subject: Hi\r\n\r\nHello\r\n"))
+	if err == nil {
+		t.Fatal("Invalid recipients should be rejected")
+	}
+
+	for _, rcpt := range to[1:] {
+		if !strings.Contains(err.Error(), strconv.Quote(rcpt)) {
+			t.Errorf("The invalid recipient %q should be reported, got %v", rcpt, err)
+		}
+	}
+
+	ts.mu.Lock()
+	for _, cmd := range ts.commands {
+		if verb, _, _ := strings.Cut(cmd, ":"); strings.EqualFold(verb, "MAIL FROM") || strings.EqualFold(verb, "RCPT TO") {
+			t.Errorf("No transaction should be started, got %q", cmd)
+		}
+	}
+	ts.mu.Unlock()
+
+	if err := c.SendReader("sender@example.com", []string{"Postmaster"}, strings.NewReader("Subject: Hi\r\n\r\nHello\r\n")); err != nil {
+		t.Errorf("The postmaster recipient should be allowed, got %v", err)
+	}
+}
+
+func TestSendNullReturnPath(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	mail := testMail("rcpt@example.com")
+	mail.SetFromConfig(FromConfig{Name: "Mail Delivery System", Address: "mailer-daemon@example.com", Envelope: "bounces@example.com"})
+	mail.SetNullReturnPath()
+
+	if err := c.Send(mail); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.mu.Lock()
+	cmds := append([]string(nil), ts.commands...)
+	ts.mu.Unlock()
+
+	found := false
+	for _, cmd := range cmds {
+		found = found || cmd == "MAIL FROM:<>"
+	}
+
+	if !found {
+		t.Errorf("MAIL FROM:<> should be sent, got %q", cmds)
+	}
+
+	tx := ts.received()
+	if len(tx) != 1 || !strings.Contains(tx[0].data, "From:Mail Delivery System <mailer-daemon@example.com>\n") {
+		t.Fatalf("The From field should be kept, got %+v", tx)
+	}
+
+	if strings.Contains(tx[0].data, "Sender:") {
+		t.Error("The Sender field should not be added for the null return path")
+	}
+}
+
+func TestDialAuthFailed(t *testing.T) {
+	ts := newTestServer(t, "AUTH PLAIN")
+	ts.password = "secret"
+
+	cfg := ts.config()
+	cfg.Server.NeedAuth = true
+	cfg.Sender.Password = "wrong"
+
+	c := NewClient(cfg)
+
+	err := c.Dial()
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("Expect ErrAuthFailed, got %v", err)
+	}
+
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 535 {
+		t.Errorf("The server response should be wrapped, got %v", err)
+	}
+
+	cfg.Sender.Password = "secret"
+
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+
+	// A connection error is not an authentication failure
+	ts.ln.Close()
+
+	if err := c.Dial(); err == nil || errors.Is(err, ErrAuthFailed) {
+		t.Errorf("A connection error should not be ErrAuthFailed, got %v", err)
+	}
+}
+
+func TestBanner(t *testing.T) {
+	ts := newTestServer(t, "")
+
+	c := NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if got, want := c.Banner(), "220 localhost ESMTP ready"; got != want {
+		t.Errorf("Expect banner %q, got %q", want, got)
+	}
+}
+
+func TestBannerImplicitTLS(t *testing.T) {
+	ts, _ := newTLSTestServer(t, "AUTH CRAM-MD5 PLAIN")
+
+	cfg := ts.config()
+	cfg.Server.EncryptType = EncryptSSL
+	cfg.Server.NeedAuth = true
+	cfg.Sender.Password = "secret"
+	cfg.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+
+	// smtp.PlainAuth allows unencrypted "localhost" and "127.0.0.1"
+	cfg.Server.Host = "::ffff:127.0.0.1"
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if banner := c.Banner(); banner != "220 localhost ESMTP ready" {
+		t.Errorf("Invalid banner %q", banner)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	// The recorded greeting must not make the session look unencrypted
+	if len(ts.auth) != 1 || ts.auth[0] != "\x00sender@example.com\x00secret" {
+		t.Errorf("PLAIN should be used over the implicit TLS, got %q", ts.auth)
+	}
+}
+
+func TestTlsAuth(t *testing.T) {
+	server := &smtp.ServerInfo{Name: "smtp.example.com", Auth: []string{"PLAIN"}}
+
+	auth := smtp.PlainAuth("", "sender@example.com", "secret", "smtp.example.com")
+	if _, _, err := auth.Start(server); err == nil {
+		t.Fatal("PLAIN should be refused over an unencrypted connection")
+	}
+
+	_, resp, err := tlsAuth{auth}.Start(server)
+	if err != nil {
+		t.Fatalf("tlsAuth should mark the connection as encrypted, got %v", err)
+	}
+
+	if string(resp) != "\x00sender@example.com\x00secret" {
+		t.Errorf("Invalid PLAIN response %q", resp)
+	}
+
+	if server.TLS {
+		t.Error("tlsAuth should not modify the server info")
+	}
+}
+
+func TestBannerMultiline(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		server.Write([]byte("220-smtp.example.com ESMTP\r\n220 ready\r\n250 OK\r\n"))
+	}()
+
+	gc := &greetingConn{Conn: client}
+	r := bufio.NewReader(gc)
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, want := gc.banner(), "220-smtp.example.com ESMTP\n220 ready"; got != want {
+		t.Errorf("Expect banner %q, got %q", want, got)
+	}
+}
+
+func TestSendTest(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := NewClient(ts.config())
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	m := testMail("rcpt@example.com")
+	m.CopyTo("cc@example.com")
+
+	if err := c.SendTest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := ts.received()
+	if len(tr) != 1 {
+		t.Fatalf("Expect 1 transaction, got %d", len(tr))
+	}
+
+	if len(tr[0].rcpt) != 1 || tr[0].rcpt[0] != "sender@example.com" {
+		t.Errorf("The mail should be sent to the sender login only, got %q", tr[0].rcpt)
+	}
+
+	if to := headerValue(tr[0].data, "To"); !strings.Contains(to, "rcpt@example.com") {
+		t.Errorf("The To field should be kept, got %q", to)
+	}
+}
+
+func TestMaxConcurrentDials(t *testing.T) {
+	srv := &ServerConfig{Host: "192.0.2.1", Port: 587, MaxConcurrentDials: 2}
+
+	var active, peak int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			release, err := acquireDialSlot(srv)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			n := atomic.AddInt32(&active, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+			release()
+		}()
+	}
+
+	wg.Wait()
+
+	if peak != 2 {
+		t.Errorf("Expect at most 2 concurrent dials, got %d", peak)
+	}
+
+	// The slot is held, so the next Dial times out
+	one := &ServerConfig{Host: "192.0.2.2", Port: 587, EncryptType: EncryptTLS, MaxConcurrentDials: 1, ConnectTimeout: 20 * time.Millisecond}
+
+	release, err := acquireDialSlot(one)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer release()
+
+	c := NewClient(&SmtpConfig{Server: *one})
+	if err := c.Dial(); err == nil || !strings.Contains(err.Error(), "dial slot") {
+		t.Errorf("Expect a dial slot timeout, got %v", err)
+	}
+
+	// The first limit of the address is shared by a sender with another one
+	other := *one
+	other.MaxConcurrentDials = 3
+
+	if _, err := acquireDialSlot(&other); err == nil || !strings.Contains(err.Error(), "dial slot") {
+		t.Errorf("The limit of the address should be shared, got %v", err)
+	}
+}
+
+func TestReconnectRetryAfter(t *testing.T) {
+	ts := newTestServer(t)
+
+	cfg := ts.config()
+	cfg.Reconnect = ReconnectConfig{Attempts: 2, Backoff: 10 * time.Millisecond, MaxBackoff: 5 * time.Second}
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	tests := []struct {
+		reply      string
+		maxBackoff time.Duration
+		min, max   time.Duration
+	}{
+		{"451 4.7.1 Too many connections, Retry-After: 1", 5 * time.Second, time.Second, 3 * time.Second},
+		{"421 4.3.2 Busy, try again in 10 minutes", 200 * time.Millisecond, 200 * time.Millisecond, time.Second},
+		{"554 No SMTP service here, retry after 60", 5 * time.Second, 0, 500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		c.cfg.Reconnect.MaxBackoff = tt.maxBackoff
+		c.conn.Close()
+
+		ts.mu.Lock()
+		ts.rejectConns = 1
+		ts.rejectReply = tt.reply
+		ts.mu.Unlock()
+
+		start := time.Now()
+
+		if err := c.Send(testMail("rcpt@example.com")); err != nil {
+			t.Fatalf("The connection should be restored on the second attempt, got %v", err)
+		}
+
+		if d := time.Since(start); d < tt.min || d > tt.max {
+			t.Errorf("%q: expected a delay between %v and %v, got %v", tt.reply, tt.min, tt.max, d)
+		}
+	}
+}
+
+func TestSendStreamsAttachments(t *testing.T) {
+	content := bytes.Repeat([]byte{0xff, 0x00, 0x80}, 1<<20)
+
+	a := NewAttachment()
+	a.SetAsBinary("large.bin", content)
+
+	mt := NewMultipartMixedMessage()
+	mt.SetText(TextPlain, []byte("See the attachment"))
+	mt.AddAttachment(a)
+
+	m := NewMail(nil)
+	m.To("rcpt@example.com")
+	m.SetMessage(&mt)
+
+	var received int64
+
+	c := throttledClient(t, &received)
+	defer c.Close()
+
+	var before, after runtime.MemStats
+
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	if err := c.Send(m); err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.ReadMemStats(&after)
+
+	// The encoded attachment alone is 4 MiB, it must not be held in memory
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Errorf("The attachment should be encoded while it's sent, %d bytes allocated", alloc)
+	}
+
+	if n := atomic.LoadInt64(&received); n < int64(len(content))*4/3 {
+		t.Errorf("The whole message should be sent, the server got %d bytes", n)
+	}
+}
@@ -0,0 +1,170 @@
+package wail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// Environment variables read by SenderConfigFromEnv
+const (
+	EnvSenderName     = "SENDER_NAME"
+	EnvSenderLogin    = "SENDER_LOGIN"
+	EnvSenderPassword = "SENDER_PWD"
+)
+
+// Environment variables read by TokenSourceFromEnv
+const (
+	EnvOAuthClientID     = "OAUTH_CLIENT_ID"
+	EnvOAuthClientSecret = "OAUTH_CLIENT_SECRET"
+	EnvOAuthRefreshToken = "OAUTH_REFRESH_TOKEN"
+	EnvOAuthTokenURL     = "OAUTH_TOKEN_URL"
+)
+
+// defaultTokenURL is the Google token endpoint used if OAUTH_TOKEN_URL is not set
+const defaultTokenURL = "https://oauth2.googleapis.com/token"
+
+// SenderConfigFromEnv returns the sender config filled in from the
+// SENDER_LOGIN, SENDER_PWD and (optional) SENDER_NAME environment variables
+func SenderConfigFromEnv() (SenderConfig, error) {
+	cfg := SenderConfig{
+		Name:     os.Getenv(EnvSenderName),
+		Login:    os.Getenv(EnvSenderLogin),
+		Password: os.Getenv(EnvSenderPassword),
+	}
+
+	if cfg.Login == "" || cfg.Password == "" {
+		return SenderConfig{}, fmt.Errorf("wail: %s and %s environment variables must be set", EnvSenderLogin, EnvSenderPassword)
+	}
+
+	return cfg, nil
+}
+
+// SenderConfigFromNetrc returns the sender config filled in from the netrc
+// entry of the host. The file is taken from the NETRC environment variable
+// or ~/.netrc. The default entry is used if there is no entry of the host
+func SenderConfigFromNetrc(host string) (SenderConfig, error) {
+	path := os.Getenv("NETRC")
+
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return SenderConfig{}, fmt.Errorf("wail: can't find the netrc file (%w)", err)
+		}
+
+		path = filepath.Join(home, ".netrc")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return SenderConfig{}, fmt.Errorf("wail: can't read the netrc file (%w)", err)
+	}
+
+	cfg, ok := parseNetrc(string(data), host)
+	if !ok || cfg.Login == "" || cfg.Password == "" {
+		return SenderConfig{}, errors.New("wail: no credentials for " + host + " in the netrc file")
+	}
+
+	return cfg, nil
+}
+
+// parseNetrc returns the credentials of the host from the netrc file content
+func parseNetrc(data, host string) (SenderConfig, bool) {
+	var (
+		cfg, def      SenderConfig
+		found, hasDef bool
+		current       *SenderConfig
+	)
+
+	lines := strings.Split(data, "\n")
+
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+
+		for j := 0; j < len(fields); j++ {
+			var value string
+			if j+1 < len(fields) {
+				value = fields[j+1]
+			}
+
+			switch fields[j] {
+			case "machine":
+				current = nil
+
+				if value == host && !found {
+					found = true
+					current = &cfg
+				}
+
+				j++
+			case "default":
+				current = nil
+
+				if !hasDef {
+					hasDef = true
+					current = &def
+				}
+			case "login":
+				if current != nil {
+					current.Login = value
+				}
+
+				j++
+			case "password":
+				if current != nil {
+					current.Password = value
+				}
+
+				j++
+			case "account":
+				j++
+			case "macdef":
+				// A macro definition lasts until an empty line
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+
+				j = len(fields)
+			}
+		}
+	}
+
+	if found {
+		return cfg, true
+	}
+
+	return def, hasDef
+}
+
+// TokenSourceFromEnv returns a token source that refreshes access tokens
+// using the OAUTH_CLIENT_ID, OAUTH_CLIENT_SECRET and OAUTH_REFRESH_TOKEN
+// environment variables. The token endpoint is taken from OAUTH_TOKEN_URL,
+// Google is used by default. Use it with SenderConfig.TokenSource
+func TokenSourceFromEnv() (oauth2.TokenSource, error) {
+	clientID := os.Getenv(EnvOAuthClientID)
+	clientSecret := os.Getenv(EnvOAuthClientSecret)
+	refreshToken := os.Getenv(EnvOAuthRefreshToken)
+
+	if clientID == "" || clientSecret == "" || refreshToken == "" {
+		return nil, fmt.Errorf("wail: %s, %s and %s environment variables must be set",
+			EnvOAuthClientID, EnvOAuthClientSecret, EnvOAuthRefreshToken)
+	}
+
+	tokenURL := os.Getenv(EnvOAuthTokenURL)
+	if tokenURL == "" {
+		tokenURL = defaultTokenURL
+	}
+
+	cfg := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: tokenURL},
+	}
+
+	return cfg.TokenSource(context.Background(), &oauth2.Token{RefreshToken: refreshToken}), nil
+}
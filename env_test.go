@@ -0,0 +1,129 @@
+package wail
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSenderConfigFromEnv(t *testing.T) {
+	t.Setenv(EnvSenderLogin, "")
+	t.Setenv(EnvSenderPassword, "")
+
+	if _, err := SenderConfigFromEnv(); err == nil {
+		t.Error("Missing credentials should be reported")
+	}
+
+	t.Setenv(EnvSenderName, "Sender")
+	t.Setenv(EnvSenderLogin, "sender@example.com")
+	t.Setenv(EnvSenderPassword, "secret")
+
+	cfg, err := SenderConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Name != "Sender" || cfg.Login != "sender@example.com" || cfg.Password != "secret" {
+		t.Errorf("Invalid sender config %+v", cfg)
+	}
+}
+
+func TestSenderConfigFromNetrc(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netrc")
+
+	netrc := `machine imap.example.com login reader@example.com password r3ad
+macdef init
+machine smtp.example.com login fake password fake
+
+machine smtp.example.com
+  login sender@example.com
+  password s3nd
+default login anonymous password guest
+`
+
+	if err := os.WriteFile(path, []byte(netrc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("NETRC", path)
+
+	cfg, err := SenderConfigFromNetrc("smtp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Login != "sender@example.com" || cfg.Password != "s3nd" {
+		t.Errorf("Invalid sender config %+v", cfg)
+	}
+
+	if cfg, _ = SenderConfigFromNetrc("other.example.com"); cfg.Login != "anonymous" {
+		t.Errorf("The default entry should be used, got %+v", cfg)
+	}
+
+	if err := os.WriteFile(path, []byte("machine imap.example.com login a password b\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := SenderConfigFromNetrc("smtp.example.com"); err == nil {
+		t.Error("Missing credentials should be reported")
+	}
+}
+
+func TestTokenSourceFromEnv(t *testing.T) {
+	for _, env := range []string{EnvOAuthClientID, EnvOAuthClientSecret, EnvOAuthRefreshToken} {
+		if os.Getenv(env) == "" {
+			t.Skipf("%s is not set", env)
+		}
+	}
+
+	ts, err := TokenSourceFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.AccessToken == "" {
+		t.Error("The access token is empty")
+	}
+}
+
+func TestTokenSourceFromEnvRefresh(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh" {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"access","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	t.Setenv(EnvOAuthClientID, "id")
+	t.Setenv(EnvOAuthClientSecret, "secret")
+	t.Setenv(EnvOAuthRefreshToken, "")
+	t.Setenv(EnvOAuthTokenURL, srv.URL)
+
+	if _, err := TokenSourceFromEnv(); err == nil {
+		t.Error("Missing credentials should be reported")
+	}
+
+	t.Setenv(EnvOAuthRefreshToken, "refresh")
+
+	ts, err := TokenSourceFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token, err := ts.Token(); err != nil || token.AccessToken != "access" {
+		t.Errorf("Invalid token %+v (%v)", token, err)
+	}
+}
@@ -2,11 +2,15 @@ module github.com/rub1q/wail
 
 go 1.20
 
-require golang.org/x/oauth2 v0.8.0
+require (
+	golang.org/x/net v0.10.0
+	golang.org/x/oauth2 v0.8.0
+	golang.org/x/text v0.9.0
+	golang.org/x/time v0.3.0
+)
 
 require (
 	github.com/golang/protobuf v1.5.2 // indirect
-	golang.org/x/net v0.10.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.28.0 // indirect
 )
@@ -0,0 +1,310 @@
+package wail
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ListConfig contains the List-* header fields of
+// a mailing list message (RFC 2369, RFC 2919, RFC 8058)
+type ListConfig struct {
+	// ID is the list identifier, optionally preceded by a description,
+	// e.g. "Weekly news <news.example.com>"
+	ID string
+
+	// Unsubscribe contains mailto: or https: URLs to unsubscribe from the list
+	Unsubscribe []string
+
+	// UnsubscribePost is an https: URL that unsubscribes the recipient on
+	// a POST request. If it's set, the mail supports one-click unsubscription
+	// (RFC 8058), which is required by Gmail and Yahoo for bulk senders
+	UnsubscribePost string
+
+	// Help is a URL of the list help
+	Help string
+
+	// Archive is a URL of the list archive
+	Archive string
+}
+
+// reservedFields are set by the mail itself and can't be set with SetHeader
+var reservedFields = []string{
+	"Date", "From", "Sender", "To", "Cc", "Bcc", "Subject", "Message-ID",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// SetHeader sets an additional header field, e.g. X-Mailer overriding
+// MailConfig.Mailer. A non-ASCII value is MIME encoded. An empty value removes
+// the field. The fields set by the mail itself (e.g. From) can't be set
+func (m *Mail) SetHeader(name, value string) error {
+	if name == "" || strings.IndexFunc(name, func(r rune) bool { return r <= ' ' || r > '~' || r == ':' }) >= 0 {
+		return fmt.Errorf("wail: invalid header field name %q", name)
+	}
+
+	for _, f := range reservedFields {
+		if strings.EqualFold(f, name) {
+			return fmt.Errorf("wail: the %s field can't be set with SetHeader", f)
+		}
+	}
+
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("wail: value of the %s field must not contain line breaks", name)
+	}
+
+	for i, t := range m.tokens {
+		if strings.EqualFold(t.name, name) {
+			m.tokens = append(m.tokens[:i], m.tokens[i+1:]...)
+			break
+		}
+	}
+
+	value = strings.TrimSpace(value)
+
+	if value != "" && !isASCIIText([]byte(value)) {
+		value = m.mb.encoder.Encode(string(m.mb.charset), value)
+	}
+
+	m.mb.SetField(name, foldList(strings.Split(value, " "), " ", len(name)+1))
+
+	return nil
+}
+
+// tokenField is a header field carrying a base64 encoded payload
+type tokenField struct {
+	name    string
+	payload []byte
+}
+
+// SetTokenHeader sets an X- prefixed header field carrying the base64
+// encoded payload, e.g. a signed token. The standard alphabet is used
+// unless MailConfig.URLSafeTokenHeaders is set. An empty payload
+// removes the field
+func (m *Mail) SetTokenHeader(name string, payload []byte) error {
+	if !strings.HasPrefix(strings.ToUpper(name), "X-") {
+		return fmt.Errorf("wail: token header field name %q must start with X-", name)
+	}
+
+	value := m.mb.encodeToken(payload)
+
+	// The value can't be folded, so it must fit into a line (RFC 5322 2.1.1)
+	if len(name)+2+len(value) > 998 {
+		return fmt.Errorf("wail: payload of the %s field is too large", name)
+	}
+
+	if err := m.SetHeader(name, ""); err != nil || len(payload) == 0 {
+		return err
+	}
+
+	m.tokens = append(m.tokens, tokenField{name: name, payload: append([]byte(nil), payload...)})
+	m.mb.SetField(name, value)
+
+	return nil
+}
+
+// SetListHeaders sets the List-* header fields of the mailing list message
+func (m *Mail) SetListHeaders(cfg ListConfig) error {
+	unsubscribe := cfg.Unsubscribe
+
+	if cfg.UnsubscribePost != "" {
+		u, err := url.Parse(cfg.UnsubscribePost)
+		if err != nil || u.Scheme != "https" {
+			return errors.New("wail: one-click unsubscribe URL must be an https URL")
+		}
+
+		unsubscribe = append([]string{cfg.UnsubscribePost}, unsubscribe...)
+	}
+
+	fields := []struct {
+		name string
+		urls []string
+	}{
+		{"List-Unsubscribe", unsubscribe},
+		{"List-Help", []string{cfg.Help}},
+		{"List-Archive", []string{cfg.Archive}},
+	}
+
+	values := make(map[string]string, len(fields))
+
+	for _, f := range fields {
+		v, err := listURLs(f.name, f.urls)
+		if err != nil {
+			return err
+		}
+
+		values[f.name] = v
+	}
+
+	id := strings.TrimSpace(cfg.ID)
+	if id != "" && !strings.HasSuffix(id, ">") {
+		id = "<" + id + ">"
+	}
+
+	if strings.IndexFunc(id, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+		return errors.New("wail: list ID must not contain line breaks or control characters")
+	}
+
+	if id != "" {
+		open := strings.LastIndexByte(id, '<')
+		if open < 0 || strings.ContainsAny(id[:open], "<>") || strings.ContainsAny(id[open+1:len(id)-1], "<> ") {
+			return fmt.Errorf("wail: invalid list ID %q", id)
+		}
+	}
+
+	m.mb.SetField("List-Id", id)
+
+	for _, f := range fields {
+		m.mb.SetField(f.name, values[f.name])
+	}
+
+	if cfg.UnsubscribePost != "" {
+		m.mb.SetField("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	} else {
+		m.mb.SetField("List-Unsubscribe-Post", "")
+	}
+
+	return nil
+}
+
+// SetListUnsubscribe sets the List-Unsubscribe field (RFC 2369) with mailto:
+// or https: URLs to unsubscribe from the list. No URLs remove the field.
+// The one-click unsubscription is disabled if none of the URLs is https
+func (m *Mail) SetListUnsubscribe(urls ...string) error {
+	v, err := listURLs("List-Unsubscribe", urls)
+	if err != nil {
+		return err
+	}
+
+	m.mb.SetField("List-Unsubscribe", v)
+
+	if !strings.Contains(v, "<https://") {
+		m.mb.SetField("List-Unsubscribe-Post", "")
+	}
+
+	return nil
+}
+
+// SetListUnsubscribeOneClick enables the one-click unsubscription (RFC 8058)
+// required by Gmail and Yahoo for bulk senders. The List-Unsubscribe field
+// must contain an https URL that unsubscribes the recipient on a POST request
+func (m *Mail) SetListUnsubscribeOneClick(enabled bool) error {
+	if !enabled {
+		m.mb.SetField("List-Unsubscribe-Post", "")
+		return nil
+	}
+
+	if !strings.Contains(m.mb.getField("List-Unsubscribe"), "<https://") {
+		return errors.New("wail: one-click unsubscribe requires an https URL in the List-Unsubscribe field")
+	}
+
+	m.mb.SetField("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+
+	return nil
+}
+
+// listURLs formats the URLs as the List-* field value
+func listURLs(field string, urls []string) (string, error) {
+	items := make([]string, 0, len(urls))
+
+	for _, v := range urls {
+		if v == "" {
+			continue
+		}
+
+		u, err := url.Parse(v)
+		if err != nil {
+			return "", fmt.Errorf("wail: invalid %s URL (%w)", field, err)
+		}
+
+		if u.Scheme != "mailto" && u.Scheme != "http" && u.Scheme != "https" {
+			return "", fmt.Errorf("wail: %s URL must be a mailto, http or https URL", field)
+		}
+
+		items = append(items, "<"+u.String()+">")
+	}
+
+	return foldList(items, ", ", len(field)+1), nil
+}
+
+// SetPrecedence sets the Precedence field that marks an automated mail,
+// so auto-responders don't reply to it. The value must be one of bulk,
+// list or junk. An empty value removes the field
+func (m *Mail) SetPrecedence(p string) error {
+	p = strings.ToLower(strings.TrimSpace(p))
+
+	switch p {
+	case "", "bulk", "list", "junk":
+	default:
+		return fmt.Errorf("wail: invalid precedence %q, must be bulk, list or junk", p)
+	}
+
+	m.mb.SetField("Precedence", p)
+
+	return nil
+}
+
+// SetComments sets the Comments field (RFC 5322 3.6.5). A non-ASCII text
+// is MIME encoded. An empty text removes the field
+func (m *Mail) SetComments(text string) {
+	text = strings.TrimSpace(text)
+
+	if text != "" && !isASCIIText([]byte(text)) {
+		text = m.mb.encoder.Encode(string(m.mb.charset), text)
+	}
+
+	m.mb.SetField("Comments", foldList(strings.Fields(text), " ", len("Comments")+1))
+}
+
+// SetKeywords sets the Keywords field (RFC 5322 3.6.5), a comma separated
+// list of the mail keywords. No keywords remove the field
+func (m *Mail) SetKeywords(keywords ...string) error {
+	items := make([]string, 0, len(keywords))
+
+	for _, k := range keywords {
+		if strings.ContainsAny(k, "\r\n") {
+			return errors.New("wail: keywords must not contain line breaks")
+		}
+
+		if k = strings.TrimSpace(k); k != "" {
+			items = append(items, m.mb.encodeDisplayName(k))
+		}
+	}
+
+	m.mb.SetField("Keywords", foldList(items, ", ", len("Keywords")+1))
+
+	return nil
+}
+
+// SetReferences sets the References field (RFC 5322 3.6.4) with Message-IDs
+// of the thread, from the oldest to the parent one. Angle brackets are added
+// if missing. The field is folded between the IDs only, so an ID longer than
+// a line is left as is. No IDs remove the field
+func (m *Mail) SetReferences(ids ...string) error {
+	items := make([]string, 0, len(ids))
+
+	for _, id := range ids {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(id, "<") {
+			id = "<" + id
+		}
+
+		if !strings.HasSuffix(id, ">") {
+			id += ">"
+		}
+
+		if strings.IndexFunc(id, func(r rune) bool { return r <= ' ' || r > '~' }) >= 0 ||
+			strings.Count(id, "<") != 1 || strings.Count(id, ">") != 1 {
+			return fmt.Errorf("wail: invalid Message-ID %q", id)
+		}
+
+		items = append(items, id)
+	}
+
+	m.mb.SetField("References", foldList(items, " ", len("References")+1))
+
+	return nil
+}
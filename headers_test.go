@@ -0,0 +1,355 @@
+package wail
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"testing"
+)
+
+func TestSetListHeaders(t *testing.T) {
+	mail := NewMail(nil)
+	mail.To("example1@example.com")
+
+	err := mail.SetListHeaders(ListConfig{
+		ID:              "Weekly news <news.example.com>",
+		Unsubscribe:     []string{"mailto:unsubscribe@example.com?subject=unsubscribe"},
+		UnsubscribePost: "https://example.com/unsubscribe/opaque-token",
+		Archive:         "https://example.com/archive",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := mail.mb.GetResultMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		"List-Id: Weekly news <news.example.com>\r\n",
+		"List-Unsubscribe: <https://example.com/unsubscribe/opaque-token>,\r\n <mailto:unsubscribe@example.com?subject=unsubscribe>\r\n",
+		"List-Archive: <https://example.com/archive>\r\n",
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+	}
+
+	for _, e := range expect {
+		if !strings.Contains(string(raw), e) {
+			t.Errorf("The message should contain %q, got %q", e, raw)
+		}
+	}
+
+	if strings.Contains(string(raw), "List-Help") {
+		t.Error("An empty List-Help should not be emitted")
+	}
+
+	if err := mail.SetListHeaders(ListConfig{UnsubscribePost: "http://example.com/unsubscribe"}); err == nil {
+		t.Error("One-click unsubscribe URL should be an https URL")
+	}
+
+	if err := mail.SetListHeaders(ListConfig{Unsubscribe: []string{"javascript:alert(1)"}}); err == nil {
+		t.Error("Unsubscribe URL with an unknown scheme should be rejected")
+	}
+
+	for _, id := range []string{"news <news.example.com>\r\nBcc: a@example.com", "news\n<news.example.com>", "a<b", "<news example.com>"} {
+		if err := mail.SetListHeaders(ListConfig{ID: id}); err == nil {
+			t.Errorf("Invalid list ID %q should be rejected", id)
+		}
+	}
+
+	if raw, _ := mail.mb.GetResultMessage(0); !strings.Contains(string(raw), "List-Id: Weekly news <news.example.com>\r\n") {
+		t.Errorf("The rejected list ID should not change the field, got %q", raw)
+	}
+}
+
+func TestSetPrecedence(t *testing.T) {
+	m := NewMail(nil)
+	m.To("example1@example.com")
+
+	if err := m.SetPrecedence("urgent"); err == nil {
+		t.Error("Only bulk, list and junk precedence should be allowed")
+	}
+
+	if err := m.SetPrecedence("Bulk"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := m.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := info.Header.Get("Precedence"); v != "bulk" {
+		t.Errorf("Invalid Precedence field, expect bulk, got %q", v)
+	}
+
+	m.SetPrecedence("")
+
+	if info, _ = m.Inspect(); info.Header.Get("Precedence") != "" {
+		t.Error("The Precedence field should be removed")
+	}
+}
+
+func TestSetCommentsAndKeywords(t *testing.T) {
+	m := NewMail(nil)
+	m.To("example1@example.com")
+
+	m.SetComments("Imported from the legacy ticketing system during the migration of the support archive")
+	m.SetKeywords("support", "Ticket #42, urgent", "отчёт", " ", "archive", "legacy", "migration", "customer")
+
+	info, err := m.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := m.mb.GetResultMessage(0)
+
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > lineLengthLimit {
+			t.Errorf("The line should be folded, got %q", line)
+		}
+	}
+
+	if c := info.Header.Get("Comments"); c != "Imported from the legacy ticketing system during the migration of the support archive" {
+		t.Errorf("Invalid Comments field, got %q", c)
+	}
+
+	expect := `support, "Ticket #42, urgent", отчёт, archive, legacy, migration, customer`
+
+	kw, err := (&mime.WordDecoder{}).DecodeHeader(info.Header.Get("Keywords"))
+	if err != nil || kw != expect {
+		t.Errorf("Invalid Keywords field, expect %s, got %s (%v)", expect, kw, err)
+	}
+
+	m.SetComments("Отчёт")
+
+	if raw, _ = m.mb.GetResultMessage(0); !strings.Contains(string(raw), "Comments: =?UTF-8?b?0J7RgtGH0ZHRgg==?=\r\n") {
+		t.Errorf("A non-ASCII comment should be encoded, got %q", raw)
+	}
+
+	if info, _ = m.Inspect(); info.Header.Get("Comments") != "Отчёт" {
+		t.Errorf("Invalid Comments field, expect %s, got %s", "Отчёт", info.Header.Get("Comments"))
+	}
+
+	if err := m.SetKeywords("support", "x\r\nBcc: a@example.com"); err == nil {
+		t.Error("A keyword with a line break should be rejected")
+	}
+
+	if info, _ = m.Inspect(); info.Header.Get("Bcc") != "" || !strings.HasPrefix(info.Header.Get("Keywords"), "support, ") {
+		t.Errorf("The rejected keywords should not change the fields, got %q", info.Header)
+	}
+
+	m.SetComments("")
+	m.SetKeywords()
+
+	if info, _ = m.Inspect(); info.Header.Get("Comments") != "" || info.Header.Get("Keywords") != "" {
+		t.Error("Empty values should remove the fields")
+	}
+}
+
+func TestSetHeaderMailer(t *testing.T) {
+	m := NewMail(&MailConfig{Mailer: "wail"})
+	m.To("example1@example.com")
+
+	info, err := m.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := info.Header.Get("X-Mailer"); v != "wail" {
+		t.Errorf("The default X-Mailer should be used, got %q", v)
+	}
+
+	if err := m.SetHeader("x-mailer", "Billing 2.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, _ = m.Inspect(); len(info.Header["X-Mailer"]) != 1 || info.Header.Get("X-Mailer") != "Billing 2.1" {
+		t.Errorf("The X-Mailer of the mail should replace the default one, got %q", info.Header["X-Mailer"])
+	}
+
+	for _, name := range []string{"From", "content-type", "sender", "Message-Id", "X Mailer", "X-Mailer:", ""} {
+		if err := m.SetHeader(name, "value"); err == nil {
+			t.Errorf("Setting the %q field should fail", name)
+		}
+	}
+
+	if err := m.SetHeader("X-Tenant", "a\r\nBcc: victim@example.com"); err == nil {
+		t.Error("A value with line breaks should be rejected")
+	}
+
+	m.SetHeader("X-Mailer", "")
+
+	if info, _ = m.Inspect(); info.Header.Get("X-Mailer") != "wail" {
+		t.Errorf("The default X-Mailer should be used again, got %q", info.Header["X-Mailer"])
+	}
+}
+
+func TestSetTokenHeader(t *testing.T) {
+	// The standard alphabet would encode the payload with "+" and "/"
+	payload := []byte{0xfb, 0xff, 0xbf, 0x01}
+
+	m := NewMail(&MailConfig{URLSafeTokenHeaders: true})
+	m.To("example1@example.com")
+
+	if err := m.SetTokenHeader("Token", payload); err == nil {
+		t.Error("A token field name without the X- prefix should be rejected")
+	}
+
+	if err := m.SetTokenHeader("X-Signed-Token", payload); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := m.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := info.Header.Get("X-Signed-Token"); v != "-_-_AQ" {
+		t.Errorf("The token should use the URL-safe alphabet, got %q", v)
+	}
+
+	// The body is still encoded with the standard alphabet
+	mt := NewTextMessage()
+	mt.Set(TextPlain, payload)
+	m.SetMessage(&mt)
+
+	if raw, _ := m.mb.GetResultMessage(0); !strings.Contains(string(raw), "\r\n\r\n+/+/AQ==\r\n") {
+		t.Errorf("The body should use the standard alphabet, got %q", raw)
+	}
+
+	out, err := RenderMessage(MailConfig{}, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(out), "X-Signed-Token: -_-_AQ\r\n") {
+		t.Error("The token should be kept by RenderMessage")
+	}
+
+	m = NewMail(nil)
+	m.To("example1@example.com")
+	m.SetTokenHeader("X-Signed-Token", payload)
+
+	if info, _ = m.Inspect(); info.Header.Get("X-Signed-Token") != "+/+/AQ==" {
+		t.Errorf("The token should use the standard alphabet by default, got %q", info.Header.Get("X-Signed-Token"))
+	}
+
+	m.SetTokenHeader("X-Signed-Token", nil)
+
+	if info, _ = m.Inspect(); info.Header.Get("X-Signed-Token") != "" {
+		t.Error("The token field should be removed")
+	}
+}
+
+func TestSetListUnsubscribe(t *testing.T) {
+	mail := NewMail(nil)
+	mail.To("example1@example.com")
+
+	if err := mail.SetListUnsubscribeOneClick(true); err == nil {
+		t.Error("One-click unsubscribe without an https URL should be rejected")
+	}
+
+	if err := mail.SetListUnsubscribe("mailto:unsubscribe@example.com", "https://example.com/u/token"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mail.SetListUnsubscribeOneClick(true); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := mail.mb.GetResultMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		"List-Unsubscribe: <mailto:unsubscribe@example.com>,\r\n <https://example.com/u/token>\r\n",
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+	}
+
+	for _, e := range expect {
+		if !strings.Contains(string(raw), e) {
+			t.Errorf("The message should contain %q, got %q", e, raw)
+		}
+	}
+
+	if err := mail.SetListUnsubscribe("ftp://example.com/u"); err == nil {
+		t.Error("Unsubscribe URL with an unknown scheme should be rejected")
+	}
+
+	// The one-click unsubscription can't work without an https URL
+	mail.SetListUnsubscribe("mailto:unsubscribe@example.com")
+
+	if raw, _ = mail.mb.GetResultMessage(0); strings.Contains(string(raw), "List-Unsubscribe-Post") {
+		t.Error("List-Unsubscribe-Post should be removed along with the https URL")
+	}
+
+	mail.SetListUnsubscribe()
+
+	if raw, _ = mail.mb.GetResultMessage(0); strings.Contains(string(raw), "List-Unsubscribe") {
+		t.Error("List-Unsubscribe should be removed")
+	}
+}
+
+func TestSetReferences(t *testing.T) {
+	m := NewMail(nil)
+	m.To("example1@example.com")
+
+	var ids []string
+	for i := 0; i < 20; i++ {
+		ids = append(ids, fmt.Sprintf("%d.0123456789abcdef@mail.example.com", i))
+	}
+
+	long := "<" + strings.Repeat("x", lineLengthLimit) + "@example.com>"
+	ids = append(ids, long, "last@example.com")
+
+	if err := m.SetReferences(ids...); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := m.mb.GetResultMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, rest, ok := strings.Cut(string(raw), "\r\nReferences: ")
+	if !ok {
+		t.Fatalf("The References field is missing in %q", raw)
+	}
+
+	lines := strings.Split(rest, "\r\n")
+	for i := 1; i < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], " ") {
+			lines = lines[:i]
+			break
+		}
+	}
+
+	if len(lines) < 3 {
+		t.Fatalf("The References field should be folded, got %q", lines)
+	}
+
+	var got []string
+	for _, l := range lines {
+		for _, id := range strings.Fields(l) {
+			if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, ">") {
+				t.Errorf("The field is folded inside a Message-ID, got line %q", l)
+			}
+
+			got = append(got, id)
+		}
+
+		if len(l) > lineLengthLimit && !strings.Contains(l, long) {
+			t.Errorf("The line should be folded, got %q", l)
+		}
+	}
+
+	if len(got) != len(ids) || got[len(got)-2] != long || got[len(got)-1] != "<last@example.com>" {
+		t.Errorf("Invalid References field, got %q", got)
+	}
+
+	if err := m.SetReferences("bad id@example.com"); err == nil {
+		t.Error("An ID with a space should be rejected")
+	}
+}
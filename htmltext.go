@@ -0,0 +1,150 @@
+package wail
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// blockTags are html elements that start a new paragraph in the plain text
+var blockTags = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"div": true, "dl": true, "fieldset": true, "footer": true, "form": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "main": true, "nav": true, "ol": true,
+	"p": true, "pre": true, "section": true, "table": true, "ul": true,
+}
+
+// skipTags are html elements whose content is not displayed
+var skipTags = map[string]bool{
+	"head": true, "script": true, "style": true, "template": true, "title": true,
+}
+
+var (
+	spaces        = regexp.MustCompile(`\s+`)
+	extraNewlines = regexp.MustCompile(`\n{3,}`)
+)
+
+// HTMLToText converts html to a basic plain text: tags are stripped,
+// entities are decoded and links are kept as "text (url)"
+func HTMLToText(htmlText []byte) []byte {
+	var (
+		out  strings.Builder
+		href []string
+		skip int
+		pre  int
+	)
+
+	z := html.NewTokenizer(bytes.NewReader(htmlText))
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		tok := z.Token()
+
+		switch tt {
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+
+			if pre > 0 {
+				out.WriteString(tok.Data)
+				continue
+			}
+
+			text := spaces.ReplaceAllString(tok.Data, " ")
+
+			if out.Len() == 0 || strings.HasSuffix(out.String(), " ") || strings.HasSuffix(out.String(), "\n") {
+				text = strings.TrimLeft(text, " ")
+			}
+
+			out.WriteString(text)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch {
+			case skipTags[tok.Data]:
+				if tt == html.StartTagToken {
+					skip++
+				}
+			case tok.Data == "br":
+				out.WriteString("\n")
+			case tok.Data == "li":
+				out.WriteString("\n- ")
+			case tok.Data == "tr":
+				out.WriteString("\n")
+			case tok.Data == "td" || tok.Data == "th":
+				out.WriteString(" ")
+			case tok.Data == "img":
+				if alt := attr(tok, "alt"); alt != "" {
+					out.WriteString(alt)
+				}
+			case tok.Data == "a":
+				if tt == html.StartTagToken {
+					href = append(href, attr(tok, "href"))
+				}
+			case blockTags[tok.Data]:
+				out.WriteString("\n\n")
+
+				if tok.Data == "pre" {
+					pre++
+				}
+			}
+		case html.EndTagToken:
+			switch {
+			case skipTags[tok.Data]:
+				if skip > 0 {
+					skip--
+				}
+			case tok.Data == "a":
+				if n := len(href); n != 0 {
+					if url := href[n-1]; isTextLink(url) && !strings.HasSuffix(out.String(), url) {
+						out.WriteString(" (" + url + ")")
+					}
+
+					href = href[:n-1]
+				}
+			case blockTags[tok.Data]:
+				out.WriteString("\n\n")
+
+				if tok.Data == "pre" && pre > 0 {
+					pre--
+				}
+			}
+		}
+	}
+
+	lines := strings.Split(out.String(), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " ")
+	}
+
+	text := extraNewlines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+
+	return []byte(strings.TrimSpace(text))
+}
+
+func attr(tok html.Token, name string) string {
+	for _, a := range tok.Attr {
+		if a.Key == name {
+			return strings.TrimSpace(a.Val)
+		}
+	}
+
+	return ""
+}
+
+// isTextLink reports whether the link is worth keeping in the plain text
+func isTextLink(url string) bool {
+	if url == "" || strings.HasPrefix(url, "#") {
+		return false
+	}
+
+	lower := strings.ToLower(url)
+
+	return !strings.HasPrefix(lower, "javascript:") && !strings.HasPrefix(lower, "cid:")
+}
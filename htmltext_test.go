@@ -0,0 +1,39 @@
+package wail
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	html := `<html><head><title>News</title><style>p { color: red }</style></head>
+<body>
+  <h1>Hello,   World</h1>
+  <p>Fish &amp; chips cost &lt;&euro;5&gt;.<br>Order <a href="https://example.com/order">here</a>
+  or <a href="https://example.com">https://example.com</a>.</p>
+  <ul><li>One</li><li>Two</li></ul>
+  <script>alert("hi")</script>
+</body></html>`
+
+	expect := "Hello, World\n\n" +
+		"Fish & chips cost <€5>.\n" +
+		"Order here (https://example.com/order) or https://example.com.\n\n" +
+		"- One\n" +
+		"- Two"
+
+	if text := string(HTMLToText([]byte(html))); text != expect {
+		t.Errorf("Invalid text, expect\n%q\ngot\n%q", expect, text)
+	}
+}
+
+func TestSetHTML(t *testing.T) {
+	mail := NewMail(nil)
+	mail.To("example1@example.com")
+	mail.SetHTML([]byte("<p>Hello, <b>World</b></p>"))
+
+	info, err := mail.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(info.Parts) != 2 || info.Parts[0].ContentType != "text/plain" || info.Parts[0].Size != len("Hello, World") {
+		t.Errorf("Expected a plain text alternative, got %+v", info.Parts)
+	}
+}
@@ -0,0 +1,187 @@
+package wail
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrSentFolder is returned by Send if the mail has been sent but can't be
+// saved to the sent folder (see SmtpConfig.SentFolder). Sending such a mail
+// again delivers it twice
+var ErrSentFolder = errors.New("wail: the mail has been sent but can't be saved to the sent folder")
+
+// ImapConfig contains information about the IMAP server
+// and the folder the sent mails are saved to
+type ImapConfig struct {
+	// Host represents the IMAP server address
+	Host string
+
+	// Port represents the IMAP server port
+	Port uint16
+
+	// EncryptType is an encryption type. EncryptSSL may be used on
+	// port 993, EncryptTLS calls the STARTTLS command (port 143)
+	EncryptType encryption
+
+	// TlsConfig is the TLS configuration used for TLS or SSL connections.
+	// DefaultTLSConfig is used if it's nil
+	TlsConfig *tls.Config
+
+	// Login and Password are the IMAP account credentials
+	Login    string
+	Password string
+
+	// Mailbox is a name of the sent folder, "Sent" by default.
+	// Only ASCII names are supported
+	Mailbox string
+
+	// Timeout limits the whole IMAP session. Zero value means no limit
+	Timeout time.Duration
+}
+
+// imapConn is a minimal IMAP4rev1 client (RFC 3501)
+// that is able to log in and append a message
+type imapConn struct {
+	conn net.Conn
+	text *textproto.Reader
+	tag  int
+}
+
+// appendSent saves the message to the sent folder with the \Seen flag
+func appendSent(cfg *ImapConfig, msg *message) error {
+	mailbox := cfg.Mailbox
+	if mailbox == "" {
+		mailbox = "Sent"
+	}
+
+	for _, s := range []string{cfg.Login, cfg.Password, mailbox} {
+		if strings.IndexFunc(s, func(r rune) bool { return r < ' ' || r > '~' }) >= 0 {
+			return errors.New("wail: IMAP credentials and mailbox must be printable ASCII")
+		}
+	}
+
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(int(cfg.Port)))
+
+	conn, err := net.DialTimeout("tcp", addr, cfg.Timeout)
+	if err != nil {
+		return err
+	}
+
+	defer func() { conn.Close() }()
+
+	if cfg.Timeout != 0 {
+		conn.SetDeadline(time.Now().Add(cfg.Timeout))
+	}
+
+	tlsConfig := DefaultTLSConfig()
+	if cfg.TlsConfig != nil {
+		tlsConfig = cfg.TlsConfig.Clone()
+	}
+
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = cfg.Host
+	}
+
+	if cfg.EncryptType == EncryptSSL {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	c := newImapConn(conn)
+
+	greeting, err := c.text.ReadLine()
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		return fmt.Errorf("wail: unexpected IMAP greeting %q", greeting)
+	}
+
+	if cfg.EncryptType == EncryptTLS {
+		if err := c.command("STARTTLS", nil); err != nil {
+			return err
+		}
+
+		conn = tls.Client(conn, tlsConfig)
+		c = newImapConn(conn)
+	}
+
+	if !strings.HasPrefix(greeting, "* PREAUTH") {
+		if err := c.command("LOGIN "+imapQuote(cfg.Login)+" "+imapQuote(cfg.Password), nil); err != nil {
+			return err
+		}
+	}
+
+	if err := c.command("APPEND "+imapQuote(mailbox)+` (\Seen)`, msg); err != nil {
+		return err
+	}
+
+	return c.command("LOGOUT", nil)
+}
+
+func newImapConn(conn net.Conn) *imapConn {
+	return &imapConn{
+		conn: conn,
+		text: textproto.NewReader(bufio.NewReader(conn)),
+	}
+}
+
+// command sends the tagged command and waits for its completion. If the
+// literal is not nil, it's sent once the server is ready to accept it
+func (c *imapConn) command(cmd string, literal *message) error {
+	c.tag++
+	tag := "a" + strconv.Itoa(c.tag)
+
+	if literal != nil {
+		cmd += " {" + strconv.FormatInt(literal.Len(), 10) + "}"
+	}
+
+	if _, err := io.WriteString(c.conn, tag+" "+cmd+"\r\n"); err != nil {
+		return err
+	}
+
+	for {
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case literal != nil && strings.HasPrefix(line, "+"):
+			w := bufio.NewWriter(c.conn)
+
+			if _, err := literal.WriteTo(w); err != nil {
+				return err
+			}
+
+			w.WriteString("\r\n")
+
+			if err := w.Flush(); err != nil {
+				return err
+			}
+
+			literal = nil
+		case strings.HasPrefix(line, tag+" "):
+			status := line[len(tag)+1:]
+			if len(status) >= 2 && strings.EqualFold(status[:2], "OK") {
+				return nil
+			}
+
+			name, _, _ := strings.Cut(cmd, " ")
+			return fmt.Errorf("wail: IMAP %s command failed: %s", name, status)
+		}
+	}
+}
+
+// imapQuote returns s as an IMAP quoted string
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,206 @@
+package wail
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testImapServer accepts IMAP sessions and records the commands and
+// the appended messages of each one. It rejects the APPEND if fail is set
+func testImapServer(t *testing.T, fail bool) (*ImapConfig, <-chan []string, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { ln.Close() })
+
+	cmds := make(chan []string, 8)
+	appended := make(chan string, 8)
+
+	session := func(conn net.Conn) {
+		defer conn.Close()
+
+		var got []string
+
+		defer func() { cmds <- got }()
+
+		r := textproto.NewReader(bufio.NewReader(conn))
+		w := textproto.NewWriter(bufio.NewWriter(conn))
+
+		w.PrintfLine("* OK IMAP4rev1 ready")
+
+		for {
+			line, err := r.ReadLine()
+			if err != nil {
+				return
+			}
+
+			tag, cmd, _ := strings.Cut(line, " ")
+			got = append(got, cmd)
+
+			switch name, _, _ := strings.Cut(cmd, " "); name {
+			case "APPEND":
+				if fail {
+					w.PrintfLine("%s NO [TRYCREATE] no such mailbox", tag)
+					continue
+				}
+
+				n, _ := strconv.Atoi(cmd[strings.LastIndex(cmd, "{")+1 : len(cmd)-1])
+
+				w.PrintfLine("+ ready")
+
+				buf := make([]byte, n+2)
+				if _, err := io.ReadFull(r.R, buf); err != nil {
+					return
+				}
+
+				appended <- string(buf[:n])
+				w.PrintfLine("%s OK APPEND completed", tag)
+			case "LOGOUT":
+				w.PrintfLine("* BYE")
+				w.PrintfLine("%s OK LOGOUT completed", tag)
+				return
+			default:
+				w.PrintfLine("%s OK done", tag)
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go session(conn)
+		}
+	}()
+
+	return &ImapConfig{
+		Host:        "127.0.0.1",
+		Port:        uint16(ln.Addr().(*net.TCPAddr).Port),
+		EncryptType: EncryptNone,
+		Login:       "sender@example.com",
+		Password:    `pa"ss`,
+		Timeout:     5 * time.Second,
+	}, cmds, appended
+}
+
+func TestSentFolder(t *testing.T) {
+	ts := newTestServer(t)
+
+	imap, cmds, appended := testImapServer(t, false)
+
+	cfg := ts.config()
+	cfg.SentFolder = imap
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if err := c.Send(testMail("rcpt@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		`LOGIN "sender@example.com" "pa\"ss"`,
+		`APPEND "Sent" (\Seen) {`,
+		"LOGOUT",
+	}
+
+	got := <-cmds
+	if len(got) != len(expect) {
+		t.Fatalf("Expect commands %q, got %q", expect, got)
+	}
+
+	for i := range expect {
+		if !strings.HasPrefix(got[i], expect[i]) {
+			t.Errorf("Expect command %q, got %q", expect[i], got[i])
+		}
+	}
+
+	msg := <-appended
+	sent := ts.received()[0].data
+
+	if strings.ReplaceAll(msg, "\r\n", "\n") != sent {
+		t.Errorf("The saved mail differs from the sent one:\n%s\n---\n%s", msg, sent)
+	}
+
+	// A mail sent in several transactions is saved once
+	c.cfg.SeparateBccDelivery = true
+
+	m := testMail("rcpt@example.com")
+	m.BlindCopyTo("bcc1@example.com", "bcc2@example.com")
+
+	if err := c.Send(m); err != nil {
+		t.Fatal(err)
+	}
+
+	groups := []RecipientGroup{{To: []string{"a@example.com"}}, {To: []string{"b@example.com"}}}
+	if err := c.SendGroups(testMail("rcpt@example.com"), groups); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SendBulk(testMail("rcpt@example.com"), []string{"a@example.com", "b@example.com"}, BulkConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := "Subject: Streamed\r\n\r\nHello\r\n"
+	if err := c.SendReader("sender@example.com", []string{"rcpt@example.com"}, strings.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(appended); n != 4 {
+		t.Fatalf("Expect 4 saved mails, got %d", n)
+	}
+
+	for i := 0; i < 3; i++ {
+		<-appended
+	}
+
+	if msg := <-appended; msg != raw {
+		t.Errorf("Invalid saved mail of SendReader, got %q", msg)
+	}
+}
+
+func TestSentFolderError(t *testing.T) {
+	ts := newTestServer(t)
+
+	imap, _, _ := testImapServer(t, true)
+
+	cfg := ts.config()
+	cfg.SentFolder = imap
+	cfg.SeparateBccDelivery = true
+
+	c := NewClient(cfg)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	m := testMail("rcpt@example.com")
+	m.BlindCopyTo("bcc1@example.com", "bcc2@example.com")
+
+	err := c.Send(m)
+	if !errors.Is(err, ErrSentFolder) {
+		t.Fatalf("Expect ErrSentFolder, got %v", err)
+	}
+
+	// The failure of the sent folder doesn't stop the delivery
+	if n := len(ts.received()); n != 3 {
+		t.Errorf("The mail should be delivered in 3 transactions, got %d", n)
+	}
+}
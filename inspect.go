@@ -0,0 +1,228 @@
+package wail
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+)
+
+// MessageInfo is a parsed view of the assembled message
+type MessageInfo struct {
+	// Header contains the decoded header fields of the message
+	Header mail.Header
+
+	// Parts contains the leaf parts of the message body.
+	// Multipart containers are not listed, only their content
+	Parts []PartInfo
+
+	// Size is a total size of the assembled message in bytes
+	Size int
+}
+
+// PartInfo describes a single part of the message body
+type PartInfo struct {
+	// ContentType is a media type of the part (e.g. text/plain)
+	ContentType string
+
+	// Encoding is a value of the Content-Transfer-Encoding field
+	Encoding string
+
+	// Size is a size of the decoded part content in bytes
+	Size int
+
+	// Filename is a name of the attached file (if any)
+	Filename string
+}
+
+// RenderMessage assembles the mail the same way Send does, but without
+// a server. Non-empty fields of cfg override the config of the mail, so
+// the same mail may be rendered with different settings. The author is
+// taken from the mail (see SetFrom) since there is no SMTP config.
+// The mail itself is not changed
+func RenderMessage(cfg MailConfig, m *Mail) ([]byte, error) {
+	if m == nil {
+		return nil, errors.New("wail: an empty mail object has been provided")
+	}
+
+	merged := mergeMailConfig(*m.cfg, cfg)
+
+	c := m.clone()
+	c.cfg = &merged
+
+	c.mb.err = nil
+	c.mb.setEncoding(merged.Charset, merged.Encoding)
+	merged.apply(c.mb)
+	c.reencode()
+
+	return c.mb.GetResultMessage(0)
+}
+
+// mergeMailConfig returns the base config with non-empty fields of cfg
+func mergeMailConfig(merged, cfg MailConfig) MailConfig {
+	if cfg.Charset != "" {
+		merged.Charset = cfg.Charset
+	}
+
+	if cfg.Encoding != "" {
+		merged.Encoding = cfg.Encoding
+	}
+
+	if cfg.Logger != nil {
+		merged.Logger = cfg.Logger
+	}
+
+	if cfg.Base64LineWidth != 0 {
+		merged.Base64LineWidth = cfg.Base64LineWidth
+	}
+
+	if cfg.QuotedPrintableLineWidth != 0 {
+		merged.QuotedPrintableLineWidth = cfg.QuotedPrintableLineWidth
+	}
+
+	if cfg.AddMessageID {
+		merged.AddMessageID = true
+	}
+
+	if cfg.MessageIDFunc != nil {
+		merged.MessageIDFunc = cfg.MessageIDFunc
+	}
+
+	if cfg.AttachmentTextThreshold != 0 {
+		merged.AttachmentTextThreshold = cfg.AttachmentTextThreshold
+	}
+
+	if cfg.BlockedExtensions != nil {
+		merged.BlockedExtensions = cfg.BlockedExtensions
+	}
+
+	if cfg.AllowedExtensions != nil {
+		merged.AllowedExtensions = cfg.AllowedExtensions
+	}
+
+	if cfg.MaxAttachmentSize != 0 {
+		merged.MaxAttachmentSize = cfg.MaxAttachmentSize
+	}
+
+	if cfg.FromName != FromNameAsIs {
+		merged.FromName = cfg.FromName
+	}
+
+	if cfg.MaxSubjectLength != 0 {
+		merged.MaxSubjectLength = cfg.MaxSubjectLength
+	}
+
+	if cfg.URLSafeTokenHeaders {
+		merged.URLSafeTokenHeaders = true
+	}
+
+	if cfg.Mailer != "" {
+		merged.Mailer = cfg.Mailer
+	}
+
+	return merged
+}
+
+// Inspect assembles the mail and returns its parsed representation.
+// It may be used to preview or validate the mail before sending it
+func (m *Mail) Inspect() (*MessageInfo, error) {
+	raw, err := m.mb.GetResultMessage(0)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	info := &MessageInfo{
+		Header: make(mail.Header, len(msg.Header)),
+		Size:   len(raw),
+	}
+
+	dec := new(mime.WordDecoder)
+
+	for k, values := range msg.Header {
+		for _, v := range values {
+			if d, err := dec.DecodeHeader(v); err == nil {
+				v = d
+			}
+
+			info.Header[k] = append(info.Header[k], v)
+		}
+	}
+
+	parts, err := inspectPart(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"),
+		msg.Header.Get("Content-Disposition"), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Parts = parts
+
+	return info, nil
+}
+
+func inspectPart(ctype, encoding, disposition string, body io.Reader) ([]PartInfo, error) {
+	if ctype == "" {
+		ctype = TextPlain.string()
+	}
+
+	mediaType, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		boundary, ok := params["boundary"]
+		if !ok {
+			return nil, errors.New("wail: multipart boundary is not specified")
+		}
+
+		var parts []PartInfo
+
+		r := multipart.NewReader(body, boundary)
+
+		for {
+			p, err := r.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			sub, err := inspectPart(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"),
+				p.Header.Get("Content-Disposition"), p)
+			if err != nil {
+				return nil, err
+			}
+
+			parts = append(parts, sub...)
+		}
+
+		return parts, nil
+	}
+
+	n, err := io.Copy(io.Discard, transferDecoder(body, encoding))
+	if err != nil {
+		return nil, err
+	}
+
+	part := PartInfo{
+		ContentType: mediaType,
+		Encoding:    encoding,
+		Size:        int(n),
+	}
+
+	if _, params, err := mime.ParseMediaType(disposition); err == nil {
+		part.Filename = params["filename"]
+	}
+
+	return []PartInfo{part}, nil
+}
@@ -2,7 +2,10 @@ package wail
 
 import (
 	"errors"
+	"fmt"
 	"net/mail"
+	"strings"
+	"time"
 )
 
 type encoding string
@@ -10,6 +13,18 @@ type encoding string
 const (
 	QuotedPrintable encoding = "quoted-printable"
 	Base64          encoding = "base64"
+
+	// SevenBit leaves the body as is. Use it only for
+	// plain US-ASCII text with lines shorter than 998 chars
+	SevenBit encoding = "7bit"
+
+	// Binary leaves the body as is without any restrictions. It's the most
+	// efficient way to send large binary attachments, but it requires the
+	// server to support the BINARYMIME and CHUNKING extensions
+	Binary encoding = "binary"
+
+	// eightBit is used only for attached messages that can't be encoded
+	eightBit encoding = "8bit"
 )
 
 type charset string
@@ -18,108 +33,567 @@ const (
 	UTF8       charset = "UTF-8"
 	ISO_8859_1 charset = "ISO-8859-1"
 	US_ASCII   charset = "US-ASCII"
+
+	// ISO_2022_JP is used by legacy Japanese mail clients
+	ISO_2022_JP charset = "ISO-2022-JP"
 )
 
 type recipients []string
 
+type fromNamePolicy int
+
+const (
+	// FromNameAsIs leaves the From field without a display name
+	// if it isn't provided. It's the default policy
+	FromNameAsIs fromNamePolicy = iota
+
+	// FromNameLocalPart uses the local part of the address
+	// (e.g. "alex" of alex@example.com) as the display name
+	FromNameLocalPart
+
+	// FromNameSender uses the sender name from the SMTP config
+	// or the local part of the address if it's empty too
+	FromNameSender
+)
+
+// MailConfig contains parameters of the message encoding.
+// Empty fields are filled in from DefaultMailConfig
 type MailConfig struct {
-	Charset  charset
+	// Charset is a charset of the text. Default is UTF-8
+	Charset charset
+
+	// Encoding is used to encode the message body. Default is base64
 	Encoding encoding
+
+	// Logger is used to report problems that don't prevent
+	// sending (e.g. an inline image that isn't referenced)
+	Logger Logger
+
+	// Base64LineWidth is a length of base64 encoded body lines. Some legacy
+	// gateways require 64. It must be a multiple of 4 not greater than 76,
+	// so base64 groups are never split. Default is 76
+	Base64LineWidth int
+
+	// QuotedPrintableLineWidth is a maximum length of quoted-printable encoded
+	// body lines including the soft line break. It must be from 4 to 76.
+	// Default is 76. Header fields are always folded at 76 chars
+	QuotedPrintableLineWidth int
+
+	// AddMessageID adds the Message-ID field to the mail. By default
+	// it's a random ID in the sender domain
+	AddMessageID bool
+
+	// MessageIDFunc generates a value of the Message-ID field, e.g. to embed
+	// a service identifier. Setting it adds the field as well. Angle brackets
+	// are added if it returns an ID without them. If it returns an empty
+	// string, the default ID is used
+	MessageIDFunc func() string
+
+	// AttachmentTextThreshold is a size in bytes below which an attachment
+	// of US-ASCII text is sent as 7bit (or quoted-printable if it has long
+	// lines or bare line breaks) instead of Encoding, since base64 inflates
+	// small attachments for nothing. Zero value disables it
+	AttachmentTextThreshold int
+
+	// BlockedExtensions are file extensions (e.g. ".exe" or ".tar.gz") of
+	// attachments that must not be sent. AllowedExtensions, if it's set,
+	// are the only extensions allowed. Extensions are case-insensitive.
+	// Send fails with ErrAttachmentBlocked if the mail violates them
+	BlockedExtensions []string
+	AllowedExtensions []string
+
+	// MaxAttachmentSize is a maximum size of an attachment in bytes. Send
+	// fails with ErrAttachmentTooLarge if it's exceeded. The attachments
+	// created by Mail.NewAttachment refuse to read more, so a huge file
+	// isn't read into memory. Zero value means no limit
+	MaxAttachmentSize int64
+
+	// FromName is a policy of the From display name when it isn't provided.
+	// Spam filters score a bare address worse. Default is FromNameAsIs
+	FromName fromNamePolicy
+
+	// MaxSubjectLength is a maximum number of characters in the subject.
+	// Send and SetSubjectChecked fail if it's exceeded. Zero value means no limit
+	MaxSubjectLength int
+
+	// URLSafeTokenHeaders makes SetTokenHeader encode the payloads with
+	// the URL-safe base64 alphabet without padding instead of the standard
+	// one. It doesn't affect the message body
+	URLSafeTokenHeaders bool
+
+	// Mailer is a value of the X-Mailer field added to the mail unless
+	// it sets its own one with SetHeader. Empty value means no field
+	Mailer string
+}
+
+// Logger reports warnings. *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, v ...any)
 }
 
 type Mail struct {
 	cfg *MailConfig
 	mb  *mimeBuilder
 
+	// from overrides the sender from the SMTP config if set
+	from *FromConfig
+
+	// nullReturnPath makes the envelope sender empty
+	nullReturnPath bool
+
+	// subject and msg are kept to encode them again with another encoding
+	subject *string
+	msg     Message
+
+	// tokens are the payloads of the token header fields
+	// kept to encode them again with another config
+	tokens []tokenField
+
+	// mtPriority is a priority of the mail transaction (RFC 6710)
+	mtPriority *int
+
 	recipients recipients
+
+	// bcc contains the blind copy recipients. They are also
+	// listed in recipients along with the others
+	bcc recipients
 }
  
+// DefaultMailConfig is used by NewMail when no config
+// is provided or some of the config fields are empty
 var DefaultMailConfig MailConfig = MailConfig{
 	Charset:  UTF8,
 	Encoding: Base64,
 }
 
+// NewMail creates a new email. The config could be nil, in that case
+// DefaultMailConfig is used. So NewMail(nil) and NewMail(&MailConfig{})
+// produce the same UTF-8 base64 encoded mail
 func NewMail(cfg *MailConfig) *Mail {
-	var m *Mail
+	c := DefaultMailConfig
 
 	if cfg != nil {
-		if cfg.Charset == "" {
-			cfg.Charset = UTF8		
-		}
-		
-		if cfg.Encoding == "" {
-			cfg.Encoding = QuotedPrintable	
+		if cfg.Charset != "" {
+			c.Charset = cfg.Charset
 		}
-		
-		m = &Mail{
-			cfg: &MailConfig{
-				Charset:  cfg.Charset,
-				Encoding: cfg.Encoding,
-			},
+
+		if cfg.Encoding != "" {
+			c.Encoding = cfg.Encoding
 		}
-	} else {
-		m = &Mail{cfg: &DefaultMailConfig}
+
+		c.Logger = cfg.Logger
+		c.Base64LineWidth = cfg.Base64LineWidth
+		c.QuotedPrintableLineWidth = cfg.QuotedPrintableLineWidth
+		c.AddMessageID = cfg.AddMessageID
+		c.MessageIDFunc = cfg.MessageIDFunc
+		c.AttachmentTextThreshold = cfg.AttachmentTextThreshold
+		c.BlockedExtensions = cfg.BlockedExtensions
+		c.AllowedExtensions = cfg.AllowedExtensions
+		c.MaxAttachmentSize = cfg.MaxAttachmentSize
+		c.FromName = cfg.FromName
+		c.MaxSubjectLength = cfg.MaxSubjectLength
+		c.URLSafeTokenHeaders = cfg.URLSafeTokenHeaders
+		c.Mailer = cfg.Mailer
 	}
 
+	m := &Mail{cfg: &c}
+
 	m.mb = newMimeBuilder(m.cfg.Charset, m.cfg.Encoding)
+	m.cfg.apply(m.mb)
+
 	m.recipients = make(recipients, 0, 10)
 
 	return m
 }
 
-// SetSubject sets an email subject. Subject could be empty
+// apply passes the config to the builder. An invalid
+// config is reported when the message is assembled
+func (c *MailConfig) apply(mb *mimeBuilder) {
+	mb.logger = c.Logger
+	mb.addMessageID = c.AddMessageID || c.MessageIDFunc != nil
+	mb.messageID = c.MessageIDFunc
+	mb.attachmentThreshold = c.AttachmentTextThreshold
+	mb.blockedExts = normalizeExtensions(c.BlockedExtensions)
+	mb.allowedExts = normalizeExtensions(c.AllowedExtensions)
+	mb.maxAttachmentSize = c.MaxAttachmentSize
+	mb.fromName = c.FromName
+	mb.maxSubjectLen = c.MaxSubjectLength
+	mb.urlSafeTokens = c.URLSafeTokenHeaders
+	mb.mailer = c.Mailer
+	mb.base64Width, mb.qpWidth = lineLengthLimit, lineLengthLimit
+
+	if w := c.Base64LineWidth; w != 0 {
+		if w < 0 || w > lineLengthLimit || w%4 != 0 {
+			mb.err = fmt.Errorf("wail: invalid base64 line width %d, it must be a multiple of 4 not greater than %d", w, lineLengthLimit)
+		} else {
+			mb.base64Width = w
+		}
+	}
+
+	if c.MaxSubjectLength < 0 {
+		mb.err = fmt.Errorf("wail: invalid max subject length %d", c.MaxSubjectLength)
+	}
+
+	if w := c.QuotedPrintableLineWidth; w != 0 {
+		if w < 4 || w > lineLengthLimit {
+			mb.err = fmt.Errorf("wail: invalid quoted-printable line width %d, it must be from 4 to %d", w, lineLengthLimit)
+		} else {
+			mb.qpWidth = w
+		}
+	}
+}
+
+// clone returns a copy of the mail that can be changed
+// without affecting the original one
+func (m *Mail) clone() *Mail {
+	c := &Mail{
+		cfg:            m.cfg,
+		mb:             m.mb.clone(),
+		from:           m.from,
+		nullReturnPath: m.nullReturnPath,
+		mtPriority:     m.mtPriority,
+		subject:        m.subject,
+		msg:            m.msg,
+		tokens:         append([]tokenField(nil), m.tokens...),
+	}
+
+	c.recipients = make(recipients, len(m.recipients))
+	copy(c.recipients, m.recipients)
+
+	c.bcc = make(recipients, len(m.bcc))
+	copy(c.bcc, m.bcc)
+
+	return c
+}
+
+// resetRecipients removes all recipients and the corresponding header fields
+func (m *Mail) resetRecipients() {
+	m.recipients = m.recipients[:0]
+	m.bcc = m.bcc[:0]
+
+	delete(m.mb.header, "to")
+	delete(m.mb.header, "cc")
+	delete(m.mb.header, "bcc")
+}
+
+// SetSubject sets an email subject. Subject could be empty. A subject
+// longer than MailConfig.MaxSubjectLength makes Send fail
 func (m *Mail) SetSubject(subj string) {
-	m.mb.SetFieldSubject(subj)
+	if err := m.SetSubjectChecked(subj); err != nil {
+		m.mb.subjectErr = err
+	}
+}
+
+// SetSubjectChecked is like SetSubject, but it fails at once if the
+// subject is longer than MailConfig.MaxSubjectLength. The previous
+// subject is kept then
+func (m *Mail) SetSubjectChecked(subj string) error {
+	if err := m.mb.SetFieldSubject(subj); err != nil {
+		return err
+	}
+
+	m.subject = &subj
+	m.mb.subjectErr = nil
+
+	return nil
+}
+
+// WithEncoding returns a copy of the mail that uses the charset and the
+// encoding instead of the ones from the config. The subject, the author
+// and the message are encoded again. The mail itself is not changed, so
+// one mail may be sent with different encodings
+func (m *Mail) WithEncoding(cs charset, enc encoding) *Mail {
+	c := m.clone()
+
+	cfg := *m.cfg
+	cfg.Charset, cfg.Encoding = cs, enc
+	c.cfg = &cfg
+
+	c.mb.setEncoding(cs, enc)
+	c.reencode()
+
+	return c
+}
+
+// reencode encodes the subject, the author and the message again
+// after the encoding or the config of the builder has been changed
+func (m *Mail) reencode() {
+	if m.subject != nil {
+		if err := m.mb.SetFieldSubject(*m.subject); err != nil {
+			m.mb.subjectErr = err
+		}
+	}
+
+	if m.from != nil {
+		m.mb.SetFieldFrom(m.from.Name, m.from.Address)
+	}
+
+	if m.msg != nil {
+		m.mb.SetMessage(m.msg)
+	}
+
+	for _, t := range m.tokens {
+		m.mb.SetField(t.name, m.mb.encodeToken(t.payload))
+	}
+}
+
+// SetBoundary sets the boundary of the top-level multipart message instead
+// of a random one, e.g. to reproduce an issue or to get a deterministic
+// output. The boundary must be 1 to 70 chars allowed by RFC 2046 5.1.1.
+// An empty boundary restores the random one
+func (m *Mail) SetBoundary(boundary string) error {
+	if !validBoundary(boundary) {
+		return fmt.Errorf("wail: invalid boundary %q", boundary)
+	}
+
+	m.mb.boundary = boundary
+
+	if m.msg != nil {
+		m.mb.SetMessage(m.msg)
+	}
+
+	return nil
+}
+
+// validBoundary reports whether the boundary consists of bchars
+// and doesn't end with a space (RFC 2046 5.1.1)
+func validBoundary(b string) bool {
+	if b == "" {
+		return true
+	}
+
+	if len(b) > 70 || strings.HasSuffix(b, " ") {
+		return false
+	}
+
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			continue
+		}
+
+		if !strings.ContainsRune("'()+_,-./:=? ", rune(c)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SetDate sets a value of the Date field. By default the Date field is
+// filled in when the message is assembled, which happens on every Send.
+// Set the date explicitly if the mail is sent later than it's been
+// created and the Date should reflect a specific moment
+func (m *Mail) SetDate(date time.Time) {
+	m.mb.SetFieldDate(date)
+}
+
+// OmitDate makes the mail be assembled without the Date field. Use it when
+// the Date is set by an upstream system (e.g. when forwarding a message).
+// Note that RFC 5322 requires the Date field, so someone has to add it
+func (m *Mail) OmitDate(omit bool) {
+	m.mb.omitDate = omit
+}
+
+// FromConfig describes who the email is from
+type FromConfig struct {
+	// Name is a display name shown in the From field
+	Name string
+
+	// Address is an email address shown in the From field
+	Address string
+
+	// Envelope is an address used in the MAIL FROM command, so bounces are
+	// sent to it. If it's empty, the sender login from the SMTP config is used.
+	// If it differs from Address, the Sender field is added to the email
+	Envelope string
+}
+
+// SetNullReturnPath makes the mail be sent with the null envelope sender
+// (MAIL FROM:<>), so no bounce is ever sent back. Use it only for bounces,
+// DSNs and other automatic replies to prevent mail loops (RFC 5321 4.5.5).
+// The From field is not affected
+func (m *Mail) SetNullReturnPath() {
+	m.nullReturnPath = true
+}
+
+// SetFrom sets the author of the email. If it isn't set,
+// the sender from the SMTP config is used instead
+func (m *Mail) SetFrom(name, addr string) error {
+	return m.SetFromConfig(FromConfig{Name: name, Address: addr})
+}
+
+// SetFromFull sets the author of the email from the combined form, e.g.
+// "Alex <alex@example.com>". The display name may be left unquoted even
+// if it contains specials like "Doe, John <john@example.com>"
+func (m *Mail) SetFromFull(s string) error {
+	addr, err := mail.ParseAddress(s)
+	if err != nil {
+		// Take everything before the angle address as the name
+		name, rest, ok := strings.Cut(strings.TrimSpace(s), "<")
+		if !ok || !strings.HasSuffix(rest, ">") {
+			return fmt.Errorf("wail: invalid From address (%w)", err)
+		}
+
+		if addr, err = mail.ParseAddress("<" + rest); err != nil {
+			return fmt.Errorf("wail: invalid From address (%w)", err)
+		}
+
+		addr.Name = strings.TrimSpace(name)
+	}
+
+	return m.SetFrom(addr.Name, addr.Address)
 }
 
-func (m *Mail) validateAndAppendEmails(emails []string) error {
+// SetFromConfig sets the author of the email, the address
+// shown to the recipients and the envelope address at once
+func (m *Mail) SetFromConfig(from FromConfig) error {
+	if _, err := mail.ParseAddress(from.Address); err != nil {
+		return err
+	}
+
+	if from.Envelope != "" {
+		if _, err := mail.ParseAddress(from.Envelope); err != nil {
+			return err
+		}
+	}
+
+	m.from = &from
+	m.mb.SetFieldFrom(from.Name, from.Address)
+
+	return nil
+}
+
+// SetMTPriority sets a priority of the mail transaction from -9 (the lowest)
+// to 9 (the highest). Servers supporting the MT-PRIORITY extension (RFC 6710)
+// deliver mails with higher priority first. The priority is ignored if the
+// server doesn't support the extension.
+//
+// Note: unlike the X-Priority field, which only helps the recipient's client
+// to display the mail, it affects the order in which the server delivers mails
+func (m *Mail) SetMTPriority(priority int) error {
+	if priority < -9 || priority > 9 {
+		return errors.New("wail: priority must be in range from -9 to 9")
+	}
+
+	m.mtPriority = &priority
+	return nil
+}
+
+// validateAndAppendEmails parses the addresses, optionally with display
+// names (e.g. "Doe, John" <john@example.com>), and appends them to
+// the envelope recipients
+func (m *Mail) validateAndAppendEmails(emails []string) ([]*mail.Address, error) {
 	if len(emails) == 0 {
-		return errors.New("wail: an empty email address list has been provided")
+		return nil, errors.New("wail: an empty email address list has been provided")
 	}
 
+	addrs := make([]*mail.Address, 0, len(emails))
+
 	for _, email := range emails {
 		if len(email) > 254 {
-			return errors.New("wail: length of the email address must be less than 254 chars")
-		} else if _, err := mail.ParseAddress(email); err != nil {
-			return err
+			return nil, errors.New("wail: length of the email address must be less than 254 chars")
 		}
+
+		a, err := mail.ParseAddress(email)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs = append(addrs, a)
 	}
 
-	m.recipients = append(m.recipients, emails...)
-	return nil
+	for _, a := range addrs {
+		m.recipients = append(m.recipients, a.Address)
+	}
+
+	return addrs, nil
 }
 
-// To sets main email addresses to which an email will be sent
+// To sets main email addresses to which an email will be sent.
+// An address may contain a display name, e.g. "Doe, John" <john@example.com>
 func (m *Mail) To(emails ...string) error {
-	if err := m.validateAndAppendEmails(emails); err != nil {
+	addrs, err := m.validateAndAppendEmails(emails)
+	if err != nil {
 		return err
 	}
 
-	m.mb.SetFieldTo(emails...)
+	m.mb.SetFieldTo(addrs...)
 	return nil
 }
 
-// CopyTo sets email addresses to which an email copy will be sent
+// ToString sets main email addresses parsed from a comma-separated list
+// (e.g. a form field value). Display names may be quoted and contain commas,
+// e.g. "Doe, John" <john@example.com>. Empty items are skipped
+func (m *Mail) ToString(list string) error {
+	addrs, err := mail.ParseAddressList(list)
+	if err != nil {
+		return fmt.Errorf("wail: invalid address list (%w)", err)
+	}
+
+	emails := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		emails = append(emails, a.String())
+	}
+
+	return m.To(emails...)
+}
+
+// CopyTo sets email addresses to which an email copy will be sent.
+// An address may contain a display name like in To
 func (m *Mail) CopyTo(emails ...string) error {
-	if err := m.validateAndAppendEmails(emails); err != nil {
+	addrs, err := m.validateAndAppendEmails(emails)
+	if err != nil {
 		return err
 	}
 
-	m.mb.SetFieldCc(emails...)
+	m.mb.SetFieldCc(addrs...)
 	return nil
 }
 
 // BlindCopyTo sets email addresses to which an email blind copy will be sent
 func (m *Mail) BlindCopyTo(emails ...string) error {
-	if err := m.validateAndAppendEmails(emails); err != nil {
+	addrs, err := m.validateAndAppendEmails(emails)
+	if err != nil {
 		return err
 	}
 
-	m.mb.SetFieldBcc(emails...)
+	for _, a := range addrs {
+		m.bcc = append(m.bcc, a.Address)
+	}
+
+	m.mb.SetFieldBcc(addrs...)
 	return nil
 }
 
+// Recipients returns all the envelope recipients (To, Cc and Bcc)
+// in order they were added. The returned slice is a copy
+func (m *Mail) Recipients() []string {
+	return append([]string(nil), m.recipients...)
+}
+
 // SetMessage sets an email message
 func (m *Mail) SetMessage(msg Message) {
+	m.msg = msg
 	m.mb.SetMessage(msg)
 }
+
+// SetTextAndHTML sets a multipart/alternative message with plain text and
+// html parts. The parts are ordered as RFC 2046 requires: plain text first
+// and html last, so clients that can display html prefer it
+func (m *Mail) SetTextAndHTML(text, html []byte) {
+	mt := NewMultipartAltMessage()
+
+	mt.SetPlainText(text, 0)
+	mt.SetHtmlText(html, 1)
+
+	m.SetMessage(&mt)
+}
+
+// SetHTML sets a multipart/alternative message with the html and
+// a plain text generated from it (see HTMLToText). Spam filters
+// penalize html messages that don't have a plain text part
+func (m *Mail) SetHTML(html []byte) {
+	m.SetTextAndHTML(HTMLToText(html), html)
+}
@@ -1,6 +1,16 @@
 package wail
 
-import "testing"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	netmail "net/mail"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
 
 var m = NewMail(nil)
 
@@ -46,3 +56,613 @@ func TestCopyTo(t *testing.T) {
 func TestBlindCopyTo(t *testing.T) {
 	univEmailAddressesTest(m.BlindCopyTo, t)
 }
+
+func TestInspect(t *testing.T) {
+	mail := NewMail(nil)
+	mail.SetSubject("Отчёт")
+	mail.To("example1@example.com")
+
+	mt := NewMultipartMixedMessage()
+	mt.SetText(TextPlain, []byte("Hello, World"))
+
+	a := NewAttachment()
+	a.SetAsBinary("report.csv", []byte("id,name\r\n1,Alex\r\n"))
+
+	mt.AddAttachment(a)
+	mail.SetMessage(&mt)
+
+	info, err := mail.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subj := info.Header.Get("Subject"); subj != "Отчёт" {
+		t.Errorf("Invalid subject, expect %s, got %s", "Отчёт", subj)
+	}
+
+	if to := info.Header.Get("To"); to != "<example1@example.com>" {
+		t.Errorf("Invalid To field, expect %s, got %s", "<example1@example.com>", to)
+	}
+
+	expect := []PartInfo{
+		{ContentType: "text/plain", Encoding: "base64", Size: 12},
+		{ContentType: "application/octet-stream", Encoding: "base64", Size: 17, Filename: "report.csv"},
+	}
+
+	if len(info.Parts) != len(expect) {
+		t.Fatalf("Expect %d parts, got %d", len(expect), len(info.Parts))
+	}
+
+	for i, p := range expect {
+		if info.Parts[i] != p {
+			t.Errorf("Invalid part %d, expect %+v, got %+v", i, p, info.Parts[i])
+		}
+	}
+
+	if info.Size == 0 {
+		t.Error("The total size should be calculated")
+	}
+}
+
+func TestSetDate(t *testing.T) {
+	mail := NewMail(nil)
+	mail.To("example1@example.com")
+
+	info, err := mail.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	date, err := info.Header.Date()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(date) > time.Minute {
+		t.Errorf("The date should be taken at assembly time, got %v", date)
+	}
+
+	scheduled := time.Date(2030, time.January, 2, 15, 4, 5, 0, time.UTC)
+	mail.SetDate(scheduled)
+
+	if info, _ = mail.Inspect(); info.Header.Get("Date") != scheduled.Format(time.RFC1123Z) {
+		t.Errorf("Invalid date, expect %s, got %s", scheduled.Format(time.RFC1123Z), info.Header.Get("Date"))
+	}
+}
+
+func TestOmitDate(t *testing.T) {
+	mail := NewMail(nil)
+	mail.To("example1@example.com")
+	mail.OmitDate(true)
+
+	info, err := mail.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := info.Header["Date"]; ok {
+		t.Errorf("The Date field should be omitted, got %s", info.Header.Get("Date"))
+	}
+
+	if err := mail.SetHeader("Date", "Mon, 02 Jan 2006 15:04:05 +0000"); err == nil {
+		t.Error("The Date field should be set with SetDate only")
+	}
+
+	mail.OmitDate(false)
+	mail.SetDate(time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC))
+
+	if info, _ = mail.Inspect(); len(info.Header["Date"]) != 1 || info.Header.Get("Date") != "Mon, 02 Jan 2006 15:04:05 +0000" {
+		t.Errorf("The Date set with SetDate should be used, got %q", info.Header["Date"])
+	}
+}
+
+func TestSetTextAndHTML(t *testing.T) {
+	mail := NewMail(nil)
+	mail.To("example1@example.com")
+	mail.SetTextAndHTML([]byte("Hello, World"), []byte("<b>Hello, World</b>"))
+
+	info, err := mail.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := info.Header.Get("Content-Type"); !strings.HasPrefix(ct, "multipart/alternative;") {
+		t.Errorf("Invalid content type, expect multipart/alternative, got %s", ct)
+	}
+
+	if len(info.Parts) != 2 || info.Parts[0].ContentType != "text/plain" || info.Parts[1].ContentType != "text/html" {
+		t.Errorf("Expect text/plain followed by text/html, got %+v", info.Parts)
+	}
+}
+
+func TestNewMailDefaults(t *testing.T) {
+	configs := []*MailConfig{nil, {}, {Charset: UTF8}}
+
+	for _, cfg := range configs {
+		m := NewMail(cfg)
+
+		if !reflect.DeepEqual(*m.cfg, DefaultMailConfig) || m.mb.encoding != DefaultMailConfig.Encoding {
+			t.Errorf("Expect the default config for %+v, got %+v", cfg, *m.cfg)
+		}
+	}
+
+	m := NewMail(&MailConfig{Encoding: QuotedPrintable})
+
+	if m.cfg.Charset != UTF8 || m.cfg.Encoding != QuotedPrintable {
+		t.Errorf("Only empty fields should be filled in with defaults, got %+v", *m.cfg)
+	}
+
+	if DefaultMailConfig.Encoding != Base64 {
+		t.Error("NewMail should not change the default config")
+	}
+}
+
+func TestToString(t *testing.T) {
+	mail := NewMail(nil)
+
+	if err := mail.ToString(` a@example.com ,, "Doe, John" <john@example.com>,  c@example.com , `); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{"a@example.com", "john@example.com", "c@example.com"}
+
+	if strings.Join(mail.recipients, " ") != strings.Join(expect, " ") {
+		t.Errorf("Invalid recipients, expect %v, got %v", expect, mail.recipients)
+	}
+
+	if err := mail.ToString("a@example.com, not an address"); err == nil {
+		t.Error("An invalid address should be rejected")
+	}
+
+	if err := mail.ToString(" , "); err == nil {
+		t.Error("An empty list should be rejected")
+	}
+}
+
+func TestNamedRecipients(t *testing.T) {
+	for _, enc := range []encoding{Base64, QuotedPrintable} {
+		mail := NewMail(&MailConfig{Encoding: enc})
+
+		if err := mail.To(`"Müller, Hans" <hans@example.com>`, "a@example.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mail.CopyTo("Doe, John <john@example.com>"); err == nil {
+			t.Error("An unquoted display name with a comma should be rejected")
+		}
+
+		if err := mail.CopyTo(`"Doe, John" <john@example.com>`); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := []string{"hans@example.com", "a@example.com", "john@example.com"}
+
+		if strings.Join(mail.recipients, " ") != strings.Join(expect, " ") {
+			t.Errorf("Envelope recipients should be bare addresses, expect %v, got %v", expect, mail.recipients)
+		}
+
+		// A non-ASCII name with specials must be B encoded, since
+		// Q encoding leaves the comma as is
+		if to := mail.mb.header["to"]; to != "=?UTF-8?b?TcO8bGxlciwgSGFucw==?= <hans@example.com>, <a@example.com>" {
+			t.Errorf("Invalid To field with %s encoding, got %q", enc, to)
+		}
+
+		if cc := mail.mb.header["cc"]; cc != `"Doe, John" <john@example.com>` {
+			t.Errorf("Invalid Cc field with %s encoding, got %q", enc, cc)
+		}
+
+		list, err := netmail.ParseAddressList(mail.mb.header["to"])
+		if err != nil || len(list) != 2 || list[0].Name != "Müller, Hans" || list[0].Address != "hans@example.com" {
+			t.Errorf("The To field should be parsed back, got %v (%v)", list, err)
+		}
+	}
+}
+
+func TestMessageID(t *testing.T) {
+	mail := NewMail(nil)
+	mail.To("example1@example.com")
+
+	info, err := mail.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id := info.Header.Get("Message-ID"); id != "" {
+		t.Errorf("Message-ID should be added only on request, got %q", id)
+	}
+
+	mail = NewMail(&MailConfig{AddMessageID: true})
+	mail.To("example1@example.com")
+	mail.mb.SetFieldFrom("", "sender@example.org")
+
+	if info, err = mail.Inspect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if id := info.Header.Get("Message-ID"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.org>") {
+		t.Errorf("Invalid default Message-ID %q", id)
+	}
+
+	n := 0
+
+	mail = NewMail(&MailConfig{MessageIDFunc: func() string {
+		n++
+		return fmt.Sprintf("%d.eu-west-1@mailer.example.com", n)
+	}})
+	mail.To("example1@example.com")
+
+	for _, expect := range []string{"<1.eu-west-1@mailer.example.com>", "<2.eu-west-1@mailer.example.com>"} {
+		if info, _ = mail.Inspect(); info.Header.Get("Message-ID") != expect {
+			t.Errorf("Invalid Message-ID, expect %s, got %s", expect, info.Header.Get("Message-ID"))
+		}
+	}
+}
+
+func TestSetFromFull(t *testing.T) {
+	mail := NewMail(nil)
+	mail.To("example1@example.com")
+
+	for _, s := range []string{"Doe, John <john@x.com>", `"Doe, John" <john@x.com>`} {
+		if err := mail.SetFromFull(s); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := mail.Inspect()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if from := info.Header.Get("From"); from != `"Doe, John" <john@x.com>` {
+			t.Errorf("Invalid From field, expect %s, got %s", `"Doe, John" <john@x.com>`, from)
+		}
+
+		if addr, err := info.Header.AddressList("From"); err != nil || addr[0].Name != "Doe, John" || addr[0].Address != "john@x.com" {
+			t.Errorf("The From field should be parsed back, got %v (%v)", addr, err)
+		}
+	}
+
+	for _, s := range []string{"", "Alex", "Alex <>"} {
+		if err := mail.SetFromFull(s); err == nil {
+			t.Errorf("%q should be rejected", s)
+		}
+	}
+}
+
+func TestUndisclosedRecipients(t *testing.T) {
+	mail := NewMail(nil)
+
+	if _, err := mail.Inspect(); err == nil {
+		t.Error("A mail without recipients should be rejected")
+	}
+
+	if err := mail.CopyTo("example1@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := mail.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if to := info.Header.Get("To"); to != "undisclosed-recipients:;" {
+		t.Errorf("Invalid To field, expect %s, got %s", "undisclosed-recipients:;", to)
+	}
+
+	if cc := info.Header.Get("Cc"); cc != "<example1@example.com>" {
+		t.Errorf("Invalid Cc field, expect %s, got %s", "<example1@example.com>", cc)
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	mail := NewMail(nil)
+	mail.To("to@example.com")
+	mail.CopyTo("cc@example.com")
+	mail.BlindCopyTo("bcc@example.com")
+
+	rcpts := mail.Recipients()
+
+	if strings.Join(rcpts, " ") != "to@example.com cc@example.com bcc@example.com" {
+		t.Errorf("Invalid recipients, got %v", rcpts)
+	}
+
+	rcpts[0] = "changed@example.com"
+
+	if mail.Recipients()[0] != "to@example.com" {
+		t.Error("Recipients should return a copy")
+	}
+}
+
+func TestWithEncoding(t *testing.T) {
+	base := NewMail(nil)
+	base.To("example1@example.com")
+	base.SetSubject("Alert")
+	base.SetMessage(PlainText("Disk is full"))
+
+	alert := base.WithEncoding(US_ASCII, SevenBit)
+	news := base.WithEncoding(UTF8, QuotedPrintable)
+
+	tests := []struct {
+		mail     *Mail
+		ctype    string
+		encoding string
+	}{
+		{base, "text/plain; charset=UTF-8", "base64"},
+		{alert, "text/plain; charset=US-ASCII", "7bit"},
+		{news, "text/plain; charset=UTF-8", "quoted-printable"},
+	}
+
+	for _, tt := range tests {
+		info, err := tt.mail.Inspect()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ct := info.Header.Get("Content-Type"); ct != tt.ctype {
+			t.Errorf("Invalid content type, expect %s, got %s", tt.ctype, ct)
+		}
+
+		if len(info.Parts) != 1 || info.Parts[0].Encoding != tt.encoding {
+			t.Errorf("Invalid encoding, expect %s, got %+v", tt.encoding, info.Parts)
+		}
+
+		if subj := info.Header.Get("Subject"); subj != "Alert" {
+			t.Errorf("Invalid subject, expect %s, got %s", "Alert", subj)
+		}
+	}
+}
+
+func TestRenderMessage(t *testing.T) {
+	mail := NewMail(nil)
+	mail.To("example1@example.com")
+	mail.SetFrom("Alex", "alex@example.com")
+	mail.SetSubject("Report")
+	mail.SetMessage(PlainText("Hello, World"))
+	mail.OmitDate(true)
+
+	raw, err := RenderMessage(MailConfig{
+		Encoding:      QuotedPrintable,
+		MessageIDFunc: func() string { return "golden@example.com" },
+	}, mail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "Subject:Report\r\n" +
+		"From:Alex <alex@example.com>\r\n" +
+		"To:<example1@example.com>\r\n" +
+		"Message-ID: <golden@example.com>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Hello, World"
+
+	if !strings.HasPrefix(string(raw), expect) {
+		t.Errorf("Invalid rendered message, expect\n%q\ngot\n%q", expect, raw)
+	}
+
+	info, err := mail.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Parts[0].Encoding != "base64" {
+		t.Errorf("The mail itself should not be changed, got %s encoding", info.Parts[0].Encoding)
+	}
+
+	if _, err := RenderMessage(MailConfig{Base64LineWidth: 70}, mail); err == nil {
+		t.Error("An invalid config should be rejected")
+	}
+
+	if _, err := RenderMessage(MailConfig{}, nil); err == nil {
+		t.Error("An empty mail should be rejected")
+	}
+}
+
+func TestRenderMessageConfig(t *testing.T) {
+	mail := NewMail(nil)
+	mail.To("example1@example.com")
+	mail.SetFrom("Alex", "alex@example.com")
+	mail.SetSubject("Report")
+
+	mt := NewMultipartMixedMessage()
+
+	a := NewAttachment()
+	a.SetAsBinary("file.bin", []byte{1, 2, 3})
+	mt.AddAttachment(a)
+
+	mail.SetMessage(&mt)
+
+	raw, err := RenderMessage(MailConfig{AddMessageID: true}, mail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id := headerValue(string(raw), "Message-ID"); !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("AddMessageID should add the Message-ID field, got %q", id)
+	}
+
+	raw, err = RenderMessage(MailConfig{Mailer: "Reports 1.0"}, mail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mailer := headerValue(string(raw), "X-Mailer"); mailer != "Reports 1.0" {
+		t.Errorf("Invalid X-Mailer field, expect %s, got %s", "Reports 1.0", mailer)
+	}
+
+	if _, err := RenderMessage(MailConfig{MaxAttachmentSize: 2}, mail); !errors.Is(err, ErrAttachmentTooLarge) {
+		t.Errorf("Expect ErrAttachmentTooLarge, got %v", err)
+	}
+
+	if _, err := mail.Inspect(); err != nil {
+		t.Errorf("The mail itself should not be changed, got %v", err)
+	}
+}
+
+func TestMergeMailConfig(t *testing.T) {
+	typ := reflect.TypeOf(MailConfig{})
+
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+
+		var cfg MailConfig
+		v := reflect.ValueOf(&cfg).Elem().Field(i)
+
+		switch f.Type.Kind() {
+		case reflect.Bool:
+			v.SetBool(true)
+		case reflect.Int, reflect.Int64:
+			v.SetInt(12)
+		case reflect.String:
+			v.SetString("x")
+		case reflect.Slice:
+			v.Set(reflect.Append(reflect.MakeSlice(f.Type, 0, 1), reflect.ValueOf("x")))
+		case reflect.Func:
+			v.Set(reflect.MakeFunc(f.Type, func([]reflect.Value) []reflect.Value {
+				return []reflect.Value{reflect.ValueOf("x")}
+			}))
+		case reflect.Interface:
+			v.Set(reflect.ValueOf(log.New(io.Discard, "", 0)))
+		default:
+			t.Fatalf("Unsupported type %s of the %s field", f.Type, f.Name)
+		}
+
+		merged := reflect.ValueOf(mergeMailConfig(MailConfig{}, cfg)).Field(i)
+
+		if f.Type.Kind() == reflect.Func {
+			if merged.IsNil() {
+				t.Errorf("The %s field should be merged", f.Name)
+			}
+
+			continue
+		}
+
+		if !reflect.DeepEqual(merged.Interface(), v.Interface()) {
+			t.Errorf("The %s field should be merged", f.Name)
+		}
+	}
+}
+
+func TestSubjectLength(t *testing.T) {
+	subjects := []string{
+		strings.TrimSpace(strings.Repeat("Очень длинная тема письма ", 40)),
+		strings.TrimSpace(strings.Repeat("A very  long subject ", 40)),
+	}
+
+	for _, subj := range subjects {
+		mail := NewMail(nil)
+		mail.To("example1@example.com")
+
+		if err := mail.SetSubjectChecked(subj); err != nil {
+			t.Fatal(err)
+		}
+
+		field := "Subject:" + mail.mb.header["subject"]
+
+		for i, l := range strings.Split(field, "\r\n") {
+			if len(l) > lineLengthLimit {
+				t.Errorf("Line %d of the subject is too long: %q", i, l)
+			}
+
+			if i != 0 && !strings.HasPrefix(l, " ") {
+				t.Errorf("Line %d of the subject isn't folded: %q", i, l)
+			}
+		}
+
+		info, err := mail.Inspect()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s := info.Header.Get("Subject"); s != subj {
+			t.Errorf("The subject is corrupted, expect %q, got %q", subj, s)
+		}
+	}
+
+	mail := NewMail(&MailConfig{MaxSubjectLength: 10})
+
+	mail.To("example1@example.com")
+
+	if err := mail.SetSubjectChecked("Отчёт 2024"); err != nil {
+		t.Errorf("A subject of 10 chars should be allowed, got %v", err)
+	}
+
+	if err := mail.SetSubjectChecked("Отчёт 2024!"); err == nil {
+		t.Error("A subject of 11 chars should be rejected")
+	}
+
+	if info, _ := mail.Inspect(); info == nil || info.Header.Get("Subject") != "Отчёт 2024" {
+		t.Errorf("A rejected subject should not replace the previous one, got %+v", info)
+	}
+
+	// SetSubject reports the long subject when the mail is assembled
+	mail.SetSubject("Отчёт 2024!")
+
+	if _, err := mail.Inspect(); err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Errorf("A mail with a long subject should be rejected, got %v", err)
+	}
+
+	mail.SetSubject("Отчёт")
+
+	if _, err := mail.Inspect(); err != nil {
+		t.Errorf("A valid subject should replace the rejected one, got %v", err)
+	}
+}
+
+func TestSetBoundary(t *testing.T) {
+	mail := NewMail(nil)
+	mail.To("example1@example.com")
+
+	for _, b := range []string{"a\"b", "ends with space ", strings.Repeat("b", 71), "тест"} {
+		if err := mail.SetBoundary(b); err == nil {
+			t.Errorf("The boundary %q should be rejected", b)
+		}
+	}
+
+	alt := NewMultipartAltMessage()
+	alt.SetPlainText([]byte("Hello"), 0)
+	alt.SetHtmlText([]byte("<p>Hello</p>"), 1)
+
+	mt := NewMultipartMixedMessage()
+	mt.SetAlternative(alt)
+
+	a := NewAttachment()
+	a.SetAsBinary("file.bin", []byte{1, 2, 3})
+	mt.AddAttachment(a)
+
+	mail.SetMessage(&mt)
+
+	if err := mail.SetBoundary("wail test:boundary"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := mail.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := info.Header.Get("Content-Type"); ct != `multipart/mixed; boundary="wail test:boundary"` {
+		t.Errorf("Invalid content type %q", ct)
+	}
+
+	if len(info.Parts) != 3 {
+		t.Errorf("Expect 3 parts, got %d", len(info.Parts))
+	}
+
+	out, _ := mail.mb.GetResultMessage(0)
+	if n := strings.Count(string(out), "--wail test:boundary"); n != 3 {
+		t.Errorf("The nested message should keep its own boundary, got %d delimiters", n)
+	}
+
+	mail = NewMail(&MailConfig{Charset: US_ASCII, Encoding: SevenBit})
+	mail.To("example1@example.com")
+	mail.SetBoundary("wail test:boundary")
+
+	mt.SetText(TextPlain, []byte("--wail test:boundary"))
+	mail.SetMessage(&mt)
+
+	if _, err := mail.mb.GetResultMessage(0); err == nil {
+		t.Error("A boundary occurring in the content should be rejected")
+	}
+}
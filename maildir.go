@@ -0,0 +1,102 @@
+package wail
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maildirCounter makes file names unique within the process
+var maildirCounter uint64
+
+// MaildirTransport delivers mails into a Maildir folder instead of sending
+// them to a server. It's useful to test code generating mails or for local
+// delivery: each mail becomes a file in the "new" subfolder
+type MaildirTransport struct {
+	dir string
+}
+
+// NewMaildirTransport returns the transport delivering into the Maildir
+// folder. The folder and its tmp, new and cur subfolders are created if needed
+func NewMaildirTransport(dir string) (*MaildirTransport, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return nil, fmt.Errorf("wail: can't create the maildir (%w)", err)
+		}
+	}
+
+	return &MaildirTransport{dir: dir}, nil
+}
+
+// Send assembles the mail and delivers it into the Maildir. The mail is
+// written into tmp first and then moved into new, so readers never see
+// a partially written mail. The Bcc field is not written
+func (t *MaildirTransport) Send(m *Mail) error {
+	if m == nil {
+		return errors.New("wail: an empty mail object has been provided")
+	}
+
+	cm := m.clone()
+	delete(cm.mb.header, "bcc")
+
+	if _, ok := cm.mb.header["to"]; !ok && len(m.bcc) != 0 {
+		if _, ok := cm.mb.header["cc"]; !ok {
+			cm.mb.header["to"] = undisclosedRecipients
+		}
+	}
+
+	raw, err := cm.mb.GetResultMessage(0)
+	if err != nil {
+		return err
+	}
+
+	name := maildirName()
+	tmp := filepath.Join(t.dir, "tmp", name)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("wail: can't create the maildir file (%w)", err)
+	}
+
+	_, err = f.Write(raw)
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(t.dir, "new", name))
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("wail: can't deliver the mail into the maildir (%w)", err)
+	}
+
+	return nil
+}
+
+// maildirName returns a unique file name of a new mail,
+// e.g. 1700000000.M123456P42Q1.host
+func maildirName() string {
+	host, err := hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+
+	// "/" and ":" are not allowed in the name (the latter separates flags)
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+
+	now := time.Now()
+	n := atomic.AddUint64(&maildirCounter, 1)
+
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, host)
+}
@@ -0,0 +1,70 @@
+package wail
+
+import (
+	"bytes"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaildirTransport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+
+	md, err := NewMaildirTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := testMail("to@example.com")
+	m.SetFrom("Alex", "alex@example.com")
+	m.BlindCopyTo("bcc@example.com")
+
+	for i := 0; i < 2; i++ {
+		if err := md.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if tmp, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(tmp) != 0 {
+		t.Errorf("No files should be left in tmp, got %d", len(tmp))
+	}
+
+	files, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("Expect 2 delivered mails, got %d", len(files))
+	}
+
+	for _, f := range files {
+		if strings.ContainsAny(f.Name(), "/:") {
+			t.Errorf("Invalid file name %s", f.Name())
+		}
+
+		raw, err := os.ReadFile(filepath.Join(dir, "new", f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if from := msg.Header.Get("From"); from != "Alex <alex@example.com>" {
+			t.Errorf("Invalid From field, expect %s, got %s", "Alex <alex@example.com>", from)
+		}
+
+		if strings.Contains(string(raw), "bcc@example.com") {
+			t.Error("The Bcc recipient should not be written")
+		}
+	}
+
+	if err := md.Send(NewMail(nil)); err == nil {
+		t.Error("A mail without recipients should be rejected")
+	}
+}
@@ -1,11 +1,24 @@
 package wail
 
 import (
-	"crypto/sha256"
+	"bytes"
+	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/language"
 )
 
 type contentType int
@@ -14,34 +27,175 @@ const (
 	TextPlain contentType = iota
 	TextHtml
 
+	// TextWatchHtml is a condensed html for Apple Watch. It's placed
+	// between the plain and html parts of a multipart/alternative message
+	TextWatchHtml
+
 	multipartMix
 	multipartAlt
+	multipartRel
 	applOctetStream
+	messageRFC822
+	multipartReport
 )
 
 var contentTypes = map[contentType]string{
 	TextPlain:       "text/plain",
 	TextHtml:        "text/html",
+	TextWatchHtml:   "text/watch-html",
 	multipartMix:    "multipart/mixed",
 	multipartAlt:    "multipart/alternative",
+	multipartRel:    "multipart/related",
 	applOctetStream: "application/octet-stream",
+	messageRFC822:   "message/rfc822",
+	multipartReport: "multipart/report",
 }
 
+// contentTypesMu guards contentTypes against concurrent registrations
+var contentTypesMu sync.RWMutex
+
 func (c contentType) string() string {
+	contentTypesMu.RLock()
+	defer contentTypesMu.RUnlock()
+
 	return contentTypes[c]
 }
 
-// Boundary is used in multipart messages
-var boundary = func() string {
-	h := sha256.New224()
-	h.Write([]byte("6MHoYQhoRORdeWi6RzQaFKK7iGYieH"))
+// ContentType is a content type of a message part, e.g. TextPlain
+// or the one returned by RegisterContentType
+type ContentType = contentType
+
+// RegisterContentType registers a media type (e.g. "text/calendar" or
+// "application/pdf") and returns the content type that can be used with
+// TextMessage.Set or Attachment.SetContentType. Registering the same media
+// type twice returns the same content type. It's safe for concurrent use
+func RegisterContentType(mediaType string) (ContentType, error) {
+	mt, params, err := mime.ParseMediaType(mediaType)
+	if err != nil || len(params) != 0 {
+		return 0, fmt.Errorf("wail: invalid media type %q", mediaType)
+	}
 
-	out := hex.EncodeToString(h.Sum(nil))
-	return out[:len(out)/2]
-}()
+	contentTypesMu.Lock()
+	defer contentTypesMu.Unlock()
 
-var middleBound = "--" + boundary + "\r\n"
-var endBound = "--" + boundary + "--"
+	var last contentType
+
+	for c, v := range contentTypes {
+		if v == mt {
+			return c, nil
+		}
+
+		if c > last {
+			last = c
+		}
+	}
+
+	contentTypes[last+1] = mt
+
+	return last + 1, nil
+}
+
+// newBoundary returns a random boundary for a multipart message.
+// Each multipart message gets its own boundary, so nested
+// multipart messages never share the same one
+var newBoundary = func() (string, error) {
+	return randomHex(15)
+}
+
+// randReader is a source of random bytes. It may be replaced in tests
+var randReader = rand.Reader
+
+// randomHex returns n random bytes encoded in hex
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		return "", fmt.Errorf("wail: failed to generate random bytes (%w)", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// multipartContent assembles a multipart message from the formatted parts.
+// Multipart messages are never encoded, so there is no Content-Transfer-Encoding
+// field even if the message is nested in another multipart message
+func multipartContent(mb *mimeBuilder, ctype string, parts []string) string {
+	segs := make([][]segment, len(parts))
+	for i, p := range parts {
+		segs[i] = appendText(nil, p)
+	}
+
+	return joinSegments(multipartSegments(mb, ctype, segs), lineLengthLimit)
+}
+
+// multipartSegments is like multipartContent but the parts are segments,
+// so their base64 encoded attachments are encoded only when it's written.
+// A failure to generate the boundary is reported when the message is assembled
+func multipartSegments(mb *mimeBuilder, ctype string, parts [][]segment) []segment {
+	boundary, err := newBoundary()
+
+	// The boundary must not occur in the parts, otherwise
+	// parsers would end the part prematurely (RFC 2046 5.1.1)
+	for err == nil && collidesAny(boundary, parts) {
+		boundary, err = newBoundary()
+	}
+
+	if err != nil {
+		if mb.msgErr == nil {
+			mb.msgErr = err
+		}
+
+		return nil
+	}
+
+	content := appendText(nil, fmt.Sprintf("Content-Type: %s; boundary=\"%s\"\r\n\r\n", ctype, boundary))
+
+	for _, p := range parts {
+		content = appendText(content, "--"+boundary+"\r\n")
+		content = appendSegments(content, p...)
+		content = appendText(content, "\r\n\r\n")
+	}
+
+	return appendText(content, "--"+boundary+"--")
+}
+
+func collidesAny(boundary string, parts [][]segment) bool {
+	for _, p := range parts {
+		if collides(boundary, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// collides reports whether the boundary occurs in the segments. The
+// base64 alphabet has no "-", so the base64 segments never contain it
+func collides(boundary string, segs []segment) bool {
+	for _, seg := range segs {
+		if !seg.base64 && bytes.Contains(seg.data, []byte("--"+boundary)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// segmenter is implemented by the messages that may contain attachments.
+// Their content is formatted as segments, so the attachments are base64
+// encoded only when the message is written
+type segmenter interface {
+	segments(mb *mimeBuilder) []segment
+}
+
+// contentSegments returns the formatted content of the message
+func contentSegments(msg Message, mb *mimeBuilder) []segment {
+	if s, ok := msg.(segmenter); ok {
+		return s.segments(mb)
+	}
+
+	return appendText(nil, msg.GetContent(mb))
+}
 
 type Message interface {
 	// GetContent returns formatted message body text
@@ -52,9 +206,24 @@ type Message interface {
 	GetContentType() contentType
 }
 
+// mimeDeclarer is an optional interface of a Message. A message
+// that doesn't implement it is treated as the one that needs MIME
+type mimeDeclarer interface {
+	// NeedsMIME reports whether the message uses any MIME features
+	// so the MIME-Version header must be present in the result message
+	NeedsMIME() bool
+}
+
 type TextMessage struct {
 	ctype contentType
 	text  []byte
+
+	// charset is a charset of this part. If it's empty
+	// the charset of the mail is used
+	charset charset
+
+	// languages is a value of the Content-Language field
+	languages string
 }
 
 // NewTextMessage creates a new text message object
@@ -62,29 +231,190 @@ func NewTextMessage() TextMessage {
 	return TextMessage{}
 }
 
+// PlainText returns a text/plain message with the text
+func PlainText(text string) Message {
+	t := NewTextMessage()
+	t.Set(TextPlain, []byte(text))
+
+	return &t
+}
+
+// HTML returns a text/html message with the html text
+func HTML(html string) Message {
+	t := NewTextMessage()
+	t.Set(TextHtml, []byte(html))
+
+	return &t
+}
+
 // Set sets a text content type (plain or html) and message text
 func (t *TextMessage) Set(ctype contentType, text []byte) {
 	t.ctype = ctype
 	t.text = text
 }
 
+// SetFromFile reads the message text from the file stored in filePath
+// (e.g. an html template). Line endings of the file are normalized to CRLF
+func (t *TextMessage) SetFromFile(ctype contentType, filePath string) error {
+	buf, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	t.Set(ctype, normalizeNewlines(buf))
+
+	return nil
+}
+
+// SetCharset sets a charset of the text that differs from the charset of
+// the mail, e.g. to add an ISO-2022-JP plain part along with a UTF-8 html
+// part. The text must be UTF-8, it's transcoded when the message is assembled
+func (t *TextMessage) SetCharset(cs charset) error {
+	if _, err := htmlindex.Get(string(cs)); err != nil {
+		return fmt.Errorf("wail: unsupported charset %s", cs)
+	}
+
+	t.charset = cs
+
+	return nil
+}
+
+// SetLanguage sets the languages of the text (RFC 3282), e.g. "ru".
+// Mail clients and screen readers use it to render the text properly
+func (t *TextMessage) SetLanguage(tags ...string) error {
+	langs := make([]string, 0, len(tags))
+
+	for _, tag := range tags {
+		lang, err := language.Parse(tag)
+		if err != nil {
+			return fmt.Errorf("wail: invalid language tag %q (%w)", tag, err)
+		}
+
+		langs = append(langs, lang.String())
+	}
+
+	t.languages = strings.Join(langs, ", ")
+
+	return nil
+}
+
 func (t *TextMessage) GetContent(mb *mimeBuilder) string {
-	content := fmt.Sprintf("Content-Type: %s; charset=%s\r\n", t.ctype.string(), mb.charset)
+	cs, text := mb.charset, t.text
+
+	if t.charset != "" {
+		if encoded, err := transcode(t.text, t.charset); err != nil {
+			if mb.logger != nil {
+				mb.logger.Printf("wail: the text can't be encoded in %s, %s is used instead (%s)", t.charset, cs, err.Error())
+			}
+		} else {
+			cs, text = t.charset, encoded
+		}
+	}
+
+	content := fmt.Sprintf("Content-Type: %s; charset=%s\r\n", t.ctype.string(), cs)
 	content += fmt.Sprintf("Content-Transfer-Encoding: %s\r\n", mb.encoding)
+
+	if t.languages != "" {
+		content += fmt.Sprintf("Content-Language: %s\r\n", t.languages)
+	}
+
 	content += "\r\n"
 
-	content += mb.EncodeBody(t.text)
+	content += mb.EncodeBody(normalizeNewlines(text))
 
 	return content
 }
 
+// transcode converts the UTF-8 text to the charset
+func transcode(text []byte, cs charset) ([]byte, error) {
+	enc, err := htmlindex.Get(string(cs))
+	if err != nil {
+		return nil, err
+	}
+
+	return enc.NewEncoder().Bytes(text)
+}
+
 func (t *TextMessage) GetContentType() contentType {
 	return t.ctype
 }
 
+// NeedsMIME returns false only for a text/plain message that
+// consists of 7bit US-ASCII chars and has no charset or language of its own
+func (t *TextMessage) NeedsMIME() bool {
+	if t.ctype != TextPlain || t.charset != "" || t.languages != "" {
+		return true
+	}
+
+	for _, c := range t.text {
+		if c == 0 || c > 127 {
+			return true
+		}
+	}
+
+	return false
+}
+
 type Attachment struct {
 	content []byte
 	name    string
+
+	// contentID is set for inline attachments that
+	// are referenced from html as "cid:<contentID>"
+	contentID string
+
+	params DispositionParams
+
+	// ctype is a content type of the attachment set explicitly.
+	// If typed is false, application/octet-stream is used
+	ctype contentType
+	typed bool
+
+	// typeParams are parameters of the Content-Type field,
+	// e.g. the ones of a part converted by FromNetMail
+	typeParams map[string]string
+
+	// maxSize limits the content read by ReadFromFile
+	// and ReadFromReader. Zero value means no limit
+	maxSize int64
+}
+
+// DispositionParams contains optional parameters of the
+// Content-Disposition field of an attachment (RFC 2183).
+// Zero values are omitted
+type DispositionParams struct {
+	CreationDate     time.Time
+	ModificationDate time.Time
+	ReadDate         time.Time
+
+	// Size is an approximate size of the file in bytes
+	Size int64
+}
+
+// String formats the parameters, each of them is preceded by "; "
+func (p DispositionParams) String() string {
+	var out string
+
+	dates := []struct {
+		name string
+		date time.Time
+	}{
+		{"creation-date", p.CreationDate},
+		{"modification-date", p.ModificationDate},
+		{"read-date", p.ReadDate},
+	}
+
+	for _, d := range dates {
+		if !d.date.IsZero() {
+			out += fmt.Sprintf("; %s=\"%s\"", d.name, d.date.Format(time.RFC1123Z))
+		}
+	}
+
+	if p.Size > 0 {
+		out += fmt.Sprintf("; size=%d", p.Size)
+	}
+
+	return out
 }
 
 // NewAttachment creates a new attachment object
@@ -92,6 +422,19 @@ func NewAttachment() Attachment {
 	return Attachment{}
 }
 
+// NewAttachment creates a new attachment object that refuses to read
+// more than MailConfig.MaxAttachmentSize of the mail
+func (m *Mail) NewAttachment() Attachment {
+	return Attachment{maxSize: m.cfg.MaxAttachmentSize}
+}
+
+// ErrAttachmentTooLarge is returned when an attachment exceeds MailConfig.MaxAttachmentSize
+var ErrAttachmentTooLarge = errors.New("wail: attachment exceeds max size")
+
+// ErrAttachmentBlocked is returned when an attachment extension is blocked
+// (or not allowed) by MailConfig.BlockedExtensions or AllowedExtensions
+var ErrAttachmentBlocked = errors.New("wail: attachment type is not allowed")
+
 // ReadFromFile reads the content of a file that is stored in filePath
 func (a *Attachment) ReadFromFile(filePath string) error {
 	info, err := os.Stat(filePath)
@@ -99,6 +442,10 @@ func (a *Attachment) ReadFromFile(filePath string) error {
 		return err
 	}
 
+	if a.maxSize > 0 && info.Size() > a.maxSize {
+		return ErrAttachmentTooLarge
+	}
+
 	buf, err := os.ReadFile(filePath)
 	if err != nil {
 		return err
@@ -109,9 +456,57 @@ func (a *Attachment) ReadFromFile(filePath string) error {
 	a.content = make([]byte, len(buf))
 	copy(a.content, buf)
 
+	a.params = DispositionParams{
+		ModificationDate: info.ModTime(),
+		Size:             info.Size(),
+	}
+
+	return nil
+}
+
+// ReadFromReader reads the content of the attachment from r
+// until EOF. The name is used as the attachment file name
+func (a *Attachment) ReadFromReader(name string, r io.Reader) error {
+	if a.maxSize > 0 {
+		r = io.LimitReader(r, a.maxSize+1)
+	}
+
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if a.maxSize > 0 && int64(len(buf)) > a.maxSize {
+		return ErrAttachmentTooLarge
+	}
+
+	a.name = name
+	a.content = buf
+	a.params = DispositionParams{}
+
 	return nil
 }
 
+// SetDispositionParams sets parameters of the Content-Disposition field.
+// It replaces the ones that ReadFromFile takes from the file info
+func (a *Attachment) SetDispositionParams(params DispositionParams) {
+	a.params = params
+}
+
+// SetInlineAuto makes the attachment inline with a generated unique
+// content ID and returns it. Refer to the attachment from html as
+// "cid:<content ID>" and add it with MultipartRelatedMessage.AddInline.
+// It fails if random bytes can't be generated
+func (a *Attachment) SetInlineAuto() (string, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	a.contentID = id + "@wail"
+	return a.contentID, nil
+}
+
 // SetAsBinary sets names and file content in cases when you can't read
 // it from file (e.g. a file content stores in DB)
 func (a *Attachment) SetAsBinary(name string, content []byte) {
@@ -121,23 +516,204 @@ func (a *Attachment) SetAsBinary(name string, content []byte) {
 	copy(a.content, content)
 }
 
+// SetAsMessage sets the raw content of an email (e.g. the original one
+// that is forwarded or reported as spam) attached as message/rfc822, so
+// mail clients can open it. An empty name is replaced with "message.eml"
+func (a *Attachment) SetAsMessage(name string, raw []byte) {
+	if name == "" {
+		name = "message.eml"
+	}
+
+	a.SetAsBinary(name, normalizeNewlines(raw))
+	a.SetContentType(messageRFC822)
+}
+
 func (a *Attachment) GetContent(mb *mimeBuilder) string {
-	content := fmt.Sprintf("Content-Type: %s\r\n", a.GetContentType().string())
-	content += fmt.Sprintf("Content-Disposition: attachment; filename=%s\r\n", a.name)
-	content += fmt.Sprintf("Content-Transfer-Encoding: %s\r\n", mb.encoding)
-	content += "\r\n"
+	return joinSegments(a.segments(mb), mb.base64Width)
+}
 
-	content += mb.EncodeBody(a.content)
+func (a *Attachment) segments(mb *mimeBuilder) []segment {
+	mb.checkAttachment(a.name, len(a.content))
 
-	return content
+	if a.contentID != "" {
+		return a.inlineSegments(mb)
+	}
+
+	mediaType := a.GetContentType().string()
+
+	if len(a.typeParams) != 0 {
+		if v := mime.FormatMediaType(mediaType, a.typeParams); v != "" {
+			mediaType = v
+		}
+	}
+
+	content := fmt.Sprintf("Content-Type: %s\r\n", mediaType)
+	content += fmt.Sprintf("Content-Disposition: attachment;%s%s\r\n", filenameParam(a.name), a.params)
+
+	if a.GetContentType() == messageRFC822 {
+		content += fmt.Sprintf("Content-Transfer-Encoding: %s\r\n", messageEncoding(a.content))
+		content += "\r\n"
+
+		return []segment{{data: []byte(content)}, {data: a.content}}
+	}
+
+	return a.bodySegments(mb, content)
+}
+
+// bodySegments returns the formatted attachment preceded by its header
+func (a *Attachment) bodySegments(mb *mimeBuilder, header string) []segment {
+	enc := mb.attachmentEncoding(a.content)
+
+	header += fmt.Sprintf("Content-Transfer-Encoding: %s\r\n", enc)
+	header += "\r\n"
+
+	if enc == Base64 {
+		return []segment{{data: []byte(header)}, {data: a.content, base64: true}}
+	}
+
+	_, body := mb.EncodeAttachment(a.content)
+
+	return appendText(nil, header+body)
+}
+
+// messageEncoding returns the encoding of an attached message. Only 7bit,
+// 8bit and binary are allowed for message/rfc822 (RFC 2046 5.2.1), so
+// the message is never encoded
+func messageEncoding(raw []byte) encoding {
+	for _, line := range bytes.Split(raw, []byte("\r\n")) {
+		if len(line) > 998 || bytes.IndexByte(line, 0) >= 0 {
+			return Binary
+		}
+	}
+
+	if isASCIIText(raw) {
+		return SevenBit
+	}
+
+	return eightBit
+}
+
+// inlineSegments formats the attachment displayed inside the html text.
+// Unless the content type is set, it's detected by the file extension
+func (a *Attachment) inlineSegments(mb *mimeBuilder) []segment {
+	mediaType := a.GetContentType().string()
+
+	if !a.typed {
+		if t := mime.TypeByExtension(filepath.Ext(a.name)); t != "" {
+			mediaType = t
+		}
+	}
+
+	content := fmt.Sprintf("Content-Type: %s\r\n", mediaType)
+	content += fmt.Sprintf("Content-Disposition: inline;%s%s\r\n", filenameParam(a.name), a.params)
+	content += fmt.Sprintf("Content-ID: <%s>\r\n", a.contentID)
+
+	return a.bodySegments(mb, content)
+}
+
+// filenameParam formats the filename parameter of the Content-Disposition
+// field preceded by a space. A non-ASCII name is percent-encoded (RFC 2231)
+// and a long encoded name is split into continuations (filename*0*=...,
+// filename*1*=...), each of them on its own line
+func filenameParam(name string) string {
+	ascii := true
+
+	for i := 0; i < len(name); i++ {
+		if name[i] < ' ' || name[i] > '~' {
+			ascii = false
+			break
+		}
+	}
+
+	if ascii {
+		if v := mime.FormatMediaType("x", map[string]string{"filename": name}); v != "" {
+			if p := " " + strings.TrimPrefix(v, "x; "); len(p) <= lineLengthLimit-len("Content-Disposition: attachment;") {
+				return p
+			}
+		}
+	}
+
+	const prefix = "UTF-8''"
+
+	// The segment length leaves room for " filename*NN*=" and ";"
+	const segmentLimit = lineLengthLimit - 16
+
+	var (
+		segment strings.Builder
+		parts   []string
+	)
+
+	flush := func() {
+		parts = append(parts, segment.String())
+		segment.Reset()
+	}
+
+	segment.WriteString(prefix)
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+
+		var chunk string
+		if isAttrChar(c) {
+			chunk = string(c)
+		} else {
+			chunk = fmt.Sprintf("%%%02X", c)
+		}
+
+		if segment.Len()+len(chunk) > segmentLimit {
+			flush()
+		}
+
+		segment.WriteString(chunk)
+	}
+
+	flush()
+
+	if len(parts) == 1 {
+		return " filename*=" + parts[0]
+	}
+
+	lines := make([]string, len(parts))
+	for i, p := range parts {
+		lines[i] = fmt.Sprintf("filename*%d*=%s", i, p)
+	}
+
+	return "\r\n " + strings.Join(lines, ";\r\n ")
+}
+
+// isAttrChar reports whether c may appear in an
+// RFC 2231 extended value without percent-encoding
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
+
+// SetContentType sets a content type of the attachment, e.g. the one
+// returned by RegisterContentType. Default is application/octet-stream
+func (a *Attachment) SetContentType(ctype contentType) {
+	a.ctype = ctype
+	a.typed = true
 }
 
 func (a *Attachment) GetContentType() contentType {
-	return applOctetStream
+	if !a.typed {
+		return applOctetStream
+	}
+
+	return a.ctype
+}
+
+func (a *Attachment) NeedsMIME() bool {
+	return true
 }
 
 type MultipartMixedMessage struct {
-	text        TextMessage
+	// body is a text message or a multipart/alternative message
+	body        Message
 	attachments []Attachment
 }
 
@@ -148,7 +724,16 @@ func NewMultipartMixedMessage() MultipartMixedMessage {
 
 // SetText sets a text content type (plain or html) and message text
 func (m *MultipartMixedMessage) SetText(ctype contentType, text []byte) {
-	m.text.Set(ctype, text)
+	t := NewTextMessage()
+	t.Set(ctype, text)
+
+	m.body = &t
+}
+
+// SetAlternative sets a multipart/alternative message as the message text.
+// Use it to send both plain and html text along with attachments
+func (m *MultipartMixedMessage) SetAlternative(alt MultipartAltMessage) {
+	m.body = &alt
 }
 
 // AddAttachment adds an attachment to the message
@@ -157,32 +742,33 @@ func (m *MultipartMixedMessage) AddAttachment(attach Attachment) {
 }
 
 func (m *MultipartMixedMessage) GetContent(mb *mimeBuilder) string {
-	content := fmt.Sprintf("Content-Type: %s; boundary=%s\r\n", m.GetContentType().string(), boundary)
-	content += "\r\n"
-
-	content += middleBound
-	content += m.text.GetContent(mb)
+	return joinSegments(m.segments(mb), mb.base64Width)
+}
 
-	content += "\r\n"
-	content += "\r\n"
+func (m *MultipartMixedMessage) segments(mb *mimeBuilder) []segment {
+	body := m.body
+	if body == nil {
+		body = &TextMessage{}
+	}
 
-	for _, attach := range m.attachments {
-		content += middleBound
-		content += attach.GetContent(mb)
+	parts := make([][]segment, 0, len(m.attachments)+1)
+	parts = append(parts, contentSegments(body, mb))
 
-		content += "\r\n"
-		content += "\r\n"
+	for i := range m.attachments {
+		parts = append(parts, m.attachments[i].segments(mb))
 	}
 
-	content += endBound
-
-	return content
+	return multipartSegments(mb, m.GetContentType().string(), parts)
 }
 
 func (m *MultipartMixedMessage) GetContentType() contentType {
 	return multipartMix
 }
 
+func (m *MultipartMixedMessage) NeedsMIME() bool {
+	return true
+}
+
 type altMessage struct {
 	text  TextMessage
 	order int
@@ -218,27 +804,251 @@ func (m *MultipartAltMessage) SetHtmlText(text []byte, order int) {
 	m.msg = append(m.msg, altMessage{text: txtHtml, order: order})
 }
 
-func (m *MultipartAltMessage) GetContent(mb *mimeBuilder) string {
-	content := fmt.Sprintf("Content-Type: %s; boundary=%s\r\n", m.GetContentType().string(), boundary)
-	content += "\r\n"
+// SetWatchHtmlText sets a text/watch-html part of the message with specified
+// order (priority). Apple Watch displays it instead of the html part, so its
+// order should be between the plain and html parts
+func (m *MultipartAltMessage) SetWatchHtmlText(text []byte, order int) {
+	txtWatch := TextMessage{}
+	txtWatch.Set(TextWatchHtml, text)
+
+	m.msg = append(m.msg, altMessage{text: txtWatch, order: order})
+}
+
+// Add adds a prebuilt text message (plain or html) as
+// a part of the message with specified order (priority)
+func (m *MultipartAltMessage) Add(msg TextMessage, order int) {
+	m.msg = append(m.msg, altMessage{text: msg, order: order})
+}
 
+func (m *MultipartAltMessage) GetContent(mb *mimeBuilder) string {
 	sort.SliceStable(m.msg, func(i, j int) bool {
 		return m.msg[i].order < m.msg[j].order
 	})
 
-	for _, v := range m.msg {
-		content += middleBound
-		content += v.text.GetContent(mb)
+	parts := make([]string, 0, len(m.msg))
 
-		content += "\r\n"
-		content += "\r\n"
+	for _, v := range m.msg {
+		parts = append(parts, v.text.GetContent(mb))
 	}
 
-	content += endBound
-
-	return content
+	return multipartContent(mb, m.GetContentType().string(), parts)
 }
 
 func (m *MultipartAltMessage) GetContentType() contentType {
 	return multipartAlt
 }
+
+func (m *MultipartAltMessage) NeedsMIME() bool {
+	return true
+}
+
+// cidRef matches "cid:" URLs (RFC 2392) in html
+var cidRef = regexp.MustCompile(`(?i)cid:([^"'\s)>]+)`)
+
+// MultipartRelatedMessage is an html message with inline images
+type MultipartRelatedMessage struct {
+	html   TextMessage
+	images []Attachment
+
+	// err is a failure to generate a content ID by AddInline
+	err error
+}
+
+// NewMultipartRelatedMessage creates a new multipart/related message object
+func NewMultipartRelatedMessage() MultipartRelatedMessage {
+	return MultipartRelatedMessage{}
+}
+
+// SetHTML sets the html text. Inline images are referenced
+// from it by their content IDs, e.g. <img src="cid:logo">
+func (m *MultipartRelatedMessage) SetHTML(html []byte) {
+	m.html.Set(TextHtml, html)
+}
+
+// AddInlineImage adds an image with the specified content ID. The image
+// type is detected by the name extension (e.g. logo.png)
+func (m *MultipartRelatedMessage) AddInlineImage(cid, name string, content []byte) {
+	a := NewAttachment()
+	a.SetAsBinary(name, content)
+	a.contentID = cid
+
+	m.images = append(m.images, a)
+}
+
+// AddInline adds the inline attachment (see Attachment.SetInlineAuto).
+// A content ID is generated if the attachment doesn't have one
+func (m *MultipartRelatedMessage) AddInline(a Attachment) {
+	if a.contentID == "" {
+		if _, err := a.SetInlineAuto(); err != nil && m.err == nil {
+			m.err = err
+		}
+	}
+
+	m.images = append(m.images, a)
+}
+
+// Validate checks that every "cid:" URL in the html refers to an inline
+// image and every inline image is referenced from the html
+func (m *MultipartRelatedMessage) Validate() error {
+	images := make(map[string]bool, len(m.images))
+	for _, img := range m.images {
+		images[img.contentID] = false
+	}
+
+	var errs []error
+
+	for _, ref := range cidRef.FindAllSubmatch(m.html.text, -1) {
+		cid := string(ref[1])
+		if c, err := url.PathUnescape(cid); err == nil {
+			cid = c
+		}
+
+		if _, ok := images[cid]; !ok {
+			errs = append(errs, fmt.Errorf("wail: html refers to cid:%s but there is no such inline image", cid))
+		} else {
+			images[cid] = true
+		}
+	}
+
+	for _, img := range m.images {
+		if !images[img.contentID] {
+			errs = append(errs, fmt.Errorf("wail: inline image %s is not referenced from html", img.contentID))
+			images[img.contentID] = true
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (m *MultipartRelatedMessage) GetContent(mb *mimeBuilder) string {
+	return joinSegments(m.segments(mb), mb.base64Width)
+}
+
+func (m *MultipartRelatedMessage) segments(mb *mimeBuilder) []segment {
+	if m.err != nil && mb.msgErr == nil {
+		mb.msgErr = m.err
+	}
+
+	if err := m.Validate(); err != nil && mb.logger != nil {
+		mb.logger.Printf("%s", err.Error())
+	}
+
+	parts := make([][]segment, 0, len(m.images)+1)
+	parts = append(parts, contentSegments(&m.html, mb))
+
+	for i := range m.images {
+		parts = append(parts, m.images[i].segments(mb))
+	}
+
+	return multipartSegments(mb, fmt.Sprintf("%s; type=\"%s\"", m.GetContentType().string(), TextHtml.string()), parts)
+}
+
+func (m *MultipartRelatedMessage) GetContentType() contentType {
+	return multipartRel
+}
+
+func (m *MultipartRelatedMessage) NeedsMIME() bool {
+	return true
+}
+
+type reportType string
+
+const (
+	// DeliveryStatus is a delivery status notification (RFC 3464)
+	DeliveryStatus reportType = "delivery-status"
+
+	// DispositionNotification is a message disposition notification (RFC 8098)
+	DispositionNotification reportType = "disposition-notification"
+)
+
+// MultipartReportMessage is a multipart/report message (RFC 6522) that
+// contains a human-readable text, a machine-readable report and
+// optionally the original message or its header. Use it to generate
+// DSNs or MDNs
+type MultipartReportMessage struct {
+	reportType reportType
+	text       TextMessage
+	report     []byte
+	original   []byte
+
+	// headersOnly is set if the original is only the header
+	// of the message sent as text/rfc822-headers
+	headersOnly bool
+}
+
+// NewMultipartReportMessage creates a new multipart/report message object
+func NewMultipartReportMessage(rt reportType) MultipartReportMessage {
+	return MultipartReportMessage{reportType: rt}
+}
+
+// SetText sets the human-readable description of the report
+func (m *MultipartReportMessage) SetText(text []byte) {
+	m.text.Set(TextPlain, text)
+}
+
+// SetReport sets the report fields, e.g. the per-message and per-recipient
+// fields of a delivery status separated by an empty line. They are sent
+// as message/delivery-status or message/disposition-notification
+func (m *MultipartReportMessage) SetReport(fields []byte) {
+	m.report = normalizeNewlines(fields)
+}
+
+// SetOriginal sets the raw original message that is sent as message/rfc822
+func (m *MultipartReportMessage) SetOriginal(raw []byte) {
+	m.original = normalizeNewlines(raw)
+	m.headersOnly = false
+}
+
+// SetOriginalHeaders sets the header of the original message that is sent
+// as text/rfc822-headers (RFC 6522). It's the usual choice for bounces since
+// the body is not returned. If raw is the whole message, its body is dropped
+func (m *MultipartReportMessage) SetOriginalHeaders(raw []byte) {
+	raw = normalizeNewlines(raw)
+
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		raw = raw[:i+2]
+	}
+
+	m.original = raw
+	m.headersOnly = true
+}
+
+func (m *MultipartReportMessage) GetContent(mb *mimeBuilder) string {
+	if len(m.report) == 0 && mb.msgErr == nil {
+		mb.msgErr = fmt.Errorf("wail: the %s report is empty", m.reportType)
+	}
+
+	parts := make([]string, 0, 3)
+	parts = append(parts, m.text.GetContent(mb))
+
+	report := fmt.Sprintf("Content-Type: message/%s\r\n", m.reportType)
+	report += fmt.Sprintf("Content-Transfer-Encoding: %s\r\n", messageEncoding(m.report))
+	report += "\r\n"
+	report += strings.TrimSuffix(string(m.report), "\r\n")
+
+	parts = append(parts, report)
+
+	if len(m.original) != 0 {
+		ctype := messageRFC822.string()
+		if m.headersOnly {
+			ctype = "text/rfc822-headers"
+		}
+
+		original := fmt.Sprintf("Content-Type: %s\r\n", ctype)
+		original += fmt.Sprintf("Content-Transfer-Encoding: %s\r\n", messageEncoding(m.original))
+		original += "\r\n"
+		original += strings.TrimSuffix(string(m.original), "\r\n")
+
+		parts = append(parts, original)
+	}
+
+	return multipartContent(mb, fmt.Sprintf("%s; report-type=%s", m.GetContentType().string(), m.reportType), parts)
+}
+
+func (m *MultipartReportMessage) GetContentType() contentType {
+	return multipartReport
+}
+
+func (m *MultipartReportMessage) NeedsMIME() bool {
+	return true
+}
@@ -0,0 +1,1014 @@
+package wail
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+func TestNestedMultipart(t *testing.T) {
+	alt := NewMultipartAltMessage()
+	alt.SetPlainText([]byte("Hello, World"), 0)
+	alt.SetHtmlText([]byte("<b>Hello, World</b>"), 1)
+
+	mt := NewMultipartMixedMessage()
+	mt.SetAlternative(alt)
+
+	a := NewAttachment()
+	a.SetAsBinary("report.csv", []byte("id,name"))
+
+	mt.AddAttachment(a)
+
+	m := NewMail(&MailConfig{Encoding: QuotedPrintable})
+	m.To("example1@example.com")
+	m.SetMessage(&mt)
+
+	raw, err := m.mb.GetResultMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Invalid outer content type %s (%v)", mediaType, err)
+	}
+
+	outer := multipart.NewReader(msg.Body, params["boundary"])
+
+	p, err := outer.NextRawPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cte := p.Header.Get("Content-Transfer-Encoding"); cte != "" {
+		t.Errorf("A nested multipart should not declare a transfer encoding, got %s", cte)
+	}
+
+	nestedType, nestedParams, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+	if err != nil || nestedType != "multipart/alternative" {
+		t.Fatalf("Invalid nested content type %s (%v)", nestedType, err)
+	}
+
+	if nestedParams["boundary"] == params["boundary"] {
+		t.Error("A nested multipart should have its own boundary")
+	}
+
+	inner := multipart.NewReader(p, nestedParams["boundary"])
+
+	for _, expect := range []string{"Hello, World", "<b>Hello, World</b>"} {
+		ip, err := inner.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := io.ReadAll(ip)
+
+		if string(bytes.TrimSpace(body)) != expect {
+			t.Errorf("Invalid nested part, expect %s, got %s", expect, body)
+		}
+	}
+
+	if _, err := inner.NextPart(); err != io.EOF {
+		t.Errorf("Expect the end of the nested multipart, got %v", err)
+	}
+
+	ap, err := outer.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ap.FileName() != "report.csv" {
+		t.Errorf("Invalid attachment name, expect %s, got %s", "report.csv", ap.FileName())
+	}
+
+	if _, err := outer.NextPart(); err != io.EOF {
+		t.Errorf("Expect the end of the outer multipart, got %v", err)
+	}
+}
+
+func TestMultipartRelated(t *testing.T) {
+	rel := NewMultipartRelatedMessage()
+	rel.SetHTML([]byte(`<img src="cid:logo"><img src='cid:banner'>`))
+	rel.AddInlineImage("logo", "logo.png", []byte("png"))
+	rel.AddInlineImage("banner", "banner.jpg", []byte("jpg"))
+
+	if err := rel.Validate(); err != nil {
+		t.Fatalf("Expect no validation error, got %v", err)
+	}
+
+	var logs bytes.Buffer
+
+	m := NewMail(&MailConfig{Logger: log.New(&logs, "", 0)})
+	m.To("example1@example.com")
+	m.SetMessage(&rel)
+
+	info, err := m.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if logs.Len() != 0 {
+		t.Errorf("Expect no warnings, got %s", logs.String())
+	}
+
+	if len(info.Parts) != 3 || info.Parts[1].ContentType != "image/png" || info.Parts[2].ContentType != "image/jpeg" {
+		t.Errorf("Invalid parts %+v", info.Parts)
+	}
+
+	rel.SetHTML([]byte(`<img src="cid:logo"><img src="cid:missing">`))
+
+	if err := rel.Validate(); err == nil {
+		t.Error("Expect a validation error for a dangling cid")
+	}
+
+	m.SetMessage(&rel)
+
+	if !strings.Contains(logs.String(), "cid:missing") || !strings.Contains(logs.String(), "banner is not referenced") {
+		t.Errorf("Expect warnings about cid:missing and banner, got %q", logs.String())
+	}
+}
+
+func TestMultipartAltAdd(t *testing.T) {
+	html := NewTextMessage()
+	html.Set(TextHtml, []byte("<b>Hello</b>"))
+
+	plain := NewTextMessage()
+	plain.Set(TextPlain, []byte("Hello"))
+
+	alt := NewMultipartAltMessage()
+	alt.Add(html, 1)
+	alt.Add(plain, 0)
+
+	m := NewMail(nil)
+	m.To("example1@example.com")
+	m.SetMessage(&alt)
+
+	info, err := m.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(info.Parts) != 2 || info.Parts[0].ContentType != "text/plain" || info.Parts[1].ContentType != "text/html" {
+		t.Errorf("Invalid parts %+v", info.Parts)
+	}
+}
+
+func TestAttachmentDispositionParams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.csv")
+
+	if err := os.WriteFile(path, []byte("id,name"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Date(2023, 5, 17, 10, 30, 0, 0, time.UTC)
+
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAttachment()
+	if err := a.ReadFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	disposition := func() map[string]string {
+		header, _, _ := strings.Cut(a.GetContent(newMimeBuilder(UTF8, Base64)), "\r\n\r\n")
+
+		msg, err := mail.ReadMessage(strings.NewReader(header + "\r\n\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Disposition"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return params
+	}
+
+	params := disposition()
+
+	if params["size"] != "7" {
+		t.Errorf("Expect size=7, got %q", params["size"])
+	}
+
+	if date, err := time.Parse(time.RFC1123Z, params["modification-date"]); err != nil || !date.Equal(modTime) {
+		t.Errorf("Expect modification-date %v, got %q", modTime, params["modification-date"])
+	}
+
+	a.SetDispositionParams(DispositionParams{CreationDate: modTime})
+
+	params = disposition()
+
+	if _, ok := params["size"]; ok || params["creation-date"] != "Wed, 17 May 2023 10:30:00 +0000" {
+		t.Errorf("Params should be overridden, got %v", params)
+	}
+}
+
+func TestTextMessageSetFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "template.html")
+
+	if err := os.WriteFile(path, []byte("<h1>Hello</h1>\n<p>World</p>\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mt := NewTextMessage()
+
+	if err := mt.SetFromFile(TextHtml, filepath.Join(t.TempDir(), "missing.html")); err == nil {
+		t.Error("Reading a missing file should fail")
+	}
+
+	if err := mt.SetFromFile(TextHtml, path); err != nil {
+		t.Fatal(err)
+	}
+
+	if mt.GetContentType() != TextHtml || string(mt.text) != "<h1>Hello</h1>\r\n<p>World</p>\r\n" {
+		t.Errorf("Invalid message %v %q", mt.GetContentType(), mt.text)
+	}
+}
+
+func TestTextMessageCharset(t *testing.T) {
+	plain := NewTextMessage()
+	plain.Set(TextPlain, []byte("こんにちは"))
+
+	if err := plain.SetCharset("KOI-9"); err == nil {
+		t.Error("An unknown charset should be rejected")
+	}
+
+	if err := plain.SetCharset(ISO_2022_JP); err != nil {
+		t.Fatal(err)
+	}
+
+	html := NewTextMessage()
+	html.Set(TextHtml, []byte("<p>こんにちは</p>"))
+
+	alt := NewMultipartAltMessage()
+	alt.Add(plain, 0)
+	alt.Add(html, 1)
+
+	m := NewMail(nil)
+	m.To("example1@example.com")
+	m.SetMessage(&alt)
+
+	raw, err := m.mb.GetResultMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	r := multipart.NewReader(msg.Body, params["boundary"])
+
+	expect := []struct {
+		charset string
+		text    string
+	}{
+		{"ISO-2022-JP", "こんにちは"},
+		{"UTF-8", "<p>こんにちは</p>"},
+	}
+
+	for _, e := range expect {
+		p, err := r.NextRawPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, params, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if params["charset"] != e.charset {
+			t.Errorf("Invalid charset, expect %s, got %s", e.charset, params["charset"])
+		}
+
+		enc, _ := htmlindex.Get(params["charset"])
+
+		text, err := io.ReadAll(enc.NewDecoder().Reader(transferDecoder(p, p.Header.Get("Content-Transfer-Encoding"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(text) != e.text {
+			t.Errorf("Invalid text, expect %q, got %q", e.text, text)
+		}
+	}
+}
+
+func TestTextMessageLanguage(t *testing.T) {
+	mt := NewTextMessage()
+	mt.Set(TextPlain, []byte("Привет"))
+
+	if err := mt.SetLanguage("not a tag!"); err == nil {
+		t.Error("An invalid language tag should be rejected")
+	}
+
+	if err := mt.SetLanguage("ru", "en-US"); err != nil {
+		t.Fatal(err)
+	}
+
+	if content := mt.GetContent(newMimeBuilder(UTF8, Base64)); !strings.Contains(content, "\r\nContent-Language: ru, en-US\r\n") {
+		t.Errorf("The Content-Language field is missing:\n%s", content)
+	}
+
+	mt.SetLanguage()
+
+	if content := mt.GetContent(newMimeBuilder(UTF8, Base64)); strings.Contains(content, "Content-Language") {
+		t.Error("The Content-Language field should be removed")
+	}
+}
+
+func TestMaxAttachmentSize(t *testing.T) {
+	mail := NewMail(&MailConfig{MaxAttachmentSize: 4})
+	mail.To("example1@example.com")
+
+	path := filepath.Join(t.TempDir(), "report.csv")
+
+	if err := os.WriteFile(path, []byte("id,name"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := mail.NewAttachment()
+
+	if err := a.ReadFromFile(path); err != ErrAttachmentTooLarge {
+		t.Errorf("Expect ErrAttachmentTooLarge, got %v", err)
+	}
+
+	if err := a.ReadFromReader("report.csv", strings.NewReader("id,name")); err != ErrAttachmentTooLarge {
+		t.Errorf("Expect ErrAttachmentTooLarge, got %v", err)
+	}
+
+	if err := a.ReadFromReader("id.txt", strings.NewReader("id")); err != nil || string(a.content) != "id" || a.name != "id.txt" {
+		t.Errorf("Invalid attachment %q %q (%v)", a.name, a.content, err)
+	}
+
+	// An attachment that isn't created by the mail isn't limited when
+	// it's read, but the mail still refuses to send it
+	b := NewAttachment()
+
+	if err := b.ReadFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	mt := NewMultipartMixedMessage()
+	mt.SetText(TextPlain, []byte("Hello"))
+	mt.AddAttachment(b)
+
+	mail.SetMessage(&mt)
+
+	if _, err := mail.Inspect(); !errors.Is(err, ErrAttachmentTooLarge) {
+		t.Errorf("Expect ErrAttachmentTooLarge, got %v", err)
+	}
+}
+
+func TestWatchHtml(t *testing.T) {
+	alt := NewMultipartAltMessage()
+	alt.SetHtmlText([]byte("<h1>Your order has shipped</h1><p>Details...</p>"), 2)
+	alt.SetPlainText([]byte("Your order has shipped"), 0)
+	alt.SetWatchHtmlText([]byte("<b>Shipped</b>"), 1)
+
+	m := NewMail(nil)
+	m.To("example1@example.com")
+	m.SetMessage(&alt)
+
+	info, err := m.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{"text/plain", "text/watch-html", "text/html"}
+
+	if len(info.Parts) != len(expect) {
+		t.Fatalf("Expect %d parts, got %+v", len(expect), info.Parts)
+	}
+
+	for i, ct := range expect {
+		if info.Parts[i].ContentType != ct {
+			t.Errorf("Part %d should be %s, got %s", i, ct, info.Parts[i].ContentType)
+		}
+	}
+}
+
+func TestLongAttachmentFilename(t *testing.T) {
+	name := strings.Repeat("Отчёт", 39) + ".pdf"
+
+	if n := len([]rune(name)); n < 199 {
+		t.Fatalf("The name is too short (%d chars)", n)
+	}
+
+	a := NewAttachment()
+	a.SetAsBinary(name, []byte("%PDF"))
+
+	header, _, _ := strings.Cut(a.GetContent(newMimeBuilder(UTF8, Base64)), "\r\n\r\n")
+
+	for _, l := range strings.Split(header, "\r\n") {
+		if len(l) > 78 {
+			t.Errorf("The line is too long (%d chars): %s", len(l), l)
+		}
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(header + "\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disposition, params, err := mime.ParseMediaType(msg.Header.Get("Content-Disposition"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if disposition != "attachment" || params["filename"] != name {
+		t.Errorf("Invalid filename, expect %q, got %q", name, params["filename"])
+	}
+
+	for _, short := range []string{"report.csv", "my report.csv", "отчёт.csv"} {
+		a.SetAsBinary(short, nil)
+
+		header, _, _ := strings.Cut(a.GetContent(newMimeBuilder(UTF8, Base64)), "\r\n\r\n")
+		msg, _ := mail.ReadMessage(strings.NewReader(header + "\r\n\r\n"))
+
+		if _, params, err := mime.ParseMediaType(msg.Header.Get("Content-Disposition")); err != nil || params["filename"] != short {
+			t.Errorf("Invalid filename, expect %q, got %q (%v)", short, params["filename"], err)
+		}
+	}
+}
+
+func TestRegisterContentType(t *testing.T) {
+	if _, err := RegisterContentType("not a type"); err == nil {
+		t.Error("An invalid media type should be rejected")
+	}
+
+	csv, err := RegisterContentType("text/csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again, _ := RegisterContentType("text/csv"); again != csv {
+		t.Error("The same media type should be registered once")
+	}
+
+	if html, _ := RegisterContentType("text/html"); html != TextHtml {
+		t.Error("A built-in media type should not be registered again")
+	}
+
+	// Concurrent registrations get the same type
+	types := make(chan ContentType, 8)
+
+	for i := 0; i < cap(types); i++ {
+		go func() {
+			c, _ := RegisterContentType("text/calendar")
+			types <- c
+		}()
+	}
+
+	calendar := <-types
+
+	for i := 1; i < cap(types); i++ {
+		if c := <-types; c != calendar || c.string() != "text/calendar" {
+			t.Errorf("Invalid concurrently registered type %d (%s), expect %d", c, c.string(), calendar)
+		}
+	}
+
+	a := NewAttachment()
+	a.SetAsBinary("report.csv", []byte("id,name"))
+	a.SetContentType(csv)
+
+	mt := NewMultipartMixedMessage()
+	mt.SetText(TextPlain, []byte("See the report"))
+	mt.AddAttachment(a)
+
+	m := NewMail(nil)
+	m.To("example1@example.com")
+	m.SetMessage(&mt)
+
+	info, err := m.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(info.Parts) != 2 || info.Parts[1].ContentType != "text/csv" || info.Parts[1].Filename != "report.csv" {
+		t.Errorf("Invalid parts %+v", info.Parts)
+	}
+}
+
+func TestBoundaryCollision(t *testing.T) {
+	defer func(f func() (string, error)) { newBoundary = f }(newBoundary)
+
+	boundaries := []string{"collision", "collision", "unique"}
+
+	newBoundary = func() (string, error) {
+		b := boundaries[0]
+		boundaries = boundaries[1:]
+
+		return b, nil
+	}
+
+	mt := NewMultipartMixedMessage()
+	mt.SetText(TextPlain, []byte("--collision"))
+
+	m := NewMail(&MailConfig{Encoding: SevenBit})
+	m.To("example1@example.com")
+	m.SetMessage(&mt)
+
+	if len(boundaries) != 0 {
+		t.Fatalf("The boundary should be regenerated twice, %d left", len(boundaries))
+	}
+
+	info, err := m.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := info.Header.Get("Content-Type"); ct != `multipart/mixed; boundary="unique"` {
+		t.Errorf("Invalid content type %s", ct)
+	}
+
+	if len(info.Parts) != 1 || info.Parts[0].Size < len("--collision") {
+		t.Errorf("Invalid parts %+v", info.Parts)
+	}
+}
+
+func TestRandomFailure(t *testing.T) {
+	defer func(r io.Reader) { randReader = r }(randReader)
+
+	randReader = iotest.ErrReader(errors.New("entropy exhausted"))
+
+	check := func(name string, err error) {
+		if err == nil || !strings.Contains(err.Error(), "entropy exhausted") {
+			t.Errorf("%s should fail with the random source error, got %v", name, err)
+		}
+	}
+
+	mt := NewMultipartMixedMessage()
+	mt.SetText(TextPlain, []byte("Hello"))
+
+	mail := NewMail(nil)
+	mail.To("example1@example.com")
+	mail.SetMessage(&mt)
+
+	_, err := mail.Inspect()
+	check("The multipart message", err)
+
+	a := NewAttachment()
+	a.SetAsBinary("logo.png", []byte("logo"))
+
+	_, err = a.SetInlineAuto()
+	check("SetInlineAuto", err)
+
+	rel := NewMultipartRelatedMessage()
+	rel.SetHTML([]byte("<b>Hello</b>"))
+	rel.AddInline(a)
+
+	mail = NewMail(nil)
+	mail.To("example1@example.com")
+	mail.SetMessage(&rel)
+
+	_, err = mail.Inspect()
+	check("The related message", err)
+
+	mail = NewMail(&MailConfig{AddMessageID: true})
+	mail.To("example1@example.com")
+
+	_, err = mail.Inspect()
+	check("Message-ID", err)
+}
+
+func TestAttachmentTextThreshold(t *testing.T) {
+	attachments := map[string][]byte{
+		"small.csv":  []byte("id,name\r\n1,Alex\r\n"),
+		"lf.csv":     []byte("id,name\n1,Alex\n"),
+		"binary.bin": {0x00, 0xff, 0x10},
+		"large.txt":  bytes.Repeat([]byte("a"), 1024),
+	}
+
+	expect := map[string]string{
+		"small.csv":  "7bit",
+		"lf.csv":     "quoted-printable",
+		"binary.bin": "base64",
+		"large.txt":  "base64",
+	}
+
+	for _, threshold := range []int{0, 512} {
+		mail := NewMail(&MailConfig{AttachmentTextThreshold: threshold})
+		mail.To("example1@example.com")
+
+		mt := NewMultipartMixedMessage()
+		mt.SetText(TextPlain, []byte("Hello, World"))
+
+		for _, name := range []string{"small.csv", "lf.csv", "binary.bin", "large.txt"} {
+			a := NewAttachment()
+			a.SetAsBinary(name, attachments[name])
+
+			mt.AddAttachment(a)
+		}
+
+		mail.SetMessage(&mt)
+
+		info, err := mail.Inspect()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, p := range info.Parts[1:] {
+			enc := expect[p.Filename]
+			if threshold == 0 {
+				enc = "base64"
+			}
+
+			if p.Encoding != enc {
+				t.Errorf("Invalid encoding of %s with threshold %d, expect %s, got %s", p.Filename, threshold, enc, p.Encoding)
+			}
+		}
+	}
+}
+
+func TestPlainTextAndHTML(t *testing.T) {
+	tests := []struct {
+		msg   Message
+		ctype string
+		text  string
+	}{
+		{PlainText("Hello, World"), "text/plain", "Hello, World"},
+		{HTML("<b>Hello, World</b>"), "text/html", "<b>Hello, World</b>"},
+	}
+
+	for _, tt := range tests {
+		mail := NewMail(nil)
+		mail.To("example1@example.com")
+		mail.SetMessage(tt.msg)
+
+		info, err := mail.Inspect()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ct := info.Header.Get("Content-Type"); !strings.HasPrefix(ct, tt.ctype+";") {
+			t.Errorf("Invalid content type, expect %s, got %s", tt.ctype, ct)
+		}
+
+		if len(info.Parts) != 1 || info.Parts[0].Size != len(tt.text) {
+			t.Errorf("Invalid content of %s, got %+v", tt.ctype, info.Parts)
+		}
+	}
+}
+
+func TestSetInlineAuto(t *testing.T) {
+	logo, photo := NewAttachment(), NewAttachment()
+	logo.SetAsBinary("logo.png", []byte("logo"))
+	photo.SetAsBinary("photo.jpg", []byte("photo"))
+
+	logoID, err := logo.SetInlineAuto()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	photoID, err := photo.SetInlineAuto()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if logoID == "" || logoID == photoID {
+		t.Fatalf("The content IDs should be unique, got %q and %q", logoID, photoID)
+	}
+
+	mt := NewMultipartRelatedMessage()
+	mt.SetHTML([]byte(`<img src="cid:` + logoID + `"><img src="cid:` + photoID + `">`))
+	mt.AddInline(logo)
+	mt.AddInline(photo)
+
+	if err := mt.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	mail := NewMail(nil)
+	mail.To("example1@example.com")
+	mail.SetMessage(&mt)
+
+	raw, err := mail.mb.GetResultMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{logoID, photoID} {
+		if !strings.Contains(string(raw), "Content-ID: <"+id+">\r\n") {
+			t.Errorf("The message should contain the content ID %s", id)
+		}
+	}
+}
+
+func TestBlockedExtensions(t *testing.T) {
+	mailWith := func(cfg *MailConfig, names ...string) *Mail {
+		mail := NewMail(cfg)
+		mail.To("example1@example.com")
+
+		mt := NewMultipartMixedMessage()
+		mt.SetText(TextPlain, []byte("Hello, World"))
+
+		for _, name := range names {
+			a := NewAttachment()
+			a.SetAsBinary(name, []byte("content"))
+			mt.AddAttachment(a)
+		}
+
+		mail.SetMessage(&mt)
+
+		return mail
+	}
+
+	blocklist := &MailConfig{BlockedExtensions: []string{"exe", ".JS", ".tar.gz"}}
+
+	for _, name := range []string{"setup.exe", "SETUP.EXE", "invoice.pdf.exe", "script.js", "backup.tar.gz"} {
+		if _, err := mailWith(blocklist, "report.pdf", name).Inspect(); !errors.Is(err, ErrAttachmentBlocked) {
+			t.Errorf("%s should be blocked, got %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"report.pdf", "exe.txt", "archive.gz", "data.json"} {
+		if _, err := mailWith(blocklist, name).Inspect(); err != nil {
+			t.Errorf("%s should be allowed, got %v", name, err)
+		}
+	}
+
+	allowlist := &MailConfig{AllowedExtensions: []string{".pdf", ".csv"}}
+
+	if _, err := mailWith(allowlist, "report.PDF", "data.csv").Inspect(); err != nil {
+		t.Errorf("Allowed attachments should be sent, got %v", err)
+	}
+
+	if _, err := mailWith(allowlist, "report.pdf", "photo.jpg").Inspect(); !errors.Is(err, ErrAttachmentBlocked) {
+		t.Errorf("An attachment that isn't allowed should be rejected, got %v", err)
+	}
+
+	// Another message replaces the one with the blocked attachment
+	mail := mailWith(blocklist, "setup.exe")
+	mail.SetMessage(PlainText("Hello, World"))
+
+	if _, err := mail.Inspect(); err != nil {
+		t.Errorf("The blocked attachment should not affect the new message, got %v", err)
+	}
+}
+
+func TestAttachedMessage(t *testing.T) {
+	original := "From: spammer@example.net\nTo: example1@example.com\nSubject: Win\n\nClick here\n"
+
+	cases := map[string]string{
+		original: "7bit",
+		strings.Replace(original, "Click here", "Нажмите здесь", 1): "8bit",
+	}
+
+	for raw, enc := range cases {
+		mail := NewMail(nil)
+		mail.To("abuse@example.com")
+
+		a := NewAttachment()
+		a.SetAsMessage("", []byte(raw))
+
+		mt := NewMultipartMixedMessage()
+		mt.SetText(TextPlain, []byte("Reported as spam"))
+		mt.AddAttachment(a)
+
+		mail.SetMessage(&mt)
+
+		info, err := mail.Inspect()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(info.Parts) != 2 {
+			t.Fatalf("Expect 2 parts, got %d", len(info.Parts))
+		}
+
+		p := info.Parts[1]
+
+		if p.ContentType != "message/rfc822" || p.Encoding != enc || p.Filename != "message.eml" {
+			t.Errorf("Invalid attached message part %+v, expect %s encoding", p, enc)
+		}
+
+		out, _ := mail.mb.GetResultMessage(0)
+
+		if !strings.Contains(string(out), "Content-Disposition: attachment; filename=message.eml\r\n") {
+			t.Error("The message should be attached")
+		}
+
+		if !strings.Contains(string(out), strings.ReplaceAll(raw, "\n", "\r\n")) {
+			t.Error("The attached message should not be encoded")
+		}
+	}
+}
+
+func TestMultipartReport(t *testing.T) {
+	mail := NewMail(nil)
+	mail.To("sender@example.com")
+
+	mt := NewMultipartReportMessage(DeliveryStatus)
+	mt.SetText([]byte("Your message could not be delivered"))
+	mt.SetReport([]byte("Reporting-MTA: dns; mx.example.com\n\nFinal-Recipient: rfc822; nobody@example.com\nAction: failed\nStatus: 5.1.1\n"))
+	mt.SetOriginal([]byte("From: sender@example.com\nTo: nobody@example.com\nSubject: Hi\n\nHello\n"))
+
+	mail.SetMessage(&mt)
+
+	info, err := mail.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := info.Header.Get("Content-Type"); !strings.HasPrefix(ct, "multipart/report; report-type=delivery-status;") {
+		t.Errorf("Invalid content type %q", ct)
+	}
+
+	expect := []string{"text/plain", "message/delivery-status", "message/rfc822"}
+
+	if len(info.Parts) != len(expect) {
+		t.Fatalf("Expect %d parts, got %d", len(expect), len(info.Parts))
+	}
+
+	for i, p := range info.Parts {
+		if p.ContentType != expect[i] || (i != 0 && p.Encoding != "7bit") {
+			t.Errorf("Invalid part %d, expect %s, got %+v", i, expect[i], p)
+		}
+	}
+
+	out, _ := mail.mb.GetResultMessage(0)
+
+	if !strings.Contains(string(out), "\r\n\r\nReporting-MTA: dns; mx.example.com\r\n\r\nFinal-Recipient: rfc822; nobody@example.com\r\n") {
+		t.Error("The report fields should be sent as is")
+	}
+
+	mt = NewMultipartReportMessage(DispositionNotification)
+	mt.SetText([]byte("Displayed"))
+	mail.SetMessage(&mt)
+
+	if _, err := mail.mb.GetResultMessage(0); err == nil {
+		t.Error("An empty report should be rejected")
+	}
+}
+
+func TestMixedMessageGolden(t *testing.T) {
+	defer func(f func() (string, error)) { newBoundary = f }(newBoundary)
+
+	newBoundary = func() (string, error) {
+		return "b1", nil
+	}
+
+	mail := NewMail(&MailConfig{Encoding: QuotedPrintable, MessageIDFunc: func() string { return "1@example.com" }})
+	mail.SetDate(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	mail.SetFrom("Sender", "sender@example.com")
+	mail.To("rcpt@example.com")
+	mail.SetSubject("Report")
+
+	// The attachment would be corrupted by quoted-printable
+	a := NewAttachment()
+	a.SetAsBinary("report.bin", []byte{0x00, 0xff, '=', '\r', '\n', 0x10, 0x80})
+
+	mt := NewMultipartMixedMessage()
+	mt.SetText(TextPlain, []byte("Привет, мир!\nSee the attachment"))
+	mt.AddAttachment(a)
+
+	mail.SetMessage(&mt)
+
+	out, err := mail.mb.GetResultMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "Date:Wed, 01 May 2024 12:00:00 +0000\r\n" +
+		"Subject:Report\r\n" +
+		"From:Sender <sender@example.com>\r\n" +
+		"To:<rcpt@example.com>\r\n" +
+		"Message-ID: <1@example.com>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"=D0=9F=D1=80=D0=B8=D0=B2=D0=B5=D1=82, =D0=BC=D0=B8=D1=80!\r\n" +
+		"See the attachment\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=report.bin\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"AP89DQoQgA==\r\n" +
+		"\r\n" +
+		"--b1--\r\n"
+
+	if string(out) != expect {
+		t.Errorf("Invalid mixed message, expect:\n%q\ngot:\n%q", expect, out)
+	}
+}
+
+func TestMultipartReportHeaders(t *testing.T) {
+	mail := NewMail(nil)
+	mail.To("sender@example.com")
+
+	mt := NewMultipartReportMessage(DeliveryStatus)
+	mt.SetText([]byte("Your message could not be delivered"))
+	mt.SetReport([]byte("Reporting-MTA: dns; mx.example.com\n\nFinal-Recipient: rfc822; nobody@example.com\nAction: failed\nStatus: 5.1.1\n"))
+	mt.SetOriginalHeaders([]byte("From: sender@example.com\nTo: nobody@example.com\nSubject: Hi\n\nSecret body\n"))
+
+	mail.SetMessage(&mt)
+
+	info, err := mail.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(info.Parts) != 3 || info.Parts[2].ContentType != "text/rfc822-headers" {
+		t.Fatalf("The original header should be sent as text/rfc822-headers, got %+v", info.Parts)
+	}
+
+	out, _ := mail.mb.GetResultMessage(0)
+
+	if !strings.Contains(string(out), "\r\n\r\nFrom: sender@example.com\r\nTo: nobody@example.com\r\nSubject: Hi\r\n\r\n--") {
+		t.Errorf("The original header should be sent as is, got %q", out)
+	}
+
+	if strings.Contains(string(out), "Secret body") {
+		t.Error("The original body should not be returned")
+	}
+}
+
+func TestSmallAttachments(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 56, 57, 58, 75, 76, 77, 200} {
+		content := bytes.Repeat([]byte{0xff, 0x00, 0x80}, n)[:n]
+
+		a := NewAttachment()
+		a.SetAsBinary("small.bin", content)
+
+		mt := NewMultipartMixedMessage()
+		mt.SetText(TextPlain, []byte("See the attachment"))
+		mt.AddAttachment(a)
+
+		m := NewMail(nil)
+		m.To("rcpt@example.com")
+		m.SetMessage(&mt)
+
+		out, err := m.mb.GetResultMessage(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.HasSuffix(out, []byte("--\r\n")) {
+			t.Errorf("%d bytes: the message should end with the closing delimiter and CRLF, got %q", n, out[len(out)-8:])
+		}
+
+		if bytes.Contains(bytes.ReplaceAll(out, []byte("\r\n"), nil), []byte("\n")) {
+			t.Errorf("%d bytes: the message contains bare LF", n)
+		}
+
+		for _, line := range strings.Split(string(out), "\r\n") {
+			if strings.TrimRight(line, " \t") != line || len(line) > lineLengthLimit {
+				t.Errorf("%d bytes: invalid line %q", n, line)
+			}
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		r := multipart.NewReader(msg.Body, params["boundary"])
+
+		r.NextRawPart()
+
+		p, err := r.NextRawPart()
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+
+		if enc := p.Header.Get("Content-Transfer-Encoding"); enc != "base64" {
+			t.Errorf("%d bytes: expected base64 encoding, got %q", n, enc)
+		}
+
+		got, err := io.ReadAll(transferDecoder(p, "base64"))
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%d bytes: the attachment is corrupted, got %x (%v)", n, got, err)
+		}
+
+		if _, err := r.NextRawPart(); err != io.EOF {
+			t.Errorf("%d bytes: expected the end of the message, got %v", n, err)
+		}
+	}
+}
@@ -5,38 +5,146 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"mime"
 	"mime/quotedprintable"
+	"net/mail"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // RFC 5322 2.2.3
 const lineLengthLimit = 76
 
+// undisclosedRecipients is an empty group used as the To field
+// if the mail has only Cc or Bcc recipients
+const undisclosedRecipients = "undisclosed-recipients:;"
+
 type mimeBuilder struct {
 	charset     charset
 	encoding    encoding
 	encoder     mime.WordEncoder
 	contentType contentType
 	header      map[string]string
+
+	// needsMIME is false only if the message explicitly
+	// declares that it doesn't need the MIME-Version header
+	needsMIME bool
+
+	// date is a value of the Date field set explicitly. If it's
+	// zero, the time of assembling the message is used instead
+	date time.Time
+
+	// omitDate disables the Date field, so it
+	// may be set by an upstream system instead
+	omitDate bool
+
+	// fields contains additional header fields in order they were set
+	fields []headerField
+
+	logger Logger
+
+	// maxSubjectLen is a maximum number of characters
+	// in the subject. Zero value means no limit
+	maxSubjectLen int
+
+	// boundary is the boundary of the top-level multipart
+	// content set explicitly. If it's empty, it's generated
+	boundary string
+
+	// urlSafeTokens makes token header fields use
+	// the URL-safe base64 alphabet without padding
+	urlSafeTokens bool
+
+	// mailer is a value of the X-Mailer field if the mail doesn't set it
+	mailer string
+
+	// fromAddr is the author address, its domain is used in Message-ID
+	fromAddr string
+
+	// fromName is a policy of the empty From display name
+	fromName fromNamePolicy
+
+	// addMessageID makes the message have the Message-ID field
+	addMessageID bool
+
+	// messageID generates the Message-ID field. If it's nil, newMessageID is used
+	messageID func() string
+
+	// base64Width is a length of base64 body lines
+	base64Width int
+
+	// qpWidth is a maximum length of quoted-printable body lines
+	qpWidth int
+
+	// attachmentThreshold is a size below which text attachments aren't base64 encoded
+	attachmentThreshold int
+
+	// blockedExts and allowedExts restrict attachment extensions.
+	// They are lowercase and start with a dot
+	blockedExts []string
+	allowedExts []string
+
+	// maxAttachmentSize is a maximum size of an attachment content
+	maxAttachmentSize int64
+
+	// err is a configuration error reported when the message is assembled
+	err error
+
+	// msgErr is an error of the message content (e.g. a blocked attachment)
+	msgErr error
+
+	// subjectErr is an error of the last subject set by Mail.SetSubject
+	subjectErr error
+
+	// content is the formatted message set by SetMessage
+	content []segment
+}
+
+type headerField struct {
+	name  string
+	value string
 }
 
 func newMimeBuilder(charset charset, encoding encoding) *mimeBuilder {
 	mb := &mimeBuilder{
-		charset:  charset,
-		encoding: encoding,
-		header:   make(map[string]string),
+		header:      make(map[string]string),
+		needsMIME:   true,
+		base64Width: lineLengthLimit,
+		qpWidth:     lineLengthLimit,
 	}
 
+	mb.setEncoding(charset, encoding)
+
+	return mb
+}
+
+// setEncoding sets the charset and the encoding of the message. Header
+// fields use the B encoding if the body is base64 encoded, Q otherwise
+func (m *mimeBuilder) setEncoding(charset charset, encoding encoding) {
+	m.charset = charset
+	m.encoding = encoding
+
 	switch encoding {
-	case QuotedPrintable:
-		mb.encoder = mime.QEncoding
 	case Base64:
-		mb.encoder = mime.BEncoding
+		m.encoder = mime.BEncoding
+	default:
+		m.encoder = mime.QEncoding
 	}
+}
 
-	return mb
+func (m *mimeBuilder) clone() *mimeBuilder {
+	c := *m
+
+	c.header = make(map[string]string, len(m.header))
+	for k, v := range m.header {
+		c.header[k] = v
+	}
+
+	c.fields = append([]headerField(nil), m.fields...)
+
+	return &c
 }
 
 func (m *mimeBuilder) EncodeHeader(value string) string {
@@ -59,73 +167,431 @@ func (m *mimeBuilder) EncodeBody(body []byte) string {
 	switch m.encoding {
 	case Base64:
 		{
-			out = base64Encode(body)
+			out = base64Encode(body, m.base64Width)
 		}
 	case QuotedPrintable:
 		{
-			if m, err := qpEncode(body); err != nil {
+			if m, err := qpEncode(body, m.qpWidth); err != nil {
 				out = string(body)
 			} else {
 				out = m
 			}
 		}
+	case SevenBit, Binary:
+		{
+			out = string(body)
+		}
 	}
 
 	return out
 }
 
-func (m *mimeBuilder) SetFieldSubject(subj string) {
-	m.header["subject"] = m.EncodeHeader(subj)
+// EncodeAttachment encodes the attachment content and returns the encoding
+// used. Attachments are base64 encoded whatever encoding the text uses
+// (quoted-printable and 7bit would break binary files), unless the mail
+// is binary. Text attachments smaller than the threshold are sent as 7bit
+// if possible, otherwise quoted-printable keeping the line breaks intact
+func (m *mimeBuilder) EncodeAttachment(body []byte) (encoding, string) {
+	switch enc := m.attachmentEncoding(body); enc {
+	case Base64:
+		return enc, base64Encode(body, m.base64Width)
+	case Binary, SevenBit:
+		return enc, string(body)
+	}
+
+	var out bytes.Buffer
+
+	qp := quotedprintable.NewWriter(&out)
+	qp.Binary = true
+
+	qp.Write(body)
+	qp.Close()
+
+	return QuotedPrintable, out.String()
+}
+
+// attachmentEncoding returns the encoding of the attachment content
+// (see EncodeAttachment)
+func (m *mimeBuilder) attachmentEncoding(body []byte) encoding {
+	if len(body) >= m.attachmentThreshold || !isASCIIText(body) {
+		if m.encoding == Binary {
+			return Binary
+		}
+
+		return Base64
+	}
+
+	if isSevenBit(body) {
+		return SevenBit
+	}
+
+	return QuotedPrintable
+}
+
+// SetFieldSubject sets the Subject field. A long subject is folded
+// between the encoded-words (or the words if it isn't encoded), so
+// every word stays valid and the lines are short
+func (m *mimeBuilder) SetFieldSubject(subj string) error {
+	if n := utf8.RuneCountInString(subj); m.maxSubjectLen > 0 && n > m.maxSubjectLen {
+		return fmt.Errorf("wail: subject is too long (%d chars), max length is %d", n, m.maxSubjectLen)
+	}
+
+	if len(subj) != 0 {
+		subj = m.encoder.Encode(string(m.charset), subj)
+	}
+
+	words := strings.Split(subj, " ")
+
+	// The field name and a long encoded-word don't fit
+	// into a line, so the value starts on the next one
+	if len("Subject:")+len(words[0]) > lineLengthLimit {
+		words = append([]string{""}, words...)
+	}
+
+	m.header["subject"] = foldList(words, " ", len("Subject"))
+	return nil
 }
 
 func (m *mimeBuilder) SetFieldFrom(name string, addr string) {
+	m.fromAddr = addr
+
+	if name == "" && m.fromName != FromNameAsIs {
+		if local, _, ok := strings.Cut(addr, "@"); ok {
+			name = local
+		}
+	}
+
 	if len(name) == 0 {
 		m.header["from"] = addr
 	} else {
-		m.header["from"] = fmt.Sprintf("%s <%s>", m.EncodeHeader(name), addr)
+		m.header["from"] = fmt.Sprintf("%s <%s>", m.encodeDisplayName(name), addr)
+	}
+}
+
+// encodeDisplayName encodes a non-ASCII display name and quotes
+// an ASCII one if it contains specials (RFC 5322 3.2.3)
+func (m *mimeBuilder) encodeDisplayName(name string) string {
+	specials := strings.ContainsAny(name, "()<>[]:;@\\,.\"")
+
+	for i := 0; i < len(name); i++ {
+		if name[i] >= utf8.RuneSelf {
+			// Q encoding leaves specials as is, which is not allowed
+			// in a phrase (RFC 2047 5), so B encoding is used instead
+			if !specials || m.encoder != mime.QEncoding {
+				return m.EncodeHeader(name)
+			}
+
+			out := mime.BEncoding.Encode(string(m.charset), name)
+			if len(out) > lineLengthLimit {
+				out = splitHeader(out)
+			}
+
+			return out
+		}
+	}
+
+	if !specials {
+		return name
+	}
+
+	r := strings.NewReplacer("\\", "\\\\", "\"", "\\\"")
+
+	return "\"" + r.Replace(name) + "\""
+}
+
+// encodeToken encodes the payload of a token header field
+func (m *mimeBuilder) encodeToken(payload []byte) string {
+	if m.urlSafeTokens {
+		return base64.RawURLEncoding.EncodeToString(payload)
 	}
+
+	return base64.StdEncoding.EncodeToString(payload)
 }
 
-func (m *mimeBuilder) SetFieldTo(addr ...string) {
+// SetFieldSender sets the Sender field. An empty address removes the field
+func (m *mimeBuilder) SetFieldSender(addr string) {
+	if len(addr) == 0 {
+		delete(m.header, "sender")
+	} else {
+		m.header["sender"] = "<" + addr + ">"
+	}
+}
+
+// formatAddrList formats the addresses as an address list field value.
+// Display names are encoded and quoted like the From one
+func (m *mimeBuilder) formatAddrList(field string, addrs []*mail.Address) string {
+	items := make([]string, 0, len(addrs))
+	named := false
+
+	for _, a := range addrs {
+		if a.Name == "" {
+			items = append(items, a.Address)
+			continue
+		}
+
+		named = true
+		items = append(items, m.encodeDisplayName(a.Name)+" <"+a.Address+">")
+	}
+
+	if !named {
+		return makeAddrString(items)
+	}
+
+	for i, a := range addrs {
+		if a.Name == "" {
+			items[i] = "<" + a.Address + ">"
+		}
+	}
+
+	return foldList(items, ", ", len(field)+1)
+}
+
+func (m *mimeBuilder) SetFieldTo(addr ...*mail.Address) {
 	if len(addr) == 0 {
 		return
 	}
 
-	m.header["to"] = makeAddrString(addr)
+	m.header["to"] = m.formatAddrList("To", addr)
 }
 
-func (m *mimeBuilder) SetFieldCc(addr ...string) {
+func (m *mimeBuilder) SetFieldCc(addr ...*mail.Address) {
 	if len(addr) == 0 {
 		return
 	}
 
-	m.header["cc"] = makeAddrString(addr)
+	m.header["cc"] = m.formatAddrList("Cc", addr)
 }
 
-func (m *mimeBuilder) SetFieldBcc(addr ...string) {
+func (m *mimeBuilder) SetFieldBcc(addr ...*mail.Address) {
 	if len(addr) == 0 {
 		return
 	}
 
-	m.header["bcc"] = makeAddrString(addr)
+	m.header["bcc"] = m.formatAddrList("Bcc", addr)
+}
+
+// SetField sets an additional header field. The value must be already
+// encoded and folded. An empty value removes the field
+func (m *mimeBuilder) SetField(name, value string) {
+	for i, f := range m.fields {
+		if strings.EqualFold(f.name, name) {
+			if len(value) == 0 {
+				m.fields = append(m.fields[:i], m.fields[i+1:]...)
+			} else {
+				m.fields[i].value = value
+			}
+
+			return
+		}
+	}
+
+	if len(value) != 0 {
+		m.fields = append(m.fields, headerField{name: name, value: value})
+	}
+}
+
+// getField returns a value of the additional header field
+func (m *mimeBuilder) getField(name string) string {
+	for _, f := range m.fields {
+		if strings.EqualFold(f.name, name) {
+			return f.value
+		}
+	}
+
+	return ""
+}
+
+func (m *mimeBuilder) hasField(name string) bool {
+	for _, f := range m.fields {
+		if strings.EqualFold(f.name, name) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (m *mimeBuilder) SetMessage(msg Message) {
+	m.needsMIME = true
+
+	if d, ok := msg.(mimeDeclarer); ok {
+		m.needsMIME = d.NeedsMIME()
+	}
+
+	m.msgErr = nil
 	m.contentType = msg.GetContentType()
-	m.header[m.contentType.string()] = msg.GetContent(m)
+
+	content := contentSegments(msg, m)
+	if m.boundary != "" {
+		content = m.replaceBoundary(content)
+	}
+
+	m.content = content
+}
+
+// replaceBoundary replaces the generated boundary of the top-level
+// multipart content with the one set explicitly. Nested multipart
+// contents keep their own boundaries. The base64 segments can't
+// contain a boundary, so only the text ones are changed
+func (m *mimeBuilder) replaceBoundary(content []segment) []segment {
+	if len(content) == 0 || content[0].base64 {
+		return content
+	}
+
+	line, _, _ := bytes.Cut(content[0].data, []byte("\r\n"))
+
+	mediaType, params, err := mime.ParseMediaType(strings.TrimPrefix(string(line), "Content-Type: "))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return content
+	}
+
+	if collides(m.boundary, content) {
+		if m.msgErr == nil {
+			m.msgErr = fmt.Errorf("wail: boundary %q occurs in the message content", m.boundary)
+		}
+
+		return content
+	}
+
+	old := params["boundary"]
+	out := make([]segment, len(content))
+
+	for i, seg := range content {
+		if seg.base64 {
+			out[i] = seg
+			continue
+		}
+
+		text := string(seg.data)
+		if i == 0 {
+			text = strings.Replace(text, "boundary=\""+old+"\"", "boundary=\""+m.boundary+"\"", 1)
+		}
+
+		out[i] = segment{data: []byte(strings.ReplaceAll(text, "--"+old, "--"+m.boundary))}
+	}
+
+	return out
+}
+
+// checkAttachment reports the attachment with a blocked extension
+// or a too large one when the message is assembled
+func (m *mimeBuilder) checkAttachment(name string, size int) {
+	if m.msgErr != nil {
+		return
+	}
+
+	if m.maxAttachmentSize > 0 && int64(size) > m.maxAttachmentSize {
+		m.msgErr = fmt.Errorf("%w: %s", ErrAttachmentTooLarge, name)
+		return
+	}
+
+	if len(m.blockedExts) == 0 && len(m.allowedExts) == 0 {
+		return
+	}
+
+	name = strings.ToLower(name)
+
+	for _, ext := range m.blockedExts {
+		if strings.HasSuffix(name, ext) {
+			m.msgErr = fmt.Errorf("%w: %s (%s)", ErrAttachmentBlocked, name, ext)
+			return
+		}
+	}
+
+	if len(m.allowedExts) == 0 {
+		return
+	}
+
+	for _, ext := range m.allowedExts {
+		if strings.HasSuffix(name, ext) {
+			return
+		}
+	}
+
+	m.msgErr = fmt.Errorf("%w: %s", ErrAttachmentBlocked, name)
+}
+
+// normalizeExtensions makes the extensions lowercase and starting with a dot
+func normalizeExtensions(exts []string) []string {
+	out := make([]string, 0, len(exts))
+
+	for _, ext := range exts {
+		if ext = strings.ToLower(strings.TrimSpace(ext)); ext == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+
+		out = append(out, ext)
+	}
+
+	return out
+}
+
+func (m *mimeBuilder) SetFieldDate(date time.Time) {
+	m.date = date
 }
 
+// GetResultMessage assembles the message. The message is never cached,
+// so unless the date was set explicitly the Date field always reflects
+// the moment GetResultMessage is called (i.e. the moment of sending)
 func (m *mimeBuilder) GetResultMessage(maxMsgSize uint) ([]byte, error) {
+	msg, err := m.assemble(maxMsgSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.Bytes(), nil
+}
+
+// assemble is like GetResultMessage, but the base64 encoded attachments
+// are encoded only when the assembled message is written
+func (m *mimeBuilder) assemble(maxMsgSize uint) (*message, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	if m.msgErr != nil {
+		return nil, m.msgErr
+	}
+
+	if m.subjectErr != nil {
+		return nil, m.subjectErr
+	}
+
 	to, ok := m.header["to"]
 	if !ok {
-		return nil, errors.New("wail: field 'To' doesn't provided")
+		_, cc := m.header["cc"]
+		_, bcc := m.header["bcc"]
+
+		if !cc && !bcc {
+			return nil, errors.New("wail: neither 'To' nor 'Cc' or 'Bcc' field provided")
+		}
+
+		// The mail is sent to Cc or Bcc recipients only (RFC 5322 A.1.3)
+		to = undisclosedRecipients
 	}
 
-	date := time.Now().Format(time.RFC1123Z)
+	var out string
+
+	if !m.omitDate {
+		date := m.date
+		if date.IsZero() {
+			date = time.Now()
+		}
+
+		out += fmt.Sprintf("Date:%s\r\n", date.Format(time.RFC1123Z))
+	}
 
-	out := fmt.Sprintf("Date:%s\r\n", date)
 	out += fmt.Sprintf("Subject:%s\r\n", m.header["subject"])
 	out += fmt.Sprintf("From:%s\r\n", m.header["from"])
+
+	if sender, ok := m.header["sender"]; ok {
+		out += fmt.Sprintf("Sender:%s\r\n", sender)
+	}
+
 	out += fmt.Sprintf("To:%s\r\n", to)
 
 	if cc, ok := m.header["cc"]; ok {
@@ -136,19 +602,76 @@ func (m *mimeBuilder) GetResultMessage(maxMsgSize uint) ([]byte, error) {
 		out += fmt.Sprintf("Bcc:%s\r\n", bcc)
 	}
 
-	out += "MIME-Version: 1.0\r\n"
+	if m.addMessageID {
+		id, err := m.newMessageID()
+		if err != nil {
+			return nil, err
+		}
 
-	if ct, ok := m.header[m.contentType.string()]; ok {
-		out += ct + "\r\n"
+		out += fmt.Sprintf("Message-ID: %s\r\n", id)
 	}
 
-	if maxMsgSize != 0 && uint(len(out)) > maxMsgSize {
+	for _, f := range m.fields {
+		out += fmt.Sprintf("%s: %s\r\n", f.name, f.value)
+	}
+
+	if m.mailer != "" && !m.hasField("X-Mailer") {
+		out += fmt.Sprintf("X-Mailer: %s\r\n", m.EncodeHeader(m.mailer))
+	}
+
+	// A 7bit message which doesn't declare any MIME features
+	// is a plain RFC 5322 message and doesn't need MIME-Version
+	if m.needsMIME || m.encoding != SevenBit {
+		out += "MIME-Version: 1.0\r\n"
+	}
+
+	msg := &message{
+		segments: appendText(nil, out),
+		width:    m.base64Width,
+	}
+
+	if m.content != nil {
+		msg.segments = appendText(append(msg.segments, m.content...), "\r\n")
+	}
+
+	if maxMsgSize != 0 && uint64(msg.Len()) > uint64(maxMsgSize) {
 		return nil, fmt.Errorf("wail: a max message size (%d) that the server can accept has been exceeded", maxMsgSize)
 	}
 
-	h := make([]byte, 0, len(out))
+	return msg, nil
+}
+
+// newMessageID returns a value of the Message-ID field
+func (m *mimeBuilder) newMessageID() (string, error) {
+	var id string
+
+	if m.messageID != nil {
+		id = strings.TrimSpace(m.messageID())
+	}
+
+	if id == "" {
+		domain := "localhost"
+		if _, d, ok := strings.Cut(m.fromAddr, "@"); ok && d != "" {
+			domain = d
+		}
+
+		random, err := randomHex(8)
+		if err != nil {
+			return "", err
+		}
 
-	return append(h, []byte(out)...), nil
+		id = fmt.Sprintf("%d.%s@%s", time.Now().UnixNano(), random, domain)
+	}
+
+	if !strings.HasPrefix(id, "<") {
+		id = "<" + id
+	}
+
+	if !strings.HasSuffix(id, ">") {
+		id += ">"
+	}
+
+	return id, nil
 }
 
 func splitHeader(header string) string {
@@ -197,23 +720,218 @@ func split(s string) []string {
 	return out
 }
 
-func base64Encode(text []byte) string {
-	out := base64.StdEncoding.EncodeToString(text)
+// base64Encode encodes the text wrapping lines at width chars
+func base64Encode(text []byte, width int) string {
+	var out strings.Builder
 
-	if len(out) > lineLengthLimit {
-		out = strings.Join(split(out), "\r\n")
+	n := base64.StdEncoding.EncodedLen(len(text))
+	out.Grow(n + n/width*2)
+
+	base64EncodeTo(&out, text, width)
+
+	return out.String()
+}
+
+// base64EncodeTo streams the base64 encoded text to w wrapping lines at
+// width chars, so the whole encoded text is never held in memory
+func base64EncodeTo(w io.Writer, text []byte, width int) error {
+	enc := base64.NewEncoder(base64.StdEncoding, &lineWriter{w: w, width: width})
+
+	if _, err := enc.Write(text); err != nil {
+		return err
 	}
 
-	return out
+	return enc.Close()
+}
+
+// lineWriter breaks the written text into lines of width chars separated
+// by CRLF. There is no line break after the last line
+type lineWriter struct {
+	w     io.Writer
+	width int
+	col   int
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	n := 0
+
+	for len(p) != 0 {
+		if l.col == l.width {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return n, err
+			}
+
+			l.col = 0
+		}
+
+		chunk := p
+		if len(chunk) > l.width-l.col {
+			chunk = chunk[:l.width-l.col]
+		}
+
+		written, err := l.w.Write(chunk)
+		n += written
+		l.col += written
+
+		if err != nil {
+			return n, err
+		}
+
+		p = p[len(chunk):]
+	}
+
+	return n, nil
+}
+
+// segment is a piece of the formatted message. The data of a base64
+// segment is encoded only when the message is written, so the encoded
+// attachment is never held in memory
+type segment struct {
+	data   []byte
+	base64 bool
+}
+
+// appendText appends the text to the segments. It's merged into the last
+// segment if it's a text one. The data is copied, so the segments
+// appended to are never changed
+func appendText(segs []segment, text string) []segment {
+	if n := len(segs); n != 0 && !segs[n-1].base64 {
+		last := segs[n-1].data
+
+		data := make([]byte, 0, len(last)+len(text))
+		data = append(append(data, last...), text...)
+
+		return append(segs[:n-1:n-1], segment{data: data})
+	}
+
+	return append(segs, segment{data: []byte(text)})
+}
+
+// appendSegments appends the segments merging the adjacent text ones
+func appendSegments(segs []segment, more ...segment) []segment {
+	for _, seg := range more {
+		if seg.base64 {
+			segs = append(segs, seg)
+		} else {
+			segs = appendText(segs, string(seg.data))
+		}
+	}
+
+	return segs
 }
 
-func qpEncode(text []byte) (string, error) {
-	qp := quotedprintable.NewWriter(&bytes.Buffer{})
+// segmentsLen returns the size of the written segments
+func segmentsLen(segs []segment, width int) int64 {
+	var n int64
 
-	out := make([]byte, len(text))
-	copy(out, text)
+	for _, seg := range segs {
+		if !seg.base64 {
+			n += int64(len(seg.data))
+			continue
+		}
+
+		// Lines are separated by CRLF, there is no line break after the last one
+		enc := int64(base64.StdEncoding.EncodedLen(len(seg.data)))
+		if enc != 0 {
+			n += enc + (enc-1)/int64(width)*2
+		}
+	}
+
+	return n
+}
 
-	if _, err := qp.Write(out); err != nil {
+// joinSegments returns the written segments as the text
+func joinSegments(segs []segment, width int) string {
+	var out strings.Builder
+
+	out.Grow(int(segmentsLen(segs, width)))
+	writeSegments(&out, segs, width)
+
+	return out.String()
+}
+
+// writeSegments writes the segments to w encoding the base64 ones on the fly
+func writeSegments(w io.Writer, segs []segment, width int) error {
+	for _, seg := range segs {
+		var err error
+
+		if seg.base64 {
+			err = base64EncodeTo(w, seg.data, width)
+		} else {
+			_, err = w.Write(seg.data)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// message is an assembled message. Its attachments are base64
+// encoded while the message is written (see WriteTo)
+type message struct {
+	segments []segment
+
+	// width is a length of base64 lines
+	width int
+}
+
+// rawMessage returns the message sent as is
+func rawMessage(raw []byte) *message {
+	return &message{segments: []segment{{data: raw}}}
+}
+
+// Len returns the size of the message
+func (msg *message) Len() int64 {
+	return segmentsLen(msg.segments, msg.width)
+}
+
+// WriteTo writes the message to w. The attachments are encoded straight
+// into w, so they are read only as fast as w accepts the data
+func (msg *message) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := writeSegments(cw, msg.segments, msg.width)
+
+	return cw.n, err
+}
+
+// Bytes returns the message as a whole
+func (msg *message) Bytes() []byte {
+	if len(msg.segments) == 1 && !msg.segments[0].base64 {
+		return msg.segments[0].data
+	}
+
+	var out bytes.Buffer
+
+	out.Grow(int(msg.Len()))
+	writeSegments(&out, msg.segments, msg.width)
+
+	return out.Bytes()
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// qpEncode encodes the text with quoted-printable
+// encoding wrapping lines at width chars
+func qpEncode(text []byte, width int) (string, error) {
+	var out bytes.Buffer
+
+	qp := quotedprintable.NewWriter(&out)
+
+	if _, err := qp.Write(text); err != nil {
 		return "", err
 	}
 
@@ -221,7 +939,135 @@ func qpEncode(text []byte) (string, error) {
 		return "", err
 	}
 
-	return string(out), nil
+	if width >= lineLengthLimit {
+		return out.String(), nil
+	}
+
+	return qpWrap(out.String(), width), nil
+}
+
+// qpWrap rewraps the quoted-printable text so that lines including
+// the soft line break don't exceed width chars. Encoded chars (=XX)
+// are never split
+func qpWrap(encoded string, width int) string {
+	lines := strings.Split(strings.ReplaceAll(encoded, "=\r\n", ""), "\r\n")
+
+	var out strings.Builder
+
+	for i, line := range lines {
+		if i != 0 {
+			out.WriteString("\r\n")
+		}
+
+		for len(line) > width {
+			n := width - 1
+
+			// Move the break before an encoded char it would split
+			if j := strings.LastIndexByte(line[:n], '='); j != -1 && j > n-3 {
+				n = j
+			}
+
+			out.WriteString(line[:n])
+			out.WriteString("=\r\n")
+			line = line[n:]
+		}
+
+		out.WriteString(line)
+	}
+
+	return out.String()
+}
+
+// isASCIIText reports whether the text consists of
+// printable US-ASCII chars, tabs and line breaks only
+func isASCIIText(text []byte) bool {
+	for _, c := range text {
+		if (c < ' ' || c > '~') && c != '\t' && c != '\r' && c != '\n' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isSevenBit reports whether the ASCII text may be sent as 7bit as is:
+// lines end with CRLF and are shorter than 998 chars (RFC 5322 2.1.1)
+func isSevenBit(text []byte) bool {
+	for _, line := range bytes.Split(text, []byte("\r\n")) {
+		if len(line) > 998 || bytes.ContainsAny(line, "\r\n") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// normalizeNewlines replaces bare LF and bare CR with CRLF
+// since SMTP requires text lines to end with CRLF
+func normalizeNewlines(text []byte) []byte {
+	if !bytes.ContainsAny(text, "\r\n") {
+		return text
+	}
+
+	out := make([]byte, 0, len(text)+len(text)/32)
+
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; c {
+		case '\r':
+			out = append(out, '\r', '\n')
+
+			if i+1 < len(text) && text[i+1] == '\n' {
+				i++
+			}
+		case '\n':
+			out = append(out, '\r', '\n')
+		default:
+			out = append(out, c)
+		}
+	}
+
+	return out
+}
+
+// transferDecoder returns a reader that decodes
+// the content encoded with the specified encoding
+func transferDecoder(r io.Reader, enc string) io.Reader {
+	switch encoding(strings.ToLower(enc)) {
+	case Base64:
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case QuotedPrintable:
+		return quotedprintable.NewReader(r)
+	}
+
+	return r
+}
+
+// foldList joins the items with the separator and folds the result so
+// that lines don't exceed the line length limit. The items themselves
+// are never split. offset is a length of the field name with the colon
+func foldList(items []string, sep string, offset int) string {
+	var out strings.Builder
+
+	lineLen := offset + 1
+
+	for i, item := range items {
+		if i != 0 {
+			if lineLen+len(sep)+len(item) > lineLengthLimit {
+				// Don't leave trailing whitespace before the line break
+				out.WriteString(strings.TrimRight(sep, " "))
+				out.WriteString("\r\n ")
+				lineLen = 1
+			} else {
+				out.WriteString(sep)
+				lineLen += len(sep)
+			}
+		}
+
+		out.WriteString(item)
+		lineLen += len(item)
+	}
+
+	return out.String()
 }
 
 func makeAddrString(addr []string) string {
@@ -1,8 +1,13 @@
 package wail
 
 import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
 	"strings"
 	"testing"
+	"time"
 )
 
 var emails = []string{
@@ -66,3 +71,261 @@ func TestSplit(t *testing.T) {
 		t.Errorf("Invalid split result, expect %s, got %s", expect, s)
 	}
 }
+
+func TestMIMEVersion(t *testing.T) {
+	mail := NewMail(&MailConfig{Charset: US_ASCII, Encoding: SevenBit})
+	mail.To("example1@example.com")
+
+	mt := NewTextMessage()
+	mt.Set(TextPlain, []byte("Hello, World"))
+
+	mail.SetMessage(&mt)
+
+	out, err := mail.mb.GetResultMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(out), "MIME-Version") {
+		t.Error("A plain 7bit message should not contain the MIME-Version header")
+	}
+
+	if !strings.HasSuffix(string(out), "\r\n\r\nHello, World\r\n") {
+		t.Errorf("Invalid 7bit message body, got %q", out)
+	}
+
+	mt.Set(TextPlain, []byte("Привет, мир"))
+	mail.SetMessage(&mt)
+
+	if out, _ := mail.mb.GetResultMessage(0); !strings.Contains(string(out), "MIME-Version: 1.0\r\n") {
+		t.Error("A non-ASCII message should contain the MIME-Version header")
+	}
+
+	mail = NewMail(nil)
+	mail.To("example1@example.com")
+
+	mt.Set(TextPlain, []byte("Hello, World"))
+	mail.SetMessage(&mt)
+
+	if out, _ := mail.mb.GetResultMessage(0); !strings.Contains(string(out), "MIME-Version: 1.0\r\n") {
+		t.Error("A base64 encoded message should contain the MIME-Version header")
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	cases := map[string]string{
+		"":                     "",
+		"no line breaks":       "no line breaks",
+		"unix\nlines\n":        "unix\r\nlines\r\n",
+		"mac\rlines\r":         "mac\r\nlines\r\n",
+		"mixed\r\n\n\r\r\nend": "mixed\r\n\r\n\r\n\r\nend",
+	}
+
+	for in, expect := range cases {
+		if out := string(normalizeNewlines([]byte(in))); out != expect {
+			t.Errorf("Invalid normalization of %q, expect %q, got %q", in, expect, out)
+		}
+	}
+}
+
+func TestTextBodyNewlines(t *testing.T) {
+	mt := NewTextMessage()
+	mt.Set(TextHtml, []byte("<p>Hello</p>\n<p>World</p>\n"))
+
+	mb := newMimeBuilder(US_ASCII, SevenBit)
+
+	if c := mt.GetContent(mb); !strings.HasSuffix(c, "\r\n\r\n<p>Hello</p>\r\n<p>World</p>\r\n") {
+		t.Errorf("Bare LF should be replaced with CRLF, got %q", c)
+	}
+
+	mt.Set(TextPlain, []byte("Привет\nмир"))
+
+	mb = newMimeBuilder(UTF8, QuotedPrintable)
+
+	if c := mt.GetContent(mb); !strings.HasSuffix(c, "\r\n\r\n=D0=9F=D1=80=D0=B8=D0=B2=D0=B5=D1=82\r\n=D0=BC=D0=B8=D1=80") {
+		t.Errorf("Invalid quoted-printable body, got %q", c)
+	}
+}
+
+func TestBase64LineWidth(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 30)
+
+	mt := NewTextMessage()
+	mt.Set(TextPlain, body)
+
+	m := NewMail(&MailConfig{Base64LineWidth: 64})
+	m.To("example1@example.com")
+	m.SetMessage(&mt)
+
+	raw, err := m.mb.GetResultMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, encoded, _ := strings.Cut(string(raw), "\r\n\r\n")
+	lines := strings.Split(strings.TrimSuffix(encoded, "\r\n"), "\r\n")
+
+	for i, l := range lines {
+		if len(l) != 64 && (i != len(lines)-1 || len(l) > 64) {
+			t.Errorf("Line %d should be 64 chars long, got %d", i, len(l))
+		}
+	}
+
+	if decoded, _ := base64.StdEncoding.DecodeString(strings.Join(lines, "")); !bytes.Equal(decoded, body) {
+		t.Error("The body is corrupted")
+	}
+
+	m = NewMail(&MailConfig{Base64LineWidth: 70})
+	m.To("example1@example.com")
+
+	if _, err := m.mb.GetResultMessage(0); err == nil {
+		t.Error("A line width that isn't a multiple of 4 should be rejected")
+	}
+}
+
+func TestBase64EncodeTo(t *testing.T) {
+	for _, size := range []int{0, 1, 56, 57, 58, 114, 1000} {
+		text := bytes.Repeat([]byte{0xfe, 'a', 0x01}, size)[:size]
+
+		var out bytes.Buffer
+
+		if err := base64EncodeTo(&out, text, lineLengthLimit); err != nil {
+			t.Fatal(err)
+		}
+
+		lines := strings.Split(out.String(), "\r\n")
+
+		for i, l := range lines {
+			if len(l) != lineLengthLimit && (i != len(lines)-1 || len(l) > lineLengthLimit) {
+				t.Errorf("Line %d of %d bytes should be %d chars long, got %d", i, size, lineLengthLimit, len(l))
+			}
+		}
+
+		if decoded, _ := base64.StdEncoding.DecodeString(strings.Join(lines, "")); !bytes.Equal(decoded, text) {
+			t.Errorf("The text of %d bytes is corrupted", size)
+		}
+
+		if s := base64Encode(text, lineLengthLimit); s != out.String() {
+			t.Errorf("base64Encode and base64EncodeTo should give the same result for %d bytes", size)
+		}
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var out bytes.Buffer
+
+	lw := &lineWriter{w: &out, width: 4}
+
+	// Lines are wrapped across writes of any size
+	for _, p := range []string{"a", "bcd", "efghij", "", "k", "lmnopqrst"} {
+		lw.Write([]byte(p))
+	}
+
+	if expect := "abcd\r\nefgh\r\nijkl\r\nmnop\r\nqrst"; out.String() != expect {
+		t.Errorf("Invalid lines, expect %q, got %q", expect, out.String())
+	}
+}
+
+func TestQuotedPrintableLineWidth(t *testing.T) {
+	body := []byte(strings.Repeat("Привет, мир! Hello, World = 100% ", 10) + "\r\nend \r\n")
+
+	for _, width := range []int{0, 40, 5} {
+		mt := NewTextMessage()
+		mt.Set(TextPlain, body)
+
+		m := NewMail(&MailConfig{Encoding: QuotedPrintable, QuotedPrintableLineWidth: width})
+		m.To("example1@example.com")
+		m.SetMessage(&mt)
+
+		raw, err := m.mb.GetResultMessage(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, encoded, _ := strings.Cut(string(raw), "\r\n\r\n")
+
+		max := width
+		if max == 0 {
+			max = lineLengthLimit
+		}
+
+		for i, l := range strings.Split(encoded, "\r\n") {
+			if len(l) > max {
+				t.Errorf("Line %d should not be longer than %d chars, got %q", i, max, l)
+			}
+		}
+
+		decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(encoded)))
+		if err != nil || !bytes.Equal(bytes.TrimSuffix(decoded, []byte("\r\n")), body) {
+			t.Errorf("The body encoded with width %d is corrupted: %q (%v)", width, decoded, err)
+		}
+	}
+
+	m := NewMail(&MailConfig{QuotedPrintableLineWidth: 80})
+	m.To("example1@example.com")
+
+	if _, err := m.mb.GetResultMessage(0); err == nil {
+		t.Error("A line width greater than 76 should be rejected")
+	}
+}
+
+func TestAssembledMessage(t *testing.T) {
+	content := bytes.Repeat([]byte{0xff, 0x00, 0x80}, 100<<10)
+
+	a := NewAttachment()
+	a.SetAsBinary("large.bin", content)
+
+	img := NewAttachment()
+	img.SetAsBinary("logo.png", []byte{0x89, 'P', 'N', 'G'})
+
+	mt := NewMultipartMixedMessage()
+	mt.SetText(TextPlain, []byte("See the attachment"))
+	mt.AddAttachment(a)
+	mt.AddAttachment(img)
+
+	mail := NewMail(&MailConfig{MessageIDFunc: func() string { return "1@example.com" }})
+	mail.SetDate(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	mail.To("rcpt@example.com")
+	mail.SetMessage(&mt)
+
+	msg, err := mail.mb.assemble(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The attachments are kept as is until the message is written
+	var encoded int
+	for _, seg := range msg.segments {
+		if seg.base64 {
+			encoded += len(seg.data)
+		}
+	}
+
+	if encoded != len(content)+4 {
+		t.Errorf("The attachments should be encoded on writing, got %d bytes to encode", encoded)
+	}
+
+	var out bytes.Buffer
+
+	n, err := msg.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := mail.mb.GetResultMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(out.Bytes(), raw) {
+		t.Error("The written message differs from the result message")
+	}
+
+	if n != int64(len(raw)) || msg.Len() != n {
+		t.Errorf("Invalid message size, expect %d, got %d written and %d reported", len(raw), n, msg.Len())
+	}
+
+	if _, err := mail.mb.assemble(uint(len(raw) - 1)); err == nil {
+		t.Error("The max message size should be checked before the message is written")
+	}
+}
@@ -0,0 +1,239 @@
+package wail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+)
+
+// FromNetMail converts a parsed message into a Mail. It maps the Subject,
+// From, To and Cc fields and the body. Supported bodies are text/plain,
+// text/html, multipart/alternative of text parts and multipart/mixed
+// with a text (or alternative) part followed by attachments
+func FromNetMail(msg *mail.Message) (*Mail, error) {
+	if msg == nil {
+		return nil, errors.New("wail: an empty message has been provided")
+	}
+
+	mediaType, params, err := parseContentType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &MailConfig{}
+
+	if cs, ok := params["charset"]; ok && !strings.HasPrefix(mediaType, "multipart/") {
+		cfg.Charset = charset(strings.ToUpper(cs))
+	}
+
+	m := NewMail(cfg)
+
+	dec := new(mime.WordDecoder)
+
+	subj, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return nil, fmt.Errorf("wail: invalid subject (%w)", err)
+	}
+
+	if err := m.SetSubjectChecked(subj); err != nil {
+		return nil, err
+	}
+
+	if from, err := msg.Header.AddressList("From"); err == nil && len(from) != 0 {
+		if err := m.SetFrom(from[0].Name, from[0].Address); err != nil {
+			return nil, err
+		}
+	} else if err != nil && err != mail.ErrHeaderNotPresent {
+		return nil, fmt.Errorf("wail: invalid From field (%w)", err)
+	}
+
+	fields := []struct {
+		name string
+		add  func(emails ...string) error
+	}{
+		{"To", m.To},
+		{"Cc", m.CopyTo},
+	}
+
+	for _, f := range fields {
+		list, err := msg.Header.AddressList(f.name)
+		if err == mail.ErrHeaderNotPresent {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("wail: invalid %s field (%w)", f.name, err)
+		}
+
+		emails := make([]string, 0, len(list))
+		for _, a := range list {
+			emails = append(emails, a.String())
+		}
+
+		if err := f.add(emails...); err != nil {
+			return nil, err
+		}
+	}
+
+	body, err := netMailBody(mediaType, params, msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	m.SetMessage(body)
+
+	return m, nil
+}
+
+func parseContentType(ctype string) (string, map[string]string, error) {
+	if ctype == "" {
+		return TextPlain.string(), map[string]string{}, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return "", nil, fmt.Errorf("wail: invalid content type (%w)", err)
+	}
+
+	return mediaType, params, nil
+}
+
+func netMailBody(mediaType string, params map[string]string, enc string, r io.Reader) (Message, error) {
+	switch mediaType {
+	case TextPlain.string(), TextHtml.string():
+		t, err := netMailText(mediaType, enc, r)
+		if err != nil {
+			return nil, err
+		}
+
+		return t, nil
+	case multipartAlt.string():
+		alt, err := netMailAlternative(params, r)
+		if err != nil {
+			return nil, err
+		}
+
+		return alt, nil
+	case multipartMix.string():
+		return netMailMixed(params, r)
+	}
+
+	return nil, fmt.Errorf("wail: unsupported message content type %s", mediaType)
+}
+
+func netMailText(mediaType, enc string, r io.Reader) (*TextMessage, error) {
+	text, err := io.ReadAll(transferDecoder(r, enc))
+	if err != nil {
+		return nil, err
+	}
+
+	ctype := TextPlain
+
+	switch mediaType {
+	case TextHtml.string():
+		ctype = TextHtml
+	case TextWatchHtml.string():
+		ctype = TextWatchHtml
+	}
+
+	t := NewTextMessage()
+	t.Set(ctype, text)
+
+	return &t, nil
+}
+
+func netMailAlternative(params map[string]string, r io.Reader) (*MultipartAltMessage, error) {
+	alt := NewMultipartAltMessage()
+
+	err := eachNetMailPart(params, r, func(mediaType string, _ map[string]string, p *multipart.Part) error {
+		if mediaType != TextPlain.string() && mediaType != TextHtml.string() && mediaType != TextWatchHtml.string() {
+			return fmt.Errorf("wail: unsupported alternative part %s", mediaType)
+		}
+
+		t, err := netMailText(mediaType, p.Header.Get("Content-Transfer-Encoding"), p)
+		if err != nil {
+			return err
+		}
+
+		alt.msg = append(alt.msg, altMessage{text: *t, order: len(alt.msg)})
+		return nil
+	})
+
+	return &alt, err
+}
+
+func netMailMixed(params map[string]string, r io.Reader) (*MultipartMixedMessage, error) {
+	mt := NewMultipartMixedMessage()
+
+	err := eachNetMailPart(params, r, func(mediaType string, partParams map[string]string, p *multipart.Part) error {
+		enc := p.Header.Get("Content-Transfer-Encoding")
+
+		if mt.body == nil && p.FileName() == "" {
+			body, err := netMailBody(mediaType, partParams, enc, p)
+			if err != nil {
+				return err
+			}
+
+			if _, ok := body.(*MultipartMixedMessage); ok {
+				return errors.New("wail: nested multipart/mixed messages are not supported")
+			}
+
+			mt.body = body
+			return nil
+		}
+
+		content, err := io.ReadAll(transferDecoder(p, enc))
+		if err != nil {
+			return err
+		}
+
+		a := NewAttachment()
+		a.SetAsBinary(p.FileName(), content)
+
+		// The original type is kept, application/octet-stream is
+		// only used if the media type can't be registered
+		if ctype, err := RegisterContentType(mediaType); err == nil {
+			a.SetContentType(ctype)
+			a.typeParams = partParams
+		}
+
+		mt.AddAttachment(a)
+		return nil
+	})
+
+	return &mt, err
+}
+
+// eachNetMailPart calls f for each part of the multipart body
+func eachNetMailPart(params map[string]string, r io.Reader, f func(string, map[string]string, *multipart.Part) error) error {
+	boundary, ok := params["boundary"]
+	if !ok {
+		return errors.New("wail: multipart boundary is not specified")
+	}
+
+	mr := multipart.NewReader(r, boundary)
+
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		mediaType, partParams, err := parseContentType(p.Header.Get("Content-Type"))
+		if err != nil {
+			return err
+		}
+
+		if err := f(mediaType, partParams, p); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package wail
+
+import (
+	"encoding/base64"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+const netMailExample = "From: Alex <alex@example.com>\r\n" +
+	"To: example1@example.com, Bob <example2@example.com>\r\n" +
+	"Cc: \"Doe, John\" <example3@example.com>\r\n" +
+	"Subject: =?UTF-8?B?0J/RgNC40LLQtdGC?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Hello, World=21\r\n"
+
+func TestFromNetMail(t *testing.T) {
+	msg, err := mail.ReadMessage(strings.NewReader(netMailExample))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := FromNetMail(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := m.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"Subject": "Привет",
+		"From":    "Alex <alex@example.com>",
+		"To":      "<example1@example.com>, Bob <example2@example.com>",
+		"Cc":      `"Doe, John" <example3@example.com>`,
+	}
+
+	for k, v := range expect {
+		if got := info.Header.Get(k); got != v {
+			t.Errorf("Invalid %s field, expect %s, got %s", k, v, got)
+		}
+	}
+
+	if len(info.Parts) != 1 || info.Parts[0].ContentType != "text/plain" {
+		t.Errorf("Invalid body, got %+v", info.Parts)
+	}
+
+	body := base64.StdEncoding.EncodeToString([]byte("Hello, World!\r\n"))
+
+	if raw, _ := m.mb.GetResultMessage(0); !strings.Contains(string(raw), "\r\n\r\n"+body+"\r\n") {
+		t.Errorf("Invalid re-rendered message, got %q", raw)
+	}
+
+	if len(m.recipients) != 3 {
+		t.Errorf("Expect 3 recipients, got %v", m.recipients)
+	}
+
+	msg, _ = mail.ReadMessage(strings.NewReader("Content-Type: image/png\r\n\r\n..."))
+
+	if _, err := FromNetMail(msg); err == nil {
+		t.Error("Unsupported content type should return an error")
+	}
+}
+
+func TestFromNetMailAttachments(t *testing.T) {
+	raw := "From: <alex@example.com>\r\n" +
+		"To: <example1@example.com>\r\n" +
+		"Subject: Report\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b1\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		"--b1\r\n" +
+		"Content-Type: image/png; name=chart.png\r\n" +
+		"Content-Disposition: attachment; filename=chart.png\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw0K\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=report.pdf\r\n" +
+		"\r\n" +
+		"%PDF-1.4\r\n" +
+		"--b1--\r\n"
+
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := FromNetMail(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := m.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []struct{ ctype, filename string }{
+		{"text/plain", ""},
+		{"image/png", "chart.png"},
+		{"application/pdf", "report.pdf"},
+	}
+
+	if len(info.Parts) != len(expect) {
+		t.Fatalf("Expect %d parts, got %+v", len(expect), info.Parts)
+	}
+
+	for i, e := range expect {
+		if p := info.Parts[i]; p.ContentType != e.ctype || p.Filename != e.filename {
+			t.Errorf("Invalid part %d, expect %s %s, got %s %s", i, e.ctype, e.filename, p.ContentType, p.Filename)
+		}
+	}
+
+	if out, _ := m.mb.GetResultMessage(0); !strings.Contains(string(out), "Content-Type: image/png; name=chart.png\r\n") {
+		t.Errorf("The parameters of the attachment type should be kept, got %q", out)
+	}
+}
@@ -0,0 +1,262 @@
+package wail
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
+)
+
+// ErrPoolTimeout is returned when all the pool connections
+// are busy for longer than the configured MaxWait
+var ErrPoolTimeout = errors.New("wail: timed out waiting for a free connection")
+
+// PoolConfig contains settings of the connection pool
+type PoolConfig struct {
+	// Size is a maximum number of connections opened
+	// by the pool at the same time. Default is 1
+	Size int
+
+	// MaxWait is a maximum time to wait for a free connection when
+	// all of them are busy. Zero value means to wait as long as needed
+	MaxWait time.Duration
+}
+
+// PoolStats contains statistics of the connection pool
+type PoolStats struct {
+	// Active is a number of connections that are in use at the moment
+	Active int
+
+	// Idle is a number of opened connections that are waiting to be used
+	Idle int
+
+	// Total is a number of opened connections (active and idle)
+	Total int
+
+	// Waiting is a number of callers waiting for a free connection right now
+	Waiting int
+
+	// WaitCount is a total number of times when a caller had to wait
+	WaitCount int64
+
+	// WaitDuration is a total time spent waiting for a free connection
+	WaitDuration time.Duration
+
+	// WaitTimeouts is a number of times when waiting exceeded MaxWait
+	WaitTimeouts int64
+}
+
+// ClientPool shares a limited number of connections
+// to the SMTP server between goroutines
+type ClientPool struct {
+	cfg     *SmtpConfig
+	maxWait time.Duration
+
+	// limiter is shared between all clients of the pool,
+	// so the rate limit applies to the pool as a whole
+	limiter *rate.Limiter
+
+	// tokens caches OAuth 2.0 access tokens for all clients of the pool
+	tokens oauth2.TokenSource
+
+	// slots limits a number of connections in use
+	slots chan struct{}
+
+	mu     sync.Mutex
+	idle   []*SmtpClient
+	stats  PoolStats
+	closed bool
+}
+
+// NewClientPool returns a new pool of SMTP clients. Connections are
+// established lazily when they are needed for the first time
+func NewClientPool(cfg *SmtpConfig, poolCfg PoolConfig) *ClientPool {
+	if poolCfg.Size <= 0 {
+		poolCfg.Size = 1
+	}
+
+	p := &ClientPool{
+		cfg:     cfg,
+		maxWait: poolCfg.MaxWait,
+		slots:   make(chan struct{}, poolCfg.Size),
+	}
+
+	if cfg != nil {
+		p.limiter = newLimiter(cfg.RateLimit)
+		p.tokens = reuseTokenSource(cfg.Sender.TokenSource)
+	}
+
+	return p
+}
+
+// Get returns a connected client from the pool. If all connections are busy
+// Get waits for a free one at most MaxWait. Each client received from
+// Get must be returned to the pool by calling Put
+func (p *ClientPool) Get() (*SmtpClient, error) {
+	return p.GetContext(context.Background())
+}
+
+// GetContext is like Get but stops waiting for a free connection when ctx is done
+func (p *ClientPool) GetContext(ctx context.Context) (*SmtpClient, error) {
+	if err := p.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+
+		return nil, errors.New("wail: the pool is closed")
+	}
+
+	if n := len(p.idle); n != 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+
+		p.stats.Idle--
+		p.stats.Active++
+		p.mu.Unlock()
+
+		return c, nil
+	}
+
+	p.mu.Unlock()
+
+	c := NewClient(p.cfg)
+	c.limiter = p.limiter
+	c.tokens = p.tokens
+
+	if err := c.Dial(); err != nil {
+		<-p.slots
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.stats.Active++
+	p.stats.Total++
+	p.mu.Unlock()
+
+	return c, nil
+}
+
+func (p *ClientPool) acquire(ctx context.Context) error {
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	start := time.Now()
+
+	p.mu.Lock()
+	p.stats.Waiting++
+	p.stats.WaitCount++
+	p.mu.Unlock()
+
+	var timeout <-chan time.Time
+
+	if p.maxWait > 0 {
+		t := time.NewTimer(p.maxWait)
+		defer t.Stop()
+
+		timeout = t.C
+	}
+
+	var err error
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-timeout:
+		err = ErrPoolTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	p.mu.Lock()
+	p.stats.Waiting--
+	p.stats.WaitDuration += time.Since(start)
+
+	if err == ErrPoolTimeout {
+		p.stats.WaitTimeouts++
+	}
+
+	p.mu.Unlock()
+
+	return err
+}
+
+// Put returns the client to the pool
+func (p *ClientPool) Put(c *SmtpClient) {
+	p.mu.Lock()
+
+	p.stats.Active--
+
+	if p.closed || c.client == nil {
+		p.stats.Total--
+		p.mu.Unlock()
+
+		c.Close()
+	} else {
+		p.idle = append(p.idle, c)
+		p.stats.Idle++
+		p.mu.Unlock()
+	}
+
+	<-p.slots
+}
+
+// Send takes a client from the pool, sends the mail and returns the client back
+func (p *ClientPool) Send(m *Mail) error {
+	return p.SendContext(context.Background(), m)
+}
+
+// SendContext is like Send but stops waiting for a free
+// connection or for the rate limit when ctx is done
+func (p *ClientPool) SendContext(ctx context.Context, m *Mail) error {
+	c, err := p.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer p.Put(c)
+
+	return c.SendContext(ctx, m)
+}
+
+// Stats returns the current statistics of the pool
+func (p *ClientPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stats
+}
+
+// Close closes all idle connections. Active connections
+// are closed when they are returned to the pool
+func (p *ClientPool) Close() error {
+	p.mu.Lock()
+
+	idle := p.idle
+
+	p.idle = nil
+	p.closed = true
+	p.stats.Total -= len(idle)
+	p.stats.Idle = 0
+
+	p.mu.Unlock()
+
+	var errs []error
+
+	for _, c := range idle {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,76 @@
+package wail
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPoolStats(t *testing.T) {
+	ts := newTestServer(t)
+
+	p := NewClientPool(ts.config(), PoolConfig{Size: 2, MaxWait: 50 * time.Millisecond})
+	defer p.Close()
+
+	c1, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := p.Stats(); s.Active != 2 || s.Idle != 0 || s.Total != 2 {
+		t.Errorf("Invalid stats of a saturated pool: %+v", s)
+	}
+
+	if _, err := p.Get(); !errors.Is(err, ErrPoolTimeout) {
+		t.Errorf("Expect ErrPoolTimeout, got %v", err)
+	}
+
+	s := p.Stats()
+	if s.WaitCount != 1 || s.WaitTimeouts != 1 || s.WaitDuration < 50*time.Millisecond {
+		t.Errorf("Invalid wait stats: %+v", s)
+	}
+
+	p.Put(c1)
+
+	if s := p.Stats(); s.Active != 1 || s.Idle != 1 || s.Total != 2 {
+		t.Errorf("Invalid stats after Put: %+v", s)
+	}
+
+	c3, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c3 != c1 {
+		t.Error("An idle connection should be reused")
+	}
+
+	// A waiting caller gets the connection as soon as it's returned
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.Put(c2)
+	}()
+
+	p.maxWait = time.Second
+
+	c4, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := p.Stats(); s.WaitCount != 2 || s.WaitTimeouts != 1 {
+		t.Errorf("Invalid wait stats: %+v", s)
+	}
+
+	p.Put(c3)
+	p.Put(c4)
+
+	if s := p.Stats(); s.Active != 0 || s.Idle != 2 || s.Total != 2 || s.Waiting != 0 {
+		t.Errorf("Invalid stats of an idle pool: %+v", s)
+	}
+}
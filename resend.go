@@ -0,0 +1,104 @@
+package wail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+)
+
+// ResentConfig describes the resending of a message (RFC 5322 3.6.6)
+type ResentConfig struct {
+	// From is the address of the one who resends the message
+	From string
+
+	// To and Cc are the addresses to which the message is resent
+	To []string
+	Cc []string
+
+	// Date is the moment of resending. Default is the current time
+	Date time.Time
+
+	// MessageID is the Resent-Message-ID. By default a random ID is used
+	MessageID string
+}
+
+// Resend returns the original message with the Resent-* block prepended,
+// so the original header fields stay untouched. Send the result with
+// SendRaw to the Resent-To and Resent-Cc addresses
+func Resend(original []byte, cfg ResentConfig) ([]byte, error) {
+	if _, err := mail.ReadMessage(bytes.NewReader(original)); err != nil {
+		return nil, fmt.Errorf("wail: invalid original message (%w)", err)
+	}
+
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("wail: invalid Resent-From address (%w)", err)
+	}
+
+	if len(cfg.To) == 0 && len(cfg.Cc) == 0 {
+		return nil, errors.New("wail: no addresses to resend the message to")
+	}
+
+	to, err := resentAddrs(cfg.To)
+	if err != nil {
+		return nil, err
+	}
+
+	cc, err := resentAddrs(cfg.Cc)
+	if err != nil {
+		return nil, err
+	}
+
+	date := cfg.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	mb := &mimeBuilder{fromAddr: from.Address}
+
+	if cfg.MessageID != "" {
+		id := cfg.MessageID
+		mb.messageID = func() string { return id }
+	}
+
+	var block bytes.Buffer
+
+	// The block of the latest resending goes first
+	fmt.Fprintf(&block, "Resent-Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&block, "Resent-From: %s\r\n", from)
+
+	if len(to) != 0 {
+		fmt.Fprintf(&block, "Resent-To: %s\r\n", foldList(to, ", ", len("Resent-To")+1))
+	}
+
+	if len(cc) != 0 {
+		fmt.Fprintf(&block, "Resent-Cc: %s\r\n", foldList(cc, ", ", len("Resent-Cc")+1))
+	}
+
+	id, err := mb.newMessageID()
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(&block, "Resent-Message-ID: %s\r\n", id)
+
+	return append(block.Bytes(), original...), nil
+}
+
+// resentAddrs parses the addresses and formats them for a Resent-* field.
+// A display name is encoded if it's needed
+func resentAddrs(emails []string) ([]string, error) {
+	out := make([]string, len(emails))
+	for i, e := range emails {
+		addr, err := mail.ParseAddress(e)
+		if err != nil {
+			return nil, fmt.Errorf("wail: invalid resent address (%w)", err)
+		}
+
+		out[i] = addr.String()
+	}
+
+	return out, nil
+}
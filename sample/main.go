@@ -23,6 +23,11 @@ func main() {
 		},
 	}
 
+	// Use OAuth2 instead of the password if its credentials are set
+	if ts, err := wail.TokenSourceFromEnv(); err == nil {
+		cfg.Sender.TokenSource = ts
+	}
+
 	c := wail.NewClient(cfg)
 
 	err := c.Dial()
@@ -63,19 +68,13 @@ func main() {
 }
 
 // CreatePlainTextMessage creates a text/plain message
-func CreatePlainTextMessage() wail.TextMessage {
-	mt := wail.NewTextMessage()
-	mt.Set(wail.TextPlain, []byte("Hello, World"))
-
-	return mt
+func CreatePlainTextMessage() wail.Message {
+	return wail.PlainText("Hello, World")
 }
 
 // CreateHtmlTextMessage creates a text/html message
-func CreateHtmlTextMessage() wail.TextMessage {
-	mt := wail.NewTextMessage()
-	mt.Set(wail.TextHtml, []byte("<b>Hello, World</b>"))
-
-	return mt
+func CreateHtmlTextMessage() wail.Message {
+	return wail.HTML("<b>Hello, World</b>")
 }
 
 // CreateMultipartMixedMessage creates a multipart/mixed message